@@ -1,84 +1,765 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 type RunRequest struct {
-	Cmd       string            `json:"cmd"`
-	Files     map[string]string `json:"files"`
-	TimeoutMs int               `json:"timeout_ms"`
+	Cmd       string              `json:"cmd"`
+	Files     map[string]FileSpec `json:"files"`
+	TimeoutMs int                 `json:"timeout_ms"`
+	// Debug returns the tail of the guest serial console in Console and
+	// keeps the per-run transcript on disk for inspection.
+	Debug bool `json:"debug"`
+	// FailOnNonzero turns a nonzero exit into a 422 (504 on timeout).
+	FailOnNonzero bool `json:"fail_on_nonzero"`
+	// CaptureRusage runs the command under time(1) in the guest and reports
+	// its resource usage. Rusage stays null if the rootfs has no time binary.
+	CaptureRusage bool `json:"capture_rusage"`
+	// CallbackURL makes /run asynchronous: it answers 202 with the exec_id
+	// and POSTs the result to this URL when the run finishes.
+	CallbackURL string `json:"callback_url"`
+	// Image selects a registered image profile; empty means the server's
+	// default image ("default" unless -default-image says otherwise).
+	Image string `json:"image"`
+	// OutputGlobs are patterns relative to /work; matching files are read
+	// back from the image after the run and returned in Outputs.
+	OutputGlobs []string `json:"output_globs"`
+	// Seccomp names a syscall filter applied in the guest around the
+	// command: "none" (the default), "default" or "strict".
+	Seccomp string `json:"seccomp"`
+	// FakeTime runs the command under libfaketime: an absolute start time
+	// (RFC 3339 or "2006-01-02 15:04:05", UTC) from which the clock ticks,
+	// or an offset like "+2d" / "-90m". Ignored if the rootfs lacks the
+	// library.
+	FakeTime string `json:"fake_time"`
+	// Deterministic removes the usual sources of run-to-run differences:
+	// address space randomization, hash seeds, locale and timezone. With an
+	// absolute FakeTime the clock is frozen rather than ticking.
+	Deterministic bool `json:"deterministic"`
+	// CaptureCore enables core dumps for the command and returns the core
+	// file (up to maxCoreBytes) and the killing signal in Core.
+	CaptureCore bool `json:"capture_core"`
+	// KeepAliveOnFailure leaves the VM running after a failed run (nonzero
+	// exit, timeout) and reports where to attach. Only honored when the
+	// server runs with -debug-keep-alive.
+	KeepAliveOnFailure bool `json:"keep_alive_on_failure"`
+	// Steps replace Cmd with a sequence of commands run one after another
+	// in the same guest; each gets its own entry in StepResults.
+	Steps []StepSpec `json:"steps"`
+	// Dmesg returns the guest kernel log, captured after the command, in
+	// RunResponse.Dmesg.
+	Dmesg bool `json:"dmesg"`
+	// Setup is sourced before the command (or steps) in the same shell, so
+	// its exports and cd carry over. If it fails the command does not run.
+	Setup string `json:"setup"`
+	// TmpfsWork runs the command against a tmpfs copy of /work (of
+	// TmpfsWorkMB, default 64) so its writes never touch the image.
+	TmpfsWork   bool `json:"tmpfs_work"`
+	TmpfsWorkMB int  `json:"tmpfs_work_mb"`
+	// WorkQuotaMiB caps /work at this size: it becomes a tmpfs_work of that
+	// size, so writes beyond it fail with ENOSPC in the guest.
+	WorkQuotaMiB int `json:"work_quota_mib"`
+	// Tty runs the command on a pseudo-terminal, so it sees a terminal on
+	// stdin/stdout/stderr. Its stdout and stderr come back combined.
+	Tty bool `json:"tty"`
+	// Shell runs the command (and each step): "sh" (the default), "ash",
+	// "dash" or "bash", or the same as a /bin path. It must exist in the
+	// image.
+	Shell string `json:"shell"`
+	// Timings adds a per-phase breakdown of the run to the response.
+	Timings bool `json:"timings"`
+	// ParseJSONStdout also returns stdout as stdout_json when it is valid
+	// JSON.
+	ParseJSONStdout bool `json:"parse_json_stdout"`
+	// FetchFiles maps paths under /work to http(s) URLs that the host
+	// downloads into the image after Files. A value may be prefixed with
+	// "sha256:<hex>:" to verify the download.
+	FetchFiles map[string]string `json:"fetch_files"`
+	// StrictPaths rejects files and fetch_files names that are the same
+	// path once cleaned, or that differ only in case.
+	StrictPaths bool `json:"strict_paths"`
+	// NoChdir keeps the command in init's working directory (usually /)
+	// even when files were injected into /work.
+	NoChdir bool `json:"no_chdir"`
+	// ExtraBootArgs are appended to the guest kernel command line, e.g.
+	// "nokaslr". Only honored when the server runs with
+	// -allow-extra-boot-args; init=, panic= and the command cannot be set.
+	ExtraBootArgs string `json:"extra_boot_args"`
+	// ReturnScratch attaches an empty drive of ScratchMiB (default 256) at
+	// /scratch and returns its contents as a tar archive in Scratch.
+	ReturnScratch bool `json:"return_scratch"`
+	ScratchMiB    int  `json:"scratch_mib"`
+	// Env is exported for the command (and setup and steps), over the
+	// image profile's env.
+	Env map[string]string `json:"env"`
+	// LiveFiles lets POST /executions/{id}/files add files to /work while
+	// the command runs. The command's stdin is then /dev/null.
+	LiveFiles bool `json:"live_files"`
+	// Hostname is set in the guest before the command runs, and
+	// HostsEntries (name to IP address) are added to its /etc/hosts.
+	Hostname     string            `json:"hostname"`
+	HostsEntries map[string]string `json:"hosts_entries"`
+	// LineBuffered runs the command under stdbuf -oL -eL (if the image has
+	// it), so that a run killed on timeout still returns what it printed.
+	LineBuffered bool `json:"line_buffered"`
+	// Stdin (text) or StdinB64 (base64, for binary input) is fed to the
+	// command's stdin byte for byte.
+	Stdin    string `json:"stdin"`
+	StdinB64 string `json:"stdin_b64"`
+	// Pipefail runs cmd (and setup and each step) with set -o pipefail, so
+	// a pipeline fails if any of its commands does.
+	Pipefail bool `json:"pipefail"`
+	// OverallTimeoutMs bounds the whole run in wall-clock time: waiting
+	// for memory, fetch_files, image prep and boot as well as the command,
+	// none of which timeout_ms counts. 0 is no bound.
+	OverallTimeoutMs int `json:"overall_timeout_ms"`
+
+	// uploads holds the file parts of a multipart request, streamed into
+	// /work after Files while the rootfs is mounted.
+	uploads *multipart.Reader
+	// execID is assigned by the handler before the request is executed.
+	execID string
+	// hostKernel is set by executors that run on the host's kernel, whose
+	// log says nothing about this run.
+	hostKernel bool
+	// scratchDevice is the guest block device of the return_scratch drive.
+	scratchDevice string
+	// imageEnv is the image profile's env, which Env overrides.
+	imageEnv map[string]string
+	// heartbeat is how often the wrapper prints heartbeatMarker while the
+	// command runs; 0 for none. Only runExecution sets it.
+	heartbeat time.Duration
+}
+
+// StepSpec is one command in RunRequest.Steps. A failing step stops the
+// sequence unless ContinueOnError is set.
+type StepSpec struct {
+	Cmd             string `json:"cmd"`
+	ContinueOnError bool   `json:"continue_on_error"`
+}
+
+// FileSpec is one entry in RunRequest.Files. It decodes from either a plain
+// string (the content, executable if it starts with "#!") or an object
+// {"content", "mode", "executable"} that sets the permissions explicitly.
+type FileSpec struct {
+	Content string `json:"content"`
+	// Mode is an octal permission string such as "0640"; it takes
+	// precedence over Executable.
+	Mode       string `json:"mode,omitempty"`
+	Executable *bool  `json:"executable,omitempty"`
+}
+
+func (f *FileSpec) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*f = FileSpec{}
+		return json.Unmarshal(b, &f.Content)
+	}
+	type plain FileSpec
+	return json.Unmarshal(b, (*plain)(f))
 }
 
+// fileMode returns the requested permissions, or 0 to fall back to the
+// shebang heuristic.
+func (f FileSpec) fileMode() (os.FileMode, error) {
+	if f.Mode != "" {
+		m, err := strconv.ParseUint(f.Mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return 0, fmt.Errorf("invalid mode %q (want octal permissions like \"0644\")", f.Mode)
+		}
+		return os.FileMode(m), nil
+	}
+	if f.Executable != nil {
+		if *f.Executable {
+			return 0o755, nil
+		}
+		return 0o644, nil
+	}
+	return 0, nil
+}
+
+// RunResponse fields are only ever added within a schema version; removing
+// or changing the meaning of one bumps responseSchemaVersion.
 type RunResponse struct {
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
-	ExitCode int    `json:"exit_code"`
+	// SchemaVersion is set on top-level responses only, not step results.
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	ExecID   string  `json:"exec_id"`
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+	ExitCode int     `json:"exit_code"`
+	Console  string  `json:"console,omitempty"`
+	Rusage   *Rusage `json:"rusage,omitempty"`
+	// VMMetrics is set for debug runs on the firecracker executor.
+	VMMetrics *VMMetrics `json:"vm_metrics,omitempty"`
+	// Outputs maps paths under /work to file contents (base64 in JSON).
+	Outputs          map[string][]byte `json:"outputs,omitempty"`
+	OutputsTruncated bool              `json:"outputs_truncated,omitempty"`
+	KeptVM           *KeptVM           `json:"kept_vm,omitempty"`
+	// DurationMs is only reported for steps.
+	DurationMs  int64         `json:"duration_ms,omitempty"`
+	StepResults []RunResponse `json:"step_results,omitempty"`
+	Dmesg       string        `json:"dmesg,omitempty"`
+	// SetupOutput is setup's stdout and stderr, kept out of Stdout.
+	SetupOutput   string `json:"setup_output,omitempty"`
+	SetupExitCode *int   `json:"setup_exit_code,omitempty"`
+	// StdoutJSON is Stdout itself when parse_json_stdout was asked for and
+	// Stdout is valid JSON.
+	StdoutJSON json.RawMessage `json:"stdout_json,omitempty"`
+	// Timings is set when the request asked for it.
+	Timings *Timings `json:"timings,omitempty"`
+	// OutputIncomplete means the guest never reported an exit code (the VM
+	// halted or died mid-run), so Stdout holds only what reached the
+	// console before that.
+	OutputIncomplete bool `json:"output_incomplete,omitempty"`
+	// StreamsCombined means stderr is interleaved in Stdout (tty runs).
+	StreamsCombined bool `json:"streams_combined,omitempty"`
+	// ExitReason says how the run ended: "exited" (the command reported
+	// its exit code), "timeout", "killed" (DELETE /executions or the client
+	// went away), "halted" (the guest shut down without reporting),
+	// "vm_exited" (firecracker died or the guest rebooted mid-run),
+	// "unresponsive" (the guest's heartbeats stopped) or "overall_timeout"
+	// (overall_timeout_ms ran out).
+	ExitReason string `json:"exit_reason,omitempty"`
+	// ResourceExhausted is "memory" when the guest kernel's OOM killer
+	// fired during a failed run, or "disk" when a failed run left a tmpfs
+	// /work (nearly) full; ExitCode stays whatever the command got (usually
+	// 137 for memory).
+	ResourceExhausted string `json:"resource_exhausted,omitempty"`
+	// Scratch is a tar archive of /scratch for return_scratch runs.
+	Scratch []byte `json:"scratch,omitempty"`
+	// Core is set for capture_core runs that died from a signal or left a
+	// core file behind.
+	Core *CoreDump `json:"core,omitempty"`
+}
+
+// CoreDump is the newest core file the guest wrote, if any, and the signal
+// that ended the command. Data (base64 in JSON) is cut at maxCoreBytes.
+type CoreDump struct {
+	Signal    string `json:"signal,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// KeptVM describes a VM left running by keep_alive_on_failure.
+type KeptVM struct {
+	PID         int       `json:"pid"`
+	SocketPath  string    `json:"socket_path"`
+	ConsolePath string    `json:"console_path"`
+	LogPath     string    `json:"log_path"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Timings breaks a run down by phase, in milliseconds. Phases that did not
+// happen (e.g. VM boot under the namespace executor) are zero.
+type Timings struct {
+	// Mounting the rootfs and injecting files and scripts.
+	ImagePrepMs int64 `json:"image_prep_ms"`
+	// Starting firecracker until its API socket is up and configured.
+	VMStartMs int64 `json:"vm_start_ms"`
+	// Attaching the drives and booting until guest init reported in.
+	BootMs int64 `json:"boot_ms"`
+	// From init reporting in until the exit code was seen (host clock).
+	ExecMs int64 `json:"exec_ms"`
+	// The command alone, measured by the guest; nil if it never reported.
+	CommandMs *int64 `json:"command_ms,omitempty"`
+	TotalMs   int64  `json:"total_ms"`
+}
+
+type Rusage struct {
+	MaxRSSKB    int64   `json:"max_rss_kb"`
+	UserSec     float64 `json:"user_sec"`
+	SystemSec   float64 `json:"system_sec"`
+	MajorFaults int64   `json:"major_faults"`
+	MinorFaults int64   `json:"minor_faults"`
 }
 
 const (
-	fcSocket   = "/tmp/fc.sock"
-	fcConsole  = "/tmp/guest-console.log"
-	fcLog      = "/tmp/firecracker/firecracker.log"
+	// Paths for the built-in "default" image profile.
 	kernelPath = "/home/milan/fc/hello-vmlinux.bin"
 	rootfsPath = "/home/milan/fc/rootfs.ext4"
+
+	// Reported in RunResponse.SchemaVersion and the schemaVersionHeader.
+	responseSchemaVersion = 1
+	schemaVersionHeader   = "X-Sandboxd-Schema-Version"
+
+	// "true" or "false" overrides -strict-json for one request.
+	strictHeader = "X-Sandboxd-Strict"
+
+	consoleTailLines = 200
+
+	// guestErrorExitCode reports that the guest failed to run the command at
+	// all, as opposed to the command itself failing (cf. docker run).
+	guestErrorExitCode = 125
 )
 
-/* ---------------- Firecracker helpers ---------------- */
+// Tunables, overridable by flags in main.
+var (
+	// Per-run scratch space (mount points, sockets, consoles) lives under
+	// runBaseDir/<execID>. Startup refuses a base with less than
+	// runBaseMinFreeMiB available.
+	runBaseDir        = "/tmp/sandboxd"
+	runBaseMinFreeMiB = 256
 
-func startFirecracker() (*exec.Cmd, *os.File, error) {
-	_ = os.Remove(fcSocket)
-	_ = os.Remove(fcConsole)
+	// Retries (with doubling backoff) for transient firecracker startup failures.
+	startRetries = 2
+	startBackoff = 100 * time.Millisecond
 
-	logDir := filepath.Dir(fcLog)
-	if err := os.MkdirAll(logDir, 0o755); err != nil {
-		return nil, nil, err
+	// Retries (with doubling backoff) for loop mounts that fail because
+	// concurrent runs have taken every free loop device.
+	mountRetries = 3
+	mountBackoff = 50 * time.Millisecond
+
+	// keep_alive_on_failure is refused unless allowKeepAlive is set; kept
+	// VMs are killed after keepAliveTTL.
+	allowKeepAlive = false
+	keepAliveTTL   = 10 * time.Minute
+
+	// extra_boot_args is refused unless allowExtraBootArgs is set.
+	allowExtraBootArgs = false
+
+	// fetch_files is refused unless allowFetchFiles is set, and downloads
+	// never reach loopback, link-local or private addresses unless
+	// allowFetchPrivate is set too.
+	allowFetchFiles   = false
+	allowFetchPrivate = false
+
+	// Finished /run/async results are dropped after resultTTL if nobody
+	// fetches them.
+	resultTTL = 10 * time.Minute
+
+	// Results of runs with an Idempotency-Key are replayed for
+	// idempotencyTTL; at most maxIdempotencyKeys are remembered.
+	idempotencyTTL     = 10 * time.Minute
+	maxIdempotencyKeys = 1024
+
+	// Image used when a request names none.
+	defaultImage = "default"
+
+	// Machine size of every VM.
+	vmVcpus  = 1
+	vmMemMiB = 256
+
+	// Guest memory all running VMs may have between them; 0 is no limit.
+	// A run that does not fit waits up to admissionTimeout for memory to
+	// free up, then gets RESOURCE_EXHAUSTED (at once if it is 0).
+	memBudgetMiB     = 0
+	admissionTimeout = 0 * time.Second
+
+	// With maxRuns set, the server takes that many runs and then shuts
+	// down once they are done, for workers that a scheduler recycles.
+	maxRuns = 0
+
+	// Once breakerFailurePct percent of the last breakerWindow runs failed
+	// on the host, runs are refused for breakerCooldown; 0 turns the
+	// breaker off.
+	breakerFailurePct = 0
+	breakerWindow     = 20
+	breakerCooldown   = 30 * time.Second
+
+	// Writable space a run gets on top of a read_only image, on top of
+	// what its files and scripts take up.
+	overlayMiB = 256
+
+	// How long a booted guest gets to report "[guest] init started". This
+	// is separate from (and not charged to) timeout_ms.
+	initTimeout = 5 * time.Second
+
+	// With termGrace set, a run that hits timeout_ms gets SIGTERM in the
+	// guest first and is only killed if it is still going termGrace later.
+	// 0 kills it outright.
+	termGrace = 0 * time.Second
+
+	// With guestHeartbeat set, the guest prints a heartbeat this often
+	// while the command runs, and a run that misses heartbeatMisses of
+	// them in a row is stopped as unresponsive. 0 turns it off.
+	guestHeartbeat = 0 * time.Second
+
+	// Upper bound on timeout_ms; larger requests are rejected.
+	maxTimeoutMs = 10 * 60 * 1000
+
+	// Upper bound on a /run body, multipart uploads included; larger
+	// bodies are cut off and answered with 413.
+	maxBodyBytes int64 = 256 << 20
+
+	// Reject request bodies with fields RunRequest does not have, rather
+	// than ignoring them; strictHeader overrides it per request.
+	strictJSON = false
+
+	// Upper bound on scratch_mib.
+	maxScratchMiB = 1024
+
+	// Reported when a run exceeds timeout_ms.
+	timeoutExitCode = 124
+	timeoutMessage  = "execution timed out"
+)
+
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func envIntOr(name string, def int) int {
+	if v, ok := os.LookupEnv(name); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("ignoring invalid %s=%q", name, v)
+	}
+	return def
+}
+
+func fcLogPath(runDir string) string {
+	return filepath.Join(runDir, "firecracker.log")
+}
+
+func newExecID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func tailLines(text string, n int) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return ""
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func consoleTail(consolePath string) string {
+	b, err := os.ReadFile(consolePath)
+	if err != nil {
+		return ""
+	}
+	return tailLines(string(b), consoleTailLines)
+}
+
+/* ---------------- Image profiles ---------------- */
+
+// How a profile's init learns which command to run.
+const (
+	// CMD=... on the kernel command line; the kernel hands unrecognised
+	// key=value parameters to init as environment variables.
+	cmdTransportEnv = "env"
+	// Appended after "--" on the kernel command line, i.e. init's argv.
+	cmdTransportArg = "arg"
+	// Nothing on the command line; init runs guestRunScript itself.
+	cmdTransportFile = "file"
+)
+
+type imageProfile struct {
+	KernelPath   string `json:"kernel_path"`
+	RootfsPath   string `json:"rootfs_path"`
+	InitPath     string `json:"init_path"`
+	CmdTransport string `json:"cmd_transport"`
+	// ReadOnly attaches the rootfs read-only and gives every run its own
+	// writable drive, which the guest init stacks on top with overlayfs
+	// (see guestInitScript). Runs on the image are then isolated from each
+	// other and can share it concurrently. Only the firecracker executor
+	// honors it.
+	ReadOnly bool `json:"read_only"`
+	// Env is exported by the wrapper for every run on the image; a
+	// request's env overrides it name by name.
+	Env map[string]string `json:"env,omitempty"`
+
+	// extraBootArgs holds a request's extra_boot_args for this run.
+	extraBootArgs string
+}
+
+// imagesMu guards imageProfiles and defaultImage, which /admin/reload may
+// change while runs look them up.
+var imagesMu sync.RWMutex
+
+var imageProfiles = map[string]imageProfile{
+	"default": {
+		KernelPath:   kernelPath,
+		RootfsPath:   rootfsPath,
+		InitPath:     "/sbin/init",
+		CmdTransport: cmdTransportEnv,
+	},
+}
+
+// loadImageProfiles registers the profiles in a JSON file of the form
+// {"name": {"kernel_path": ..., "rootfs_path": ..., ...}}. A profile named
+// "default" replaces the built-in one.
+func loadImageProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var profiles map[string]imageProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return registerImageProfiles(profiles)
+}
+
+// registerImageProfiles fills in defaults, validates and registers
+// profiles, whether they came from -images or the config file. Once the
+// server is up, callers must hold imagesMu.
+func registerImageProfiles(profiles map[string]imageProfile) error {
+	for name, p := range profiles {
+		if p.InitPath == "" {
+			p.InitPath = "/sbin/init"
+		}
+		if p.CmdTransport == "" {
+			p.CmdTransport = cmdTransportEnv
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("image %q: %w", name, err)
+		}
+		imageProfiles[name] = p
+	}
+	return nil
+}
+
+func (p imageProfile) validate() error {
+	if p.KernelPath == "" || p.RootfsPath == "" {
+		return fmt.Errorf("kernel_path and rootfs_path are required")
+	}
+	if !filepath.IsAbs(p.InitPath) || strings.ContainsAny(p.InitPath, " \t\"") {
+		return fmt.Errorf("init_path must be an absolute path without spaces")
+	}
+	switch p.CmdTransport {
+	case cmdTransportEnv, cmdTransportArg, cmdTransportFile:
+	default:
+		return fmt.Errorf("unknown cmd_transport %q", p.CmdTransport)
+	}
+	return validateEnv(p.Env)
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnv checks env names and values that the wrapper can export.
+func validateEnv(env map[string]string) error {
+	for name, value := range env {
+		if !envNameRe.MatchString(name) {
+			return fmt.Errorf("env: %q is not a valid variable name", name)
+		}
+		if strings.ContainsRune(value, 0) {
+			return fmt.Errorf("env %s: value contains a NUL byte", name)
+		}
+	}
+	return nil
+}
+
+// hostnameRe is an RFC 1123 host name: dot-separated labels of letters,
+// digits and inner hyphens.
+var hostnameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// Linux keeps at most this much of a hostname.
+const maxHostnameLen = 64
+
+func validateHosts(hostname string, entries map[string]string) error {
+	if hostname != "" && (len(hostname) > maxHostnameLen || !hostnameRe.MatchString(hostname)) {
+		return fmt.Errorf("hostname %q is not a valid host name of at most %d characters", hostname, maxHostnameLen)
+	}
+	for name, ip := range entries {
+		if len(name) > 253 || !hostnameRe.MatchString(name) {
+			return fmt.Errorf("hosts_entries: %q is not a valid host name", name)
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("hosts_entries %s: %q is not an IP address", name, ip)
+		}
+	}
+	return nil
+}
+
+// Unless the image is read_only, a run mounts its rootfs read-write and
+// boots it as a writable drive, so two runs on one image would corrupt each
+// other (and overwrite each other's /sandboxd scripts). Such a rootfs serves
+// one run at a time and the others are refused with SANDBOX_BUSY.
+var (
+	rootfsLocksMu sync.Mutex
+	rootfsLocks   = map[string]*sync.Mutex{}
+)
+
+// lockRootfs claims img's rootfs for a run without waiting.
+func lockRootfs(img imageProfile) (unlock func(), err error) {
+	rootfsLocksMu.Lock()
+	mu, ok := rootfsLocks[img.RootfsPath]
+	if !ok {
+		mu = &sync.Mutex{}
+		rootfsLocks[img.RootfsPath] = mu
+	}
+	rootfsLocksMu.Unlock()
+
+	if !mu.TryLock() {
+		return nil, newAPIError(errSandboxBusy, fmt.Errorf("sandbox busy: %s is in use by another run (concurrent runs need a read_only image)", img.RootfsPath))
+	}
+	return mu.Unlock, nil
+}
+
+// overlayBootParam tells the guest init of a read_only image to stack the
+// run's drive (the second one, /dev/vdb) on the rootfs.
+const overlayBootParam = "sandboxd.overlay"
+
+// clockBootParam carries the host's Unix time at boot; the wrapper sets the
+// guest clock from it (see buildGuestScript).
+const clockBootParam = "sandboxd.clock"
+
+// reservedBootParams are kernel parameters extra_boot_args may not set:
+// they pick init, make a crashed guest exit, carry the command, set up the
+// overlay, or set the clock.
+var reservedBootParams = []string{"init", "rdinit", "panic", "CMD", overlayBootParam, clockBootParam}
+
+// validateExtraBootArgs checks extra_boot_args: plain space-separated
+// parameters, none of them reserved. Quotes and "--" are refused since
+// they would change how the rest of the command line is parsed.
+func validateExtraBootArgs(args string) error {
+	if len(args) > 512 {
+		return fmt.Errorf("extra_boot_args must be at most 512 bytes")
+	}
+	for _, param := range strings.Fields(args) {
+		if param == "--" || strings.ContainsAny(param, "\"'\\") {
+			return fmt.Errorf("extra_boot_args: %q is not allowed", param)
+		}
+		for _, c := range param {
+			if c < 0x21 || c > 0x7e {
+				return fmt.Errorf("extra_boot_args: %q has a non-printable character", param)
+			}
+		}
+		key, _, _ := strings.Cut(param, "=")
+		for _, reserved := range reservedBootParams {
+			if key == reserved {
+				return fmt.Errorf("extra_boot_args: %s= is set by sandboxd", key)
+			}
+		}
+	}
+	return nil
+}
+
+func lookupImage(name string) (imageProfile, error) {
+	imagesMu.RLock()
+	defer imagesMu.RUnlock()
+	if name == "" {
+		name = defaultImage
+	}
+	p, ok := imageProfiles[name]
+	if !ok {
+		return imageProfile{}, newAPIError(errValidation, fmt.Errorf("unknown image %q", name))
 	}
-	logFile, err := os.Create(fcLog)
+	return p, nil
+}
+
+// bootArgs builds the kernel command line for img.
+func (p imageProfile) bootArgs() string {
+	args := fmt.Sprintf("console=ttyS0 quiet loglevel=0 reboot=k panic=1 pci=off %s=%d init=%s", clockBootParam, time.Now().Unix(), p.InitPath)
+	if p.extraBootArgs != "" {
+		// Before the transport, which may end the kernel's own parameters.
+		args += " " + p.extraBootArgs
+	}
+	if p.ReadOnly {
+		args += " " + overlayBootParam
+	}
+	switch p.CmdTransport {
+	case cmdTransportArg:
+		args += " -- sh " + guestRunScript
+	case cmdTransportEnv:
+		args += fmt.Sprintf(" CMD=\"sh %s\"", guestRunScript)
+	}
+	return args
+}
+
+/* ---------------- Firecracker helpers ---------------- */
+
+func startFirecracker(socketPath, consolePath, logPath string, stdin *os.File) (*exec.Cmd, *os.File, error) {
+	_ = os.Remove(socketPath)
+
+	// firecracker wants --log-path to exist already.
+	logFile, err := os.Create(logPath)
 	if err != nil {
 		return nil, nil, err
 	}
 	_ = logFile.Close()
 
-	consoleFile, err := os.Create(fcConsole)
+	consoleFile, err := os.Create(consolePath)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	cmd := exec.Command(
 		"firecracker",
-		"--api-sock", fcSocket,
-		"--log-path", fcLog,
+		"--api-sock", socketPath,
+		"--log-path", logPath,
 		"--level", "Error",
 	)
 
+	// The serial console is wired to firecracker's stdio: stdin (if any)
+	// feeds the guest's ttyS0, everything the guest prints lands in the file.
+	cmd.Stdin = stdin
 	cmd.Stdout = consoleFile
 	cmd.Stderr = nil
 
 	if err := cmd.Start(); err != nil {
 		_ = consoleFile.Close()
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, nil, fmt.Errorf("firecracker not installed: %w", err)
+		}
 		return nil, nil, err
 	}
 
 	return cmd, consoleFile, nil
 }
 
-func waitForSocket(path string, timeout time.Duration) error {
+func waitForSocket(ctx context.Context, path string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if _, err := os.Stat(path); err == nil {
 			return nil
 		}
@@ -87,7 +768,12 @@ func waitForSocket(path string, timeout time.Duration) error {
 	return fmt.Errorf("timeout waiting for socket %s", path)
 }
 
-func fcPut(path string, body any) error {
+// fcPut issues one firecracker API call. It gives up when ctx is done, and
+// after 5s regardless.
+func fcPut(ctx context.Context, socketPath, path string, body any) (err error) {
+	_, sp := startSpan(ctx, "fcPut "+path)
+	defer func() { sp.finish(err) }()
+
 	data, err := json.Marshal(body)
 	if err != nil {
 		return err
@@ -95,16 +781,15 @@ func fcPut(path string, body any) error {
 
 	tr := &http.Transport{
 		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			return net.Dial("unix", fcSocket)
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
 		},
 	}
+	client := &http.Client{Transport: tr}
 
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   5 * time.Second,
-	}
-
-	req, err := http.NewRequest("PUT", "http://unix"+path, bytes.NewReader(data))
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://unix"+path, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -124,35 +809,235 @@ func fcPut(path string, body any) error {
 	return nil
 }
 
+// startVM launches firecracker on a fresh socket and applies the machine
+// config, retrying that setup phase on transient failures (socket races, a
+// stale path still in use). The guest has not booted yet at this point, so a
+// retry never re-runs the user's command.
+func startVM(ctx context.Context, runDir, consolePath string, stdin *os.File) (*exec.Cmd, *os.File, string, error) {
+	// Per-run, so concurrent VMs never interleave their logs.
+	logPath := fcLogPath(runDir)
+
+	var lastErr error
+	retries, firstBackoff := live(&startRetries), live(&startBackoff)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			backoff := firstBackoff << (attempt - 1)
+			log.Printf("firecracker startup failed (attempt %d/%d): %v; retrying in %s",
+				attempt, retries+1, lastErr, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, nil, "", ctx.Err()
+			}
+		}
+
+		socketPath := filepath.Join(runDir, fmt.Sprintf("fc-%d.sock", attempt))
+		_, startSp := startSpan(ctx, "startFirecracker")
+		startSp.setAttr("sandboxd.attempt", strconv.Itoa(attempt))
+		fc, consoleFile, err := startFirecracker(socketPath, consolePath, logPath, stdin)
+		startSp.finish(err)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := setupVM(ctx, socketPath, logPath); err != nil {
+			lastErr = err
+			if fc.Process != nil {
+				_ = fc.Process.Kill()
+			}
+			_ = fc.Wait()
+			_ = consoleFile.Close()
+			_ = os.Remove(socketPath)
+			continue
+		}
+
+		return fc, consoleFile, socketPath, nil
+	}
+	return nil, nil, "", lastErr
+}
+
+func setupVM(ctx context.Context, socketPath, logPath string) error {
+	_, sockSpan := startSpan(ctx, "waitForSocket")
+	err := waitForSocket(ctx, socketPath, 10*time.Second)
+	sockSpan.finish(err)
+	if err != nil {
+		logText, readErr := os.ReadFile(logPath)
+		if readErr == nil {
+			snippet := tailLines(string(logText), 50)
+			if snippet != "" {
+				return fmt.Errorf("%s\nfirecracker log:\n%s", err.Error(), snippet)
+			}
+		}
+		return err
+	}
+
+	return fcPut(ctx, socketPath, "/machine-config", map[string]any{
+		"vcpu_count":   live(&vmVcpus),
+		"mem_size_mib": live(&vmMemMiB),
+		"smt":          false,
+	})
+}
+
+// VMMetrics are a few of firecracker's own counters, summed over the run:
+// disk traffic of all drives and the vCPU exits to the VMM, which the guest
+// itself cannot see.
+type VMMetrics struct {
+	BlockReadBytes  uint64 `json:"block_read_bytes"`
+	BlockWriteBytes uint64 `json:"block_write_bytes"`
+	BlockReadCount  uint64 `json:"block_read_count"`
+	BlockWriteCount uint64 `json:"block_write_count"`
+	VcpuExitsIO     uint64 `json:"vcpu_exits_io"`
+	VcpuExitsMMIO   uint64 `json:"vcpu_exits_mmio"`
+}
+
+// fcMetricsPath is where a debug run's firecracker writes its metrics.
+func fcMetricsPath(runDir string) string {
+	return filepath.Join(runDir, "firecracker-metrics.json")
+}
+
+// enableVMMetrics points firecracker's metrics at runDir. It must happen
+// before InstanceStart. Metrics are only a debugging aid, so a failure is
+// logged and the run goes on without them ("" is returned).
+func enableVMMetrics(ctx context.Context, socketPath, runDir string) string {
+	path := fcMetricsPath(runDir)
+	err := os.WriteFile(path, nil, 0o644)
+	if err == nil {
+		err = fcPut(ctx, socketPath, "/metrics", map[string]any{"metrics_path": path})
+	}
+	if err != nil {
+		log.Printf("firecracker metrics: %v", err)
+		return ""
+	}
+	return path
+}
+
+// collectVMMetrics has firecracker flush its metrics and sums what it
+// wrote. Firecracker writes one JSON object per flush (also once a minute
+// on its own), whose counters are deltas since the previous one. If it has
+// already exited, the flushes it managed before that are all there is.
+func collectVMMetrics(ctx context.Context, socketPath, path string) *VMMetrics {
+	_ = fcPut(ctx, socketPath, "/actions", map[string]any{"action_type": "FlushMetrics"})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var m VMMetrics
+	for _, line := range strings.Split(string(b), "\n") {
+		var flush struct {
+			Block struct {
+				ReadBytes  uint64 `json:"read_bytes"`
+				WriteBytes uint64 `json:"write_bytes"`
+				ReadCount  uint64 `json:"read_count"`
+				WriteCount uint64 `json:"write_count"`
+			} `json:"block"`
+			Vcpu struct {
+				ExitIOIn      uint64 `json:"exit_io_in"`
+				ExitIOOut     uint64 `json:"exit_io_out"`
+				ExitMMIORead  uint64 `json:"exit_mmio_read"`
+				ExitMMIOWrite uint64 `json:"exit_mmio_write"`
+			} `json:"vcpu"`
+		}
+		// A VM killed mid-flush leaves a partial last line.
+		if json.Unmarshal([]byte(line), &flush) != nil {
+			continue
+		}
+		m.BlockReadBytes += flush.Block.ReadBytes
+		m.BlockWriteBytes += flush.Block.WriteBytes
+		m.BlockReadCount += flush.Block.ReadCount
+		m.BlockWriteCount += flush.Block.WriteCount
+		m.VcpuExitsIO += flush.Vcpu.ExitIOIn + flush.Vcpu.ExitIOOut
+		m.VcpuExitsMMIO += flush.Vcpu.ExitMMIORead + flush.Vcpu.ExitMMIOWrite
+	}
+	return &m
+}
+
 /* ---------------- Guest console parsing ---------------- */
 
 // Wait until the guest init actually starts (so we don't count boot time against timeout_ms).
-func waitForGuestInitStarted(timeout time.Duration) error {
+func waitForGuestInitStarted(ctx context.Context, consolePath string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 
 	for time.Now().Before(deadline) {
-		b, err := os.ReadFile(fcConsole)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := os.ReadFile(consolePath)
 		if err == nil {
 			text := strings.ReplaceAll(string(b), "\r\n", "\n")
 			if strings.Contains(text, "[guest] init started") {
 				return nil
 			}
 			// If the guest already halted/panicked, don't wait forever.
-			if strings.Contains(text, "Kernel panic") || strings.Contains(text, "reboot: System halted") {
-				return fmt.Errorf("guest did not reach init started (halt/panic)")
+			if err := kernelPanicError(text); err != nil {
+				return err
+			}
+			if strings.Contains(text, "reboot: System halted") {
+				return newAPIError(errBootFailed, fmt.Errorf("guest halted before init started"))
 			}
 		}
 		time.Sleep(50 * time.Millisecond)
 	}
 
-	return fmt.Errorf("timeout waiting for guest init started")
+	return newAPIError(errAgentTimeout, fmt.Errorf("guest init did not start within %s", timeout))
+}
+
+// errVMExited means firecracker went away before the guest reported an exit
+// code; whatever the guest printed until then is still returned.
+var errVMExited = errors.New("VM exited before the guest reported an exit code; output may be incomplete")
+
+var (
+	errGuestHalted       = errors.New("guest halted without reporting an exit code")
+	errCompletionTimeout = errors.New("timeout waiting for guest completion")
+	errGuestUnresponsive = errors.New("guest stopped responding")
+)
+
+// Values of RunResponse.ExitReason.
+const (
+	exitReasonExited   = "exited"
+	exitReasonTimeout  = "timeout"
+	exitReasonKilled   = "killed"
+	exitReasonHalted   = "halted"
+	exitReasonVMExited = "vm_exited"
+	exitReasonStalled  = "unresponsive"
+	exitReasonOverall  = "overall_timeout"
+)
+
+// exitReason classifies how waitForGuestCompletion ended. Kernel panics
+// never get here; they fail the request with KERNEL_PANIC.
+func exitReason(waitErr error) string {
+	switch {
+	case waitErr == nil:
+		return exitReasonExited
+	case errors.Is(waitErr, errGuestHalted):
+		return exitReasonHalted
+	case errors.Is(waitErr, errCompletionTimeout):
+		return exitReasonTimeout
+	case errors.Is(waitErr, errGuestUnresponsive):
+		return exitReasonStalled
+	}
+	return exitReasonVMExited
+}
+
+// stripHeartbeats removes every heartbeatMarker line from console text.
+func stripHeartbeats(text string) string {
+	return strings.ReplaceAll(text, "\n"+heartbeatMarker+"\n", "")
 }
 
-func waitForGuestCompletion(timeout time.Duration) (stdout string, exitCode int, err error) {
+// waitForGuestCompletion polls the console for the exit code marker. If
+// vmExited (which may be nil) reports that firecracker is gone, it stops
+// early with errVMExited instead of waiting out the timeout. With heartbeat
+// set, it gives up with errGuestUnresponsive once heartbeatMisses beats in
+// a row have not shown up; timeout still applies either way.
+func waitForGuestCompletion(ctx context.Context, consolePath string, timeout, heartbeat time.Duration, vmExited func() bool) (stdout string, exitCode int, err error) {
 	deadline := time.Now().Add(timeout)
+	beats, lastBeat := 0, time.Now()
 
-	for time.Now().Before(deadline) {
-		b, readErr := os.ReadFile(fcConsole)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		// Checked before reading, so a final read sees everything the VM
+		// wrote before it exited.
+		exited := vmExited != nil && vmExited()
+		b, readErr := os.ReadFile(consolePath)
 		if readErr == nil {
 			text := strings.ReplaceAll(string(b), "\r\n", "\n")
 
@@ -166,29 +1051,84 @@ func waitForGuestCompletion(timeout time.Duration) (stdout string, exitCode int,
 				}
 			}
 
+			if err := kernelPanicError(text); err != nil {
+				return text, guestErrorExitCode, err
+			}
+
+			// Halting without an exit code means init never ran (or never
+			// finished) the command; don't report that as a clean exit 0.
 			if strings.Contains(text, "reboot: System halted") {
-				return text, 0, nil
+				return text, guestErrorExitCode, errGuestHalted
+			}
+			if exited {
+				return text, guestErrorExitCode, errVMExited
+			}
+
+			if heartbeat > 0 {
+				if n := strings.Count(text, "\n"+heartbeatMarker+"\n"); n != beats {
+					beats, lastBeat = n, time.Now()
+				} else if silent := time.Since(lastBeat); silent > heartbeatMisses*heartbeat {
+					return text, guestErrorExitCode, fmt.Errorf("%w: no heartbeat for %s", errGuestUnresponsive, silent.Round(time.Millisecond))
+				}
 			}
 		}
 
 		time.Sleep(50 * time.Millisecond)
 	}
 
-	b, _ := os.ReadFile(fcConsole)
+	b, _ := os.ReadFile(consolePath)
 	text := strings.ReplaceAll(string(b), "\r\n", "\n")
-	return text, 124, fmt.Errorf("timeout waiting for guest completion")
+	return text, live(&timeoutExitCode), errCompletionTimeout
+}
+
+// processExited reports whether the child p has exited, without reaping it
+// (WNOWAIT), so that the usual Wait still collects it.
+func processExited(p *os.Process) bool {
+	var info [128]byte // siginfo_t
+	const pPID = 1
+	_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(p.Pid), uintptr(unsafe.Pointer(&info[0])),
+		syscall.WEXITED|syscall.WNOHANG|syscall.WNOWAIT, 0, 0)
+	if errno != 0 {
+		return false
+	}
+	// si_pid stays 0 while the child is still running.
+	return *(*int32)(unsafe.Pointer(&info[16])) != 0
+}
+
+// The boot args set panic=1, so a panicking guest reboots (and firecracker
+// exits) without init ever reporting. Without this check that shows up as a
+// plain timeout. Only the kernel's own timestamped printk line counts, so a
+// command printing the same words does not fail its run.
+var kernelPanicRe = regexp.MustCompile(`(?m)^\[ *\d+\.\d+\] (Kernel panic - not syncing:.*)$`)
+
+// kernelPanicError returns a KERNEL_PANIC error carrying the panic message if
+// the console text contains one.
+func kernelPanicError(text string) error {
+	m := kernelPanicRe.FindStringSubmatch(text)
+	if m == nil {
+		return nil
+	}
+	return newAPIError(errKernelPanic, fmt.Errorf("guest %s", strings.TrimSpace(m[1])))
 }
 
+// Why resolveWorkPath refuses a name; pathReason turns them into the
+// reasons reported in an error body's fields.
+var (
+	errEmptyPath     = errors.New("file name is empty")
+	errAbsolutePath  = errors.New("absolute paths are not allowed")
+	errPathTraversal = errors.New("path traversal is not allowed")
+)
+
 func resolveWorkPath(workDir, name string) (string, error) {
 	if name == "" {
-		return "", fmt.Errorf("file name is empty")
+		return "", errEmptyPath
 	}
 	if filepath.IsAbs(name) {
-		return "", fmt.Errorf("absolute paths are not allowed")
+		return "", errAbsolutePath
 	}
 	clean := filepath.Clean(name)
 	if clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(os.PathSeparator)) {
-		return "", fmt.Errorf("path traversal is not allowed")
+		return "", errPathTraversal
 	}
 	targetPath := filepath.Join(workDir, clean)
 	rel, err := filepath.Rel(workDir, targetPath)
@@ -198,235 +1138,7137 @@ func resolveWorkPath(workDir, name string) (string, error) {
 	return targetPath, nil
 }
 
-/* ---------------- HTTP handler ---------------- */
+// checkPortablePaths reports names that clean to the same path, or whose
+// paths (or parent directories) differ only in case, which a
+// case-insensitive filesystem would merge.
+func checkPortablePaths(names []string) error {
+	sort.Strings(names)
+	byPath := make(map[string]string)
+	// Lowercased path or directory -> how the request spelled it.
+	byFold := make(map[string]string)
+	for _, name := range names {
+		clean := filepath.Clean(name)
+		if other, ok := byPath[clean]; ok {
+			return fmt.Errorf("%q and %q are the same path", other, name)
+		}
+		byPath[clean] = name
+		for p := clean; p != "." && p != "/"; p = filepath.Dir(p) {
+			fold := strings.ToLower(p)
+			if spelled, ok := byFold[fold]; ok && spelled != p {
+				return fmt.Errorf("%q collides with %q when case is ignored", name, spelled)
+			}
+			byFold[fold] = p
+		}
+	}
+	return nil
+}
 
-func runHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "POST only", http.StatusMethodNotAllowed)
-		return
+// checkNoSymlinks refuses to let targetPath (or workDir itself) pass through a
+// symlink. The rootfs is shared between runs, so an earlier command can leave
+// e.g. /work/x -> /etc behind; following it on the host would write outside
+// the mounted image.
+func checkNoSymlinks(workDir, targetPath string) error {
+	rel, err := filepath.Rel(workDir, targetPath)
+	if err != nil {
+		return fmt.Errorf("path escapes work dir")
 	}
 
-	var req RunRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid JSON", http.StatusBadRequest)
-		return
+	fi, err := os.Lstat(workDir)
+	if err != nil {
+		return err
 	}
-	if req.Cmd == "" {
-		http.Error(w, "cmd is required", http.StatusBadRequest)
-		return
+	if fi.Mode()&os.ModeSymlink != 0 || !fi.IsDir() {
+		return fmt.Errorf("work dir is not a plain directory")
 	}
 
-	log.Printf("run: %q", req.Cmd)
+	cur := workDir
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			// Nothing below a missing component can be a symlink.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			rel, _ := filepath.Rel(workDir, cur)
+			return fmt.Errorf("refusing to follow symlink %s", rel)
+		}
+	}
+	return nil
+}
 
-	mountDir, err := os.MkdirTemp("", "rootfs-mount-")
+// writeFileNoFollow is os.WriteFile with O_NOFOLLOW, so a symlink swapped in
+// after checkNoSymlinks still cannot redirect the write.
+func writeFileNoFollow(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, perm)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return err
 	}
-	defer os.RemoveAll(mountDir)
-
-	mountCmd := exec.Command("mount", "-o", "loop", rootfsPath, mountDir)
-	if err := mountCmd.Run(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
 	}
-
-	unmountErr := func() error {
-		return exec.Command("umount", mountDir).Run()
+	// Chmod through the open file: umask may have masked perm on create, and
+	// os.Chmod on the path would follow symlinks.
+	if err := f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
 	}
+	return f.Close()
+}
 
-	workDir := mountDir + "/work"
+/* ---------------- Guest scripts ---------------- */
+
+// The guest init runs CMD from the boot args. Rather than squeezing the user
+// command (and its quoting) onto the kernel command line, the host writes it
+// into the rootfs together with a small wrapper, and CMD just runs the wrapper.
+const (
+	guestRunScript = "/sandboxd/run.sh"
+	guestCmdScript = "/sandboxd/cmd.sh"
+	guestStdinFile = "/sandboxd/stdin"
+
+	rusageMarker = "[guest] rusage:"
+
+	// "[guest] command uptime <start> <end>", from /proc/uptime.
+	timingMarker = "[guest] command uptime "
+
+	// Printed by the wrapper's watchdog when it sends SIGTERM on timeout.
+	terminateMarker = "[guest] terminating"
+
+	// Printed when the wrapper had to set the guest clock from
+	// clockBootParam. Left in the console (debug), removed from stdout.
+	clockSyncedMarker = "[guest] clock synced"
+
+	// Printed once the live_files receiver is reading the console.
+	liveFilesMarker = "[guest] receiving files"
+
+	// Printed every guestHeartbeat while the command runs. Unlike the
+	// other markers it shows up many times; see stripHeartbeats.
+	heartbeatMarker = "[guest] heartbeat"
+	heartbeatMisses = 3
+
+	// Steps are framed on the console by "[guest] step N begin|stderr|end"
+	// lines; see buildStepsScript.
+	stepMarker = "[guest] step "
+	maxSteps   = 64
+
+	// With tmpfs_work, the image's /work stays reachable here while a tmpfs
+	// is mounted over /work.
+	guestWorkSeed      = "/sandboxd/work-seed"
+	defaultTmpfsWorkMB = 64
+	maxTmpfsWorkMB     = 192 // of the guest's 256 MiB
+
+	// hosts_entries are added to a copy of /etc/hosts here, which is then
+	// mounted over it.
+	guestHostsFile = "/sandboxd/hosts"
+
+	// capture_core points the guest kernel's core_pattern here, on the
+	// image, so the host can read cores back after the run.
+	guestCoreDir = "/sandboxd/core"
+
+	guestSetupScript = "/sandboxd/setup.sh"
+	setupBeginMarker = "[guest] setup begin"
+	setupEndMarker   = "[guest] setup end "
+
+	// Kernel parameters and environment for deterministic runs. The epoch
+	// is 1980-01-01, the earliest date zip can store.
+	deterministicBootArgs = "nokaslr norandmaps"
+	deterministicEnv      = "PYTHONHASHSEED=0 SOURCE_DATE_EPOCH=315532800 TZ=UTC LANG=C LC_ALL=C"
+
+	// Printed after a failed command if the guest kernel logged an OOM kill.
+	oomMarker = "[guest] oom-killed"
+
+	// Printed after a failed command if a tmpfs /work has less than
+	// workFullKB left, i.e. the command most likely hit ENOSPC.
+	workFullMarker = "[guest] work full"
+	workFullKB     = 1024
+
+	dmesgBeginMarker = "[guest] dmesg begin"
+	dmesgEndMarker   = "[guest] dmesg end"
+	maxDmesgBytes    = 64 << 10
+)
+
+// writeExports adds an export line for env to a wrapper script, in name
+// order.
+func writeExports(b *strings.Builder, env map[string]string) {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(b, "export %s=%s\n", name, shellQuote(env[name]))
+	}
+}
+
+// shellQuote single-quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Where distributions put libfaketime; the wrapper uses the first one found.
+var libfaketimePaths = []string{
+	"/usr/lib/x86_64-linux-gnu/faketime/libfaketime.so.1",
+	"/usr/lib/aarch64-linux-gnu/faketime/libfaketime.so.1",
+	"/usr/lib/faketime/libfaketime.so.1",
+	"/usr/local/lib/faketime/libfaketime.so.1",
+}
+
+// fakeTimeSpec turns the fake_time field into a FAKETIME value. The result
+// only contains digits, '@', '+', '-', ':', ' ' and a unit letter, so it is
+// safe inside single quotes.
+func fakeTimeSpec(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	if (v[0] == '+' || v[0] == '-') && len(v) > 2 {
+		n, unit := v[1:len(v)-1], v[len(v)-1]
+		if _, err := strconv.ParseUint(n, 10, 32); err == nil && strings.IndexByte("smhdy", unit) >= 0 {
+			return v, nil
+		}
+		return "", fmt.Errorf("invalid fake_time offset %q (want e.g. \"+2d\" or \"-90m\")", v)
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return "@" + t.UTC().Format("2006-01-02 15:04:05"), nil
+		}
+	}
+	return "", fmt.Errorf("invalid fake_time %q (want RFC 3339, \"2006-01-02 15:04:05\" or an offset like \"+2d\")", v)
+}
+
+// guestShells are the shells Shell may name, with their path in the guest.
+var guestShells = map[string]string{
+	"sh":   "/bin/sh",
+	"ash":  "/bin/ash",
+	"dash": "/bin/dash",
+	"bash": "/bin/bash",
+}
+
+// noPipefailShells lack set -o pipefail, so a pipefail request naming one is
+// refused up front. Plain sh is whatever the image has and is checked in
+// the guest instead.
+var noPipefailShells = map[string]bool{"/bin/dash": true}
+
+// pipefailPrelude turns on pipefail, or fails the run with a clear message
+// if the shell has no such option. The probe runs in a subshell because a
+// failing set exits a POSIX shell outright.
+func pipefailPrelude() string {
+	return fmt.Sprintf(`(set -o pipefail) 2>/dev/null || { echo "sandboxd: the shell does not support pipefail" >&2; exit %d; }
+set -o pipefail
+`, guestErrorExitCode)
+}
+
+// guestShellPath maps the request field to a guest path. Empty means
+// plain "sh" from init's PATH, which is not checked against the image.
+func guestShellPath(name string) (string, error) {
+	if name == "" {
+		return "sh", nil
+	}
+	if path, ok := guestShells[strings.TrimPrefix(name, "/bin/")]; ok {
+		return path, nil
+	}
+	return "", newAPIError(errValidation, fmt.Errorf("unsupported shell %q", name))
+}
+
+// workTmpfsMB is the size of the tmpfs mounted over /work, or 0 if the
+// command runs on the image's /work.
+func workTmpfsMB(req RunRequest) int {
+	switch {
+	case req.WorkQuotaMiB > 0:
+		return req.WorkQuotaMiB
+	case !req.TmpfsWork:
+		return 0
+	case req.TmpfsWorkMB > 0:
+		return req.TmpfsWorkMB
+	}
+	return defaultTmpfsWorkMB
+}
+
+func buildGuestScript(req RunRequest) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+
+	if !req.hostKernel {
+		// A guest can come up with a stale clock, which breaks TLS among
+		// other things. The host's time at boot is at most a second or two
+		// behind by now, so leave a clock that is already that close alone.
+		fmt.Fprintf(&b, `for sandboxd_p in $(cat /proc/cmdline 2>/dev/null); do
+	case $sandboxd_p in %s=*)
+		sandboxd_now=${sandboxd_p#*=}
+		sandboxd_d=$(($(date +%%s) - sandboxd_now))
+		[ $sandboxd_d -lt 0 ] || [ $sandboxd_d -gt 2 ] && date -s "@$sandboxd_now" >/dev/null 2>&1 && printf '\n%%s\n' '%s'
+	esac
+done
+`, clockBootParam, clockSyncedMarker)
+	}
+
+	tmpfsMB := workTmpfsMB(req)
+	if tmpfsMB > 0 {
+		// Must happen before the cd, or the shell would stay on the image.
+		fmt.Fprintf(&b, `mkdir -p /work %[1]s &&
+	mount -o bind /work %[1]s &&
+	mount -t tmpfs -o size=%[2]dm sandboxd-work /work &&
+	cp -a %[1]s/. /work/ || { echo "sandboxd: could not set up tmpfs /work" >&2; exit %[3]d; }
+`, guestWorkSeed, tmpfsMB, guestErrorExitCode)
+	}
+
+	if req.Hostname != "" {
+		fmt.Fprintf(&b, "hostname '%[1]s' 2>/dev/null || echo '%[1]s' > /proc/sys/kernel/hostname || { echo \"sandboxd: could not set the hostname\" >&2; exit %[2]d; }\n", req.Hostname, guestErrorExitCode)
+	}
+	if len(req.HostsEntries) > 0 {
+		// Bind-mounted over /etc/hosts rather than written to it, so that the
+		// image's own file is left as it was.
+		names := make([]string, 0, len(req.HostsEntries))
+		for name := range req.HostsEntries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b.WriteString("{ cat /etc/hosts 2>/dev/null\n")
+		for _, name := range names {
+			fmt.Fprintf(&b, "\techo '%s\t%s'\n", net.ParseIP(req.HostsEntries[name]), name)
+		}
+		fmt.Fprintf(&b, `} > %[1]s && { [ -e /etc/hosts ] || : > /etc/hosts; } && mount --bind %[1]s /etc/hosts ||
+	{ echo "sandboxd: could not set up /etc/hosts" >&2; exit %[2]d; }
+`, guestHostsFile, guestErrorExitCode)
+	}
+
+	if req.scratchDevice != "" {
+		fmt.Fprintf(&b, "mkdir -p %[1]s && mount %[2]s %[1]s || { echo \"sandboxd: could not mount the scratch drive\" >&2; exit %[3]d; }\n", guestScratchDir, req.scratchDevice, guestErrorExitCode)
+	}
+
+	if (len(req.Files) > 0 || len(req.FetchFiles) > 0 || req.uploads != nil) && !req.NoChdir {
+		b.WriteString("cd /work || exit 1\n")
+	}
+
+	// The image's env first, so that deterministic runs and then the
+	// request get the last word.
+	writeExports(&b, req.imageEnv)
+	if req.Deterministic {
+		fmt.Fprintf(&b, "export %s\n", deterministicEnv)
+	}
+	writeExports(&b, req.Env)
+
+	if spec, err := fakeTimeSpec(req.FakeTime); err == nil && spec != "" {
+		if req.Deterministic {
+			// Without the '@' libfaketime stops the clock at that time.
+			spec = strings.TrimPrefix(spec, "@")
+		}
+		fmt.Fprintf(&b, "for lib in %s; do\n", strings.Join(libfaketimePaths, " "))
+		fmt.Fprintf(&b, "\t[ -e \"$lib\" ] && export LD_PRELOAD=\"$lib\" FAKETIME='%s' && break\n", spec)
+		b.WriteString("done\n")
+	}
+
+	if req.CaptureCore {
+		b.WriteString("ulimit -c unlimited 2>/dev/null\n")
+		if !req.hostKernel {
+			// core_pattern is global, so only touch it on a guest kernel.
+			fmt.Fprintf(&b, "mkdir -p %[1]s && echo '%[1]s/core.%%e.%%p' > /proc/sys/kernel/core_pattern 2>/dev/null\n", guestCoreDir)
+		}
+	}
+
+	if req.LiveFiles {
+		// See liveFeed. Without echo off, everything sent would also come
+		// back as output, so no stty means no receiver (and the host gives
+		// up waiting for the marker). The frame is spooled to /tmp first so
+		// that it is consumed in full even if writing the file fails.
+		fmt.Fprintf(&b, `if stty -echo 2>/dev/null; then
+	exec 3<&0
+	while read -r sandboxd_kind sandboxd_name sandboxd_mode sandboxd_lines; do
+		[ "$sandboxd_kind" = sandboxd-file ] || continue
+		head -n "$sandboxd_lines" > /tmp/sandboxd-incoming
+		sandboxd_path=/work/$(echo "$sandboxd_name" | base64 -d)
+		mkdir -p "${sandboxd_path%%/*}" &&
+			base64 -d < /tmp/sandboxd-incoming > "$sandboxd_path.sandboxd-part" &&
+			chmod "$sandboxd_mode" "$sandboxd_path.sandboxd-part" &&
+			mv -f "$sandboxd_path.sandboxd-part" "$sandboxd_path"
+	done <&3 &
+	sandboxd_receiver=$!
+	printf '\n%%s\n' '%s'
+fi
+`, liveFilesMarker)
+	}
+
+	if req.heartbeat > 0 {
+		// The sleep lets go of stdout, so killing the loop leaves nothing
+		// holding it.
+		ms := req.heartbeat.Milliseconds()
+		fmt.Fprintf(&b, "while sleep %d.%03d >/dev/null; do printf '\\n%%s\\n' '%s'; done &\nsandboxd_beat=$!\n", ms/1000, ms%1000, heartbeatMarker)
+	}
+
+	if req.Timings {
+		b.WriteString("read -r sandboxd_t0 _ 2>/dev/null < /proc/uptime\n")
+	}
+
+	shell, _ := guestShellPath(req.Shell)
+	run := shell + " " + guestCmdScript
+	if req.LiveFiles {
+		run += " </dev/null 3<&-"
+	}
+	if hasStdin(req) {
+		run += " <" + guestStdinFile
+	}
+	if req.LineBuffered {
+		// stdbuf works through LD_PRELOAD, which the command's own
+		// programs inherit; static binaries keep their buffering.
+		b.WriteString("command -v stdbuf >/dev/null 2>&1 && sandboxd_linebuf=\"stdbuf -oL -eL\"\n")
+		run = "$sandboxd_linebuf " + run
+	}
+	if req.Deterministic && req.hostKernel {
+		// The host kernel randomizes as it likes, so turn it off for this
+		// process tree only (the guest kernel gets norandmaps instead).
+		b.WriteString("command -v setarch >/dev/null 2>&1 && sandboxd_norand=\"setarch $(uname -m) -R\"\n")
+		run = "$sandboxd_norand " + run
+	}
+	if needsGuestHelper(req) {
+		profile := req.Seccomp
+		if profile == "" {
+			profile = seccompNone
+		}
+		if req.Tty {
+			b.WriteString("[ -e /dev/pts/ptmx ] || { mkdir -p /dev/pts && mount -t devpts devpts /dev/pts; } 2>/dev/null\n")
+			run = fmt.Sprintf("%s guest-exec -tty -seccomp %s -- %s", guestHelper, profile, run)
+		} else {
+			run = fmt.Sprintf("%s guest-exec -seccomp %s -- %s", guestHelper, profile, run)
+		}
+	}
+	watch := ""
+	if grace := live(&termGrace); grace > 0 {
+		// The command gets its own process group (if setsid exists) so the
+		// whole tree sees SIGTERM, then SIGKILL once termGrace is up. The
+		// host's own kill is a backstop for a guest too wedged to report.
+		// The sleeps let go of stdout so an orphaned one holds up nothing.
+		ms, graceMs := execTimeout(req.TimeoutMs).Milliseconds(), grace.Milliseconds()
+		fmt.Fprintf(&b, `sandboxd_setsid=$(command -v setsid)
+sandboxd_watch() {
+	$sandboxd_setsid "$@" &
+	sandboxd_pid=$!
+	(sleep %d.%03d >/dev/null && printf '\n%%s\n' '%s' && { kill -TERM -- -$sandboxd_pid || kill -TERM $sandboxd_pid; } &&
+		sleep %d.%03d >/dev/null && { kill -KILL -- -$sandboxd_pid || kill -KILL $sandboxd_pid; }) 2>/dev/null &
+	sandboxd_dog=$!
+	wait $sandboxd_pid
+	sandboxd_rc=$?
+	kill $sandboxd_dog 2>/dev/null
+	return $sandboxd_rc
+}
+`, ms/1000, ms%1000, terminateMarker, graceMs/1000, graceMs%1000)
+		watch = "sandboxd_watch "
+	}
+	if req.CaptureRusage {
+		// %M max RSS (KB), %U/%S user/system seconds, %F/%R major/minor faults.
+		// time(1) prefixes the file with a status line on nonzero exit, hence tail.
+		fmt.Fprintf(&b, `if [ -x /usr/bin/time ]; then
+	%s/usr/bin/time -o /tmp/rusage -f '%%M %%U %%S %%F %%R' %s
+	rc=$?
+	[ -s /tmp/rusage ] && echo "%s $(tail -n 1 /tmp/rusage)"
+else
+	%s
+	rc=$?
+fi
+`, watch, run, rusageMarker, watch+run)
+	} else {
+		fmt.Fprintf(&b, "%s%s\nrc=$?\n", watch, run)
+	}
+	if req.LiveFiles {
+		b.WriteString("[ -n \"$sandboxd_receiver\" ] && kill $sandboxd_receiver 2>/dev/null\n")
+	}
+	if req.heartbeat > 0 {
+		b.WriteString("kill $sandboxd_beat 2>/dev/null\n")
+	}
+
+	if req.Timings {
+		fmt.Fprintf(&b, "read -r sandboxd_t1 _ 2>/dev/null < /proc/uptime\nprintf '\\n%%s%%s %%s\\n' '%s' \"$sandboxd_t0\" \"$sandboxd_t1\"\n", timingMarker)
+	}
+
+	if !req.hostKernel {
+		// A fresh guest kernel has logged nothing else, so any OOM kill
+		// belongs to this run.
+		fmt.Fprintf(&b, "[ $rc -ne 0 ] && dmesg 2>/dev/null | grep -q -e 'Out of memory: Killed process' -e 'oom-kill:' && printf '\\n%%s\\n' '%s'\n", oomMarker)
+	}
+
+	if tmpfsMB > 0 {
+		fmt.Fprintf(&b, "[ $rc -ne 0 ] && [ \"$(df -kP /work 2>/dev/null | awk 'NR == 2 { print $4 }')\" -lt %d ] 2>/dev/null && printf '\\n%%s\\n' '%s'\n", workFullKB, workFullMarker)
+	}
+
+	if req.Dmesg {
+		fmt.Fprintf(&b, "echo; echo '%s'\ndmesg 2>&1 | tail -c %d\necho '%s'\n", dmesgBeginMarker, maxDmesgBytes, dmesgEndMarker)
+	}
+
+	if len(req.OutputGlobs) > 0 && tmpfsMB > 0 {
+		// Outputs are read from the image, so copy the tmpfs back.
+		fmt.Fprintf(&b, "cp -a /work/. %s/\n", guestWorkSeed)
+	}
+	if len(req.OutputGlobs) > 0 || req.CaptureCore {
+		// The host reads outputs and cores back from the image after
+		// killing the VM, so they must be on disk before init reports the
+		// exit code.
+		b.WriteString("sync\n")
+	}
+	if req.scratchDevice != "" {
+		// The cd is for a command that left the shell inside /scratch.
+		fmt.Fprintf(&b, "cd / && umount %s 2>/dev/null || sync\n", guestScratchDir)
+	}
+
+	b.WriteString("exit $rc\n")
+	return b.String()
+}
+
+func guestStepScript(i int) string {
+	return fmt.Sprintf("/sandboxd/step-%d.sh", i)
+}
+
+// buildStepsScript stands in for the user command when a request has steps.
+// Each step's stderr goes to a file and is replayed after its stdout, and
+// /proc/uptime stamps let the host compute durations. The stderr and end
+// markers are preceded by a newline so they always start a line.
+func buildStepsScript(steps []StepSpec, shell string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("now() { read -r up _ 2>/dev/null < /proc/uptime && echo \"$up\" || echo -; }\n")
+	b.WriteString("rc=0\n")
+	for i, step := range steps {
+		fmt.Fprintf(&b, "echo \"%s%d begin $(now)\"\n", stepMarker, i)
+		fmt.Fprintf(&b, "%s %s 2>/tmp/sandboxd-step.err\nrc=$?\n", shell, guestStepScript(i))
+		fmt.Fprintf(&b, "printf '\\n%s%d stderr\\n'\ncat /tmp/sandboxd-step.err\n", stepMarker, i)
+		fmt.Fprintf(&b, "printf '\\n%s%d end %%d %%s\\n' \"$rc\" \"$(now)\"\n", stepMarker, i)
+		if !step.ContinueOnError {
+			b.WriteString("[ $rc -eq 0 ] || exit $rc\n")
+		}
+	}
+	b.WriteString("exit $rc\n")
+	return b.String()
+}
+
+// parseStepResults rebuilds per-step results from the markers written by
+// buildStepsScript. Steps that never ran are left out.
+func parseStepResults(text string) []RunResponse {
+	var (
+		results     []RunResponse
+		cur         *RunResponse
+		began       float64
+		out, errOut []string
+		inStderr    bool
+	)
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, stepMarker) {
+			switch {
+			case cur == nil:
+			case inStderr:
+				errOut = append(errOut, line)
+			default:
+				out = append(out, line)
+			}
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, stepMarker))
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[1] {
+		case "begin":
+			cur = &RunResponse{}
+			out, errOut, inStderr = nil, nil, false
+			began = -1
+			if len(fields) > 2 {
+				if v, err := strconv.ParseFloat(fields[2], 64); err == nil {
+					began = v
+				}
+			}
+		case "stderr":
+			inStderr = true
+		case "end":
+			if cur == nil {
+				continue
+			}
+			// The newline printed before each marker ends the last
+			// line, so joining the lines restores the output exactly.
+			cur.Stdout, cur.Stderr = strings.Join(out, "\n"), strings.Join(errOut, "\n")
+			if len(fields) > 2 {
+				cur.ExitCode, _ = strconv.Atoi(fields[2])
+			}
+			if len(fields) > 3 && began >= 0 {
+				if ended, err := strconv.ParseFloat(fields[3], 64); err == nil {
+					cur.DurationMs = int64(math.Round((ended - began) * 1000))
+				}
+			}
+			results = append(results, *cur)
+			cur = nil
+		}
+	}
+	return results
+}
+
+// extractDmesg cuts the dmesg block out of the console text so that it does
+// not end up in stdout, and caps it at maxDmesgBytes (keeping the end).
+func extractDmesg(text string) (dmesg, rest string) {
+	begin := strings.Index(text, "\n"+dmesgBeginMarker+"\n")
+	if begin < 0 {
+		return "", text
+	}
+	body := text[begin+len(dmesgBeginMarker)+2:]
+	end := strings.Index(body, dmesgEndMarker+"\n")
+	if end < 0 {
+		return "", text
+	}
+	dmesg = body[:end]
+	if len(dmesg) > maxDmesgBytes {
+		dmesg = dmesg[len(dmesg)-maxDmesgBytes:]
+	}
+	// The wrapper echoes a newline before the block; dropping it along with
+	// the block restores the console as it would have been without it.
+	return dmesg, text[:begin] + body[end+len(dmesgEndMarker)+1:]
+}
+
+// extractOOM removes the OOM marker line (and the newline printed before
+// it) from the console text and reports whether it was there.
+func extractOOM(text string) (bool, string) {
+	return extractFlagMarker(text, oomMarker)
+}
+
+// extractCommandTiming removes the timing marker line (and the newline
+// printed before it) and returns the guest-measured command duration.
+func extractCommandTiming(text string) (*int64, string) {
+	i := strings.LastIndex(text, "\n"+timingMarker)
+	if i < 0 {
+		return nil, text
+	}
+	line, rest, _ := strings.Cut(text[i+1:], "\n")
+	text = text[:i] + rest
+	var start, end float64
+	if _, err := fmt.Sscanf(strings.TrimPrefix(line, timingMarker), "%f %f", &start, &end); err != nil || end < start {
+		return nil, text
+	}
+	ms := int64(math.Round((end - start) * 1000))
+	return &ms, text
+}
+
+// extractFlagMarker removes a marker printed as printf '\n<marker>\n' from
+// the console text and reports whether it was there.
+func extractFlagMarker(text, marker string) (bool, string) {
+	i := strings.LastIndex(text, "\n"+marker+"\n")
+	if i < 0 {
+		return false, text
+	}
+	return true, text[:i] + text[i+len(marker)+2:]
+}
+
+// setupPrelude is prepended to the command script when the request has a
+// setup script. It is part of the command script rather than the wrapper so
+// that seccomp, faketime and time(1) apply to it as well.
+func setupPrelude() string {
+	return fmt.Sprintf(`echo '%s'
+. %s 2>&1
+sandboxd_rc=$?
+printf '\n%s%%d\n' "$sandboxd_rc"
+[ $sandboxd_rc -eq 0 ] || exit $sandboxd_rc
+`, setupBeginMarker, guestSetupScript, setupEndMarker)
+}
+
+// stdoutJSON returns stdout as raw JSON, or nil if it is not a single
+// valid JSON value (surrounding whitespace, e.g. a trailing newline, is
+// fine).
+func stdoutJSON(stdout string) json.RawMessage {
+	trimmed := strings.TrimSpace(stdout)
+	if trimmed == "" || !json.Valid([]byte(trimmed)) {
+		return nil
+	}
+	return json.RawMessage(trimmed)
+}
+
+// splitSetup moves the setup block out of resp.Stdout. A failed setup makes
+// the run a guest error (125) so it cannot be mistaken for the command
+// failing.
+func splitSetup(resp *RunResponse) {
+	begin := strings.Index(resp.Stdout, setupBeginMarker+"\n")
+	if begin < 0 {
+		return
+	}
+	body := resp.Stdout[begin+len(setupBeginMarker)+1:]
+
+	end := strings.Index(body, "\n"+setupEndMarker)
+	if end < 0 {
+		// setup called exit (or the guest died): the command never ran.
+		resp.SetupOutput = body
+		code := resp.ExitCode
+		resp.SetupExitCode = &code
+		resp.Stdout = resp.Stdout[:begin]
+		resp.ExitCode = guestErrorExitCode
+		resp.Stderr = "setup exited before the command ran"
+		return
+	}
+
+	// As with steps, the newline printed before the end marker ends the
+	// last line of output.
+	resp.SetupOutput = body[:end]
+	rest := body[end+1+len(setupEndMarker):]
+	line, after, _ := strings.Cut(rest, "\n")
+	code, _ := strconv.Atoi(strings.TrimSpace(line))
+	resp.SetupExitCode = &code
+	resp.Stdout = resp.Stdout[:begin] + after
+	if code != 0 {
+		resp.ExitCode = guestErrorExitCode
+		resp.Stderr = fmt.Sprintf("setup failed with exit code %d", code)
+	}
+}
+
+// installGuestScripts writes the wrapper and the user command into the mounted
+// rootfs, after checking that the image has the requested shell.
+func installGuestScripts(mountDir string, req RunRequest) error {
+	shell, err := guestShellPath(req.Shell)
+	if err != nil {
+		return err
+	}
+	if req.Shell != "" {
+		// Symlinks (e.g. to busybox) are resolved in the guest, so Lstat.
+		if _, err := os.Lstat(filepath.Join(mountDir, shell)); err != nil {
+			return newAPIError(errValidation, fmt.Errorf("shell %s is not present in the image", shell))
+		}
+	}
+	return writeGuestScripts(mountDir, req)
+}
+
+// hasStdin reports whether the request feeds the command's stdin.
+func hasStdin(req RunRequest) bool {
+	return req.Stdin != "" || req.StdinB64 != ""
+}
+
+// stdinBytes returns what the command gets on stdin, nil for nothing.
+func stdinBytes(req RunRequest) ([]byte, error) {
+	if req.StdinB64 == "" {
+		if req.Stdin == "" {
+			return nil, nil
+		}
+		return []byte(req.Stdin), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(req.StdinB64)
+	if err != nil {
+		return nil, fmt.Errorf("stdin_b64: %w", err)
+	}
+	return b, nil
+}
+
+// writeGuestScripts writes the wrapper and the user command under root, the
+// guest's / as far as /sandboxd goes. Like /work, the directory may be shared
+// between runs, so refuse symlinks.
+func writeGuestScripts(root string, req RunRequest) error {
+	shell, err := guestShellPath(req.Shell)
+	if err != nil {
+		return err
+	}
+
+	scripts := map[string]string{
+		guestRunScript: buildGuestScript(req),
+		guestCmdScript: req.Cmd + "\n",
+	}
+	stdin, err := stdinBytes(req)
+	if err != nil {
+		return newAPIError(errValidation, err)
+	}
+	prelude := ""
+	if req.Pipefail {
+		prelude = pipefailPrelude()
+	}
+	if len(req.Steps) > 0 {
+		scripts[guestCmdScript] = buildStepsScript(req.Steps, shell)
+		for i, step := range req.Steps {
+			scripts[guestStepScript(i)] = prelude + step.Cmd + "\n"
+		}
+	}
+	if req.Setup != "" {
+		scripts[guestSetupScript] = req.Setup + "\n"
+		scripts[guestCmdScript] = setupPrelude() + scripts[guestCmdScript]
+	}
+	// Before setup, which is sourced into the same shell.
+	scripts[guestCmdScript] = prelude + scripts[guestCmdScript]
+
+	// Cores from an earlier run must not be returned for this one.
+	coreDir := filepath.Join(root, guestCoreDir)
+	if err := checkNoSymlinks(root, coreDir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(coreDir); err != nil {
+		return err
+	}
+
+	for guestPath, content := range scripts {
+		hostPath := filepath.Join(root, guestPath)
+		if err := checkNoSymlinks(root, hostPath); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0o755); err != nil {
+			return err
+		}
+		if err := writeFileNoFollow(hostPath, []byte(content), 0o755); err != nil {
+			return err
+		}
+	}
+
+	// Like the scripts, stdin is left on the image, so a run without any
+	// must not be able to read the previous run's.
+	stdinPath := filepath.Join(root, guestStdinFile)
+	if err := checkNoSymlinks(root, stdinPath); err != nil {
+		return err
+	}
+	if stdin != nil {
+		if err := writeFileNoFollow(stdinPath, stdin, 0o644); err != nil {
+			return err
+		}
+	} else if err := os.Remove(stdinPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if needsGuestHelper(req) {
+		if err := installGuestHelper(root); err != nil {
+			return fmt.Errorf("install guest helper: %w", err)
+		}
+	}
+	return nil
+}
+
+// extractRusage pulls the rusage marker line out of the console text so it
+// does not leak into stdout. It returns nil if the guest never printed one
+// (e.g. time(1) is missing from the rootfs).
+func extractRusage(text string) (*Rusage, string) {
+	var ru *Rusage
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, rusageMarker) {
+			kept = append(kept, line)
+			continue
+		}
+		var r Rusage
+		fields := strings.TrimSpace(strings.TrimPrefix(line, rusageMarker))
+		if _, err := fmt.Sscanf(fields, "%d %f %f %d %d",
+			&r.MaxRSSKB, &r.UserSec, &r.SystemSec, &r.MajorFaults, &r.MinorFaults); err == nil {
+			ru = &r
+		}
+	}
+	return ru, strings.Join(kept, "\n")
+}
+
+// mountHints map fragments of mount(8)/umount(8) error output to their
+// usual cause on a sandboxd host.
+var mountHints = []struct{ match, hint string }{
+	{"failed to setup loop device", "no free loop devices; load the loop module or raise max_loop"},
+	{"no free loop device", "no free loop devices; load the loop module or raise max_loop"},
+	{"must be superuser", "needs root or CAP_SYS_ADMIN"},
+	{"only root", "needs root or CAP_SYS_ADMIN"},
+	{"permission denied", "needs root or CAP_SYS_ADMIN"},
+	{"operation not permitted", "needs root or CAP_SYS_ADMIN"},
+	{"no space left on device", "the filesystem holding the run dir (-run-dir, often a tmpfs) is full"},
+	{"target is busy", "a process still has files open under the mount point"},
+	{"wrong fs type", "the image is not a filesystem mount understands (or is corrupt)"},
+	{"does not exist", "the image or mount point is missing"},
+}
+
+// runMountTool runs mount or umount and, on failure, includes the tool's
+// output and a hint about the likely cause in the error.
+func runMountTool(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(string(out))
+	if msg != "" {
+		err = fmt.Errorf("%w: %s", err, msg)
+	}
+	lower := strings.ToLower(msg)
+	for _, h := range mountHints {
+		if strings.Contains(lower, h.match) {
+			return fmt.Errorf("%w (hint: %s)", err, h.hint)
+		}
+	}
+	return err
+}
+
+// mountImage loop-mounts image at mountDir with the given options (plus
+// "loop"), retrying while the host is out of free loop devices and ctx is
+// not done.
+func mountImage(ctx context.Context, image, mountDir, opts string) error {
+	if opts != "" {
+		opts = "loop," + opts
+	} else {
+		opts = "loop"
+	}
+	backoff, retries := live(&mountBackoff), live(&mountRetries)
+	for attempt := 0; ; attempt++ {
+		err := runMountTool("mount", "-o", opts, image, mountDir)
+		if err == nil || attempt >= retries || !strings.Contains(err.Error(), "loop device") {
+			return err
+		}
+		log.Printf("mount %s: %v; retrying in %s", image, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (gave up: %v)", err, context.Cause(ctx))
+		}
+		backoff *= 2
+	}
+}
+
+// unmountImage unmounts mountDir, retrying while it is busy (a process
+// such as a just-killed firecracker still holding files under it). If it
+// stays busy, it falls back to a lazy unmount, which detaches the mount
+// now and releases the image once the last user goes away.
+func unmountImage(mountDir string) error {
+	backoff, retries := live(&mountBackoff), live(&mountRetries)
+	for attempt := 0; ; attempt++ {
+		err := runMountTool("umount", mountDir)
+		if err == nil {
+			return nil
+		}
+		if !strings.Contains(err.Error(), "busy") {
+			return err
+		}
+		if attempt >= retries {
+			if lazyErr := runMountTool("umount", "-l", mountDir); lazyErr != nil {
+				return fmt.Errorf("%w; lazy umount also failed: %v", err, lazyErr)
+			}
+			log.Printf("umount %s: still busy after %d retries; unmounted lazily", mountDir, retries)
+			return nil
+		}
+		log.Printf("umount %s: %v; retrying in %s", mountDir, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// prepareRootfs loop-mounts the image's rootfs at mountDir, injects the
+// request's files into /work and installs the guest scripts.
+func prepareRootfs(ctx context.Context, mountDir string, img imageProfile, req RunRequest) error {
+	if err := mountImage(ctx, img.RootfsPath, mountDir, ""); err != nil {
+		return newAPIError(errImageUnavailable, fmt.Errorf("mount rootfs: %w", err))
+	}
+
+	unmountErr := func() error {
+		if err := unmountImage(mountDir); err != nil {
+			return fmt.Errorf("umount rootfs: %w", err)
+		}
+		return nil
+	}
+
+	workDir := mountDir + "/work"
 	if err := os.MkdirAll(workDir, 0o755); err != nil {
 		_ = unmountErr()
-		http.Error(w, err.Error(), 500)
+		return err
+	}
+
+	if err := injectFiles(workDir, req.Files); err != nil {
+		_ = unmountErr()
+		return err
+	}
+
+	if req.uploads != nil {
+		if err := writeUploads(workDir, req.uploads); err != nil {
+			_ = unmountErr()
+			return err
+		}
+	}
+
+	if err := fetchFiles(ctx, workDir, req.FetchFiles); err != nil {
+		_ = unmountErr()
+		return err
+	}
+
+	if err := installGuestScripts(mountDir, req); err != nil {
+		_ = unmountErr()
+		return err
+	}
+
+	return unmountErr()
+}
+
+// prepareOverlay builds the per-run drive for a read_only image at drive:
+// an ext4 image whose /upper holds the request's files and the guest
+// scripts, laid out as in the guest, plus an empty /ovlwork for overlayfs.
+// The rootfs itself is never touched, so the shell is not checked here.
+func prepareOverlay(ctx context.Context, drive, runDir string, req RunRequest) error {
+	stage := filepath.Join(runDir, "overlay")
+	defer os.RemoveAll(stage)
+
+	upper := filepath.Join(stage, "upper")
+	workDir := upper + "/work"
+	for _, dir := range []string{workDir, stage + "/ovlwork"} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	if err := injectFiles(workDir, req.Files); err != nil {
+		return err
+	}
+	if req.uploads != nil {
+		if err := writeUploads(workDir, req.uploads); err != nil {
+			return err
+		}
+	}
+	if err := fetchFiles(ctx, workDir, req.FetchFiles); err != nil {
+		return err
+	}
+	if err := writeGuestScripts(upper, req); err != nil {
+		return err
+	}
+
+	var staged int64
+	_ = filepath.WalkDir(stage, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				staged += fi.Size()
+			}
+		}
+		return nil
+	})
+	// Double the staged bytes to leave room for ext4's own overhead.
+	sizeMiB := int64(overlayMiB) + 2*(staged>>20) + 1
+	if err := runMountTool("mkfs.ext4", "-q", "-F", "-d", stage, drive, fmt.Sprintf("%dM", sizeMiB)); err != nil {
+		return newAPIError(errImageUnavailable, fmt.Errorf("build overlay drive: %w", err))
+	}
+	return nil
+}
+
+// bootGuest points an already configured VM at the image's kernel and rootfs
+// (and, if set, the run's overlay and scratch drives, which the guest sees in
+// that order from /dev/vdb on) and starts it. The guest init runs the
+// wrapper script installed by prepareRootfs or prepareOverlay.
+func bootGuest(ctx context.Context, socketPath string, img imageProfile, overlayDrive, scratchDrive string) error {
+	if err := fcPut(ctx, socketPath, "/boot-source", map[string]any{
+		"kernel_image_path": img.KernelPath,
+		"boot_args":         img.bootArgs(),
+	}); err != nil {
+		return err
+	}
+
+	if err := fcPut(ctx, socketPath, "/drives/rootfs", map[string]any{
+		"drive_id":       "rootfs",
+		"path_on_host":   img.RootfsPath,
+		"is_root_device": true,
+		"is_read_only":   img.ReadOnly,
+	}); err != nil {
+		return err
+	}
+
+	for _, d := range []struct{ id, path string }{{"overlay", overlayDrive}, {"scratch", scratchDrive}} {
+		if d.path == "" {
+			continue
+		}
+		if err := fcPut(ctx, socketPath, "/drives/"+d.id, map[string]any{
+			"drive_id":       d.id,
+			"path_on_host":   d.path,
+			"is_root_device": false,
+			"is_read_only":   false,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return fcPut(ctx, socketPath, "/actions", map[string]any{
+		"action_type": "InstanceStart",
+	})
+}
+
+// execTimeout applies the timeout_ms default. Boot time is not counted: the
+// clock starts once the guest init reports in.
+func execTimeout(timeoutMs int) time.Duration {
+	if timeoutMs <= 0 {
+		timeoutMs = 5000
+	}
+	// Requests are validated against maxTimeoutMs, but keep the conversion
+	// from overflowing whatever gets here.
+	if int64(timeoutMs) > math.MaxInt64/int64(time.Millisecond) {
+		return math.MaxInt64
+	}
+	return time.Duration(timeoutMs) * time.Millisecond
+}
+
+// validateTimeout rejects negative and oversized timeout_ms values; 0 means
+// the default.
+func validateTimeout(timeoutMs int) error {
+	if timeoutMs < 0 {
+		return newAPIError(errValidation, fmt.Errorf("timeout_ms must not be negative"))
+	}
+	if limit := live(&maxTimeoutMs); timeoutMs > limit {
+		return newAPIError(errValidation, fmt.Errorf("timeout_ms must be at most %d", limit))
+	}
+	return nil
+}
+
+/* ---------------- Errors ---------------- */
+
+// Stable error codes returned as {"error": {"code", "message"}} so clients
+// can program against them rather than matching message strings.
+const (
+	errValidation        = "VALIDATION_ERROR"
+	errNotFound          = "NOT_FOUND"
+	errMethodNotAllowed  = "METHOD_NOT_ALLOWED"
+	errImageUnavailable  = "IMAGE_UNAVAILABLE"
+	errBootFailed        = "BOOT_FAILED"
+	errKernelPanic       = "KERNEL_PANIC"
+	errAgentTimeout      = "AGENT_TIMEOUT"
+	errPayloadTooLarge   = "PAYLOAD_TOO_LARGE"
+	errSandboxBusy       = "SANDBOX_BUSY"
+	errFetchFailed       = "FETCH_FAILED"
+	errResourceExhausted = "RESOURCE_EXHAUSTED"
+	errUnauthorized      = "UNAUTHORIZED"
+	errShuttingDown      = "SHUTTING_DOWN"
+	errHostDegraded      = "HOST_DEGRADED"
+	errInternal          = "INTERNAL"
+)
+
+var errorStatus = map[string]int{
+	errValidation:        http.StatusBadRequest,
+	errNotFound:          http.StatusNotFound,
+	errMethodNotAllowed:  http.StatusMethodNotAllowed,
+	errImageUnavailable:  http.StatusServiceUnavailable,
+	errBootFailed:        http.StatusBadGateway,
+	errKernelPanic:       http.StatusBadGateway,
+	errAgentTimeout:      http.StatusGatewayTimeout,
+	errPayloadTooLarge:   http.StatusRequestEntityTooLarge,
+	errSandboxBusy:       http.StatusConflict,
+	errFetchFailed:       http.StatusBadGateway,
+	errResourceExhausted: http.StatusTooManyRequests,
+	errUnauthorized:      http.StatusUnauthorized,
+	errShuttingDown:      http.StatusServiceUnavailable,
+	errHostDegraded:      http.StatusServiceUnavailable,
+	errInternal:          http.StatusInternalServerError,
+}
+
+type apiError struct {
+	code string
+	err  error
+	// fields, if set, lists each bad request entry behind err.
+	fields []fieldError
+}
+
+// fieldError is one bad entry of a request map, such as a files name.
+type fieldError struct {
+	Field   string `json:"field"`
+	Name    string `json:"name"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func newAPIError(code string, err error) *apiError {
+	return &apiError{code: code, err: err}
+}
+
+func (e *apiError) Error() string { return e.err.Error() }
+func (e *apiError) Unwrap() error { return e.err }
+
+type errorBody struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// errorBodyFor maps err to its code; errors without one are INTERNAL.
+func errorBodyFor(err error) errorBody {
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return errorBody{Code: ae.code, Message: ae.Error(), Fields: ae.fields}
+	}
+	return errorBody{Code: errInternal, Message: err.Error()}
+}
+
+// bodyError reports a read that ran into maxBodyBytes as PAYLOAD_TOO_LARGE;
+// any other failure is reported as otherwise.
+func bodyError(err, otherwise error) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return newAPIError(errPayloadTooLarge, fmt.Errorf("request body exceeds %d bytes", mbe.Limit))
+	}
+	return otherwise
+}
+
+// contentTooLarge rejects a request whose Content-Length already puts it
+// over limit, before any of the body is read. Bodies without one (chunked)
+// are left to http.MaxBytesReader.
+func contentTooLarge(r *http.Request, limit int64) error {
+	if r.ContentLength > limit {
+		return newAPIError(errPayloadTooLarge, fmt.Errorf("request body of %d bytes exceeds %d bytes", r.ContentLength, limit))
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	body := errorBodyFor(err)
+	status, ok := errorStatus[body.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]errorBody{"error": body})
+}
+
+// injectWorkers bounds how many files injectFiles writes at once.
+var injectWorkers = 8
+
+// injectFiles writes the request's files into workDir. It knows nothing
+// about mounts, so any directory will do. Names are validated up front in
+// sorted order and written by a pool of injectWorkers; either way the error
+// reported is the one for the first bad name in sorted order, as if the
+// files had been written one by one.
+func injectFiles(workDir string, files map[string]FileSpec) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	modes := make([]os.FileMode, len(names))
+	targets := make([]string, len(names))
+	// Names that clean to the same path: the last in sorted order wins, as
+	// it did when files were written sequentially.
+	byPath := make(map[string]int, len(names))
+	for i, name := range names {
+		mode, err := files[name].fileMode()
+		if err != nil {
+			return newAPIError(errValidation, fmt.Errorf("%s: %w", name, err))
+		}
+		target, err := resolveWorkPath(workDir, name)
+		if err != nil {
+			return newAPIError(errValidation, fmt.Errorf("%s: %w", name, err))
+		}
+		modes[i], targets[i] = mode, target
+		byPath[target] = i
+	}
+	for target, i := range byPath {
+		for dir := filepath.Dir(target); dir != workDir && dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			if j, ok := byPath[dir]; ok {
+				return newAPIError(errValidation, fmt.Errorf("%s: %s is also a file", names[i], names[j]))
+			}
+		}
+	}
+
+	jobs := make(chan int)
+	errs := make([]error, len(names))
+	// Lowest failed index so far; later files are skipped, earlier ones
+	// still run so that they can claim the error.
+	var firstFail atomic.Int64
+	firstFail.Store(int64(len(names)))
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(injectWorkers, len(names)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if int64(i) > firstFail.Load() {
+					continue
+				}
+				name := names[i]
+				err := writeWorkFile(workDir, name, strings.NewReader(files[name].Content), modes[i])
+				if err == nil {
+					continue
+				}
+				errs[i] = err
+				for {
+					cur := firstFail.Load()
+					if int64(i) >= cur || firstFail.CompareAndSwap(cur, int64(i)) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	for i := range names {
+		if byPath[targets[i]] == i {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWorkFile streams r into name under workDir, creating parent
+// directories as needed. A zero mode means 0644, or 0755 for content starting
+// with a shebang.
+func writeWorkFile(workDir, name string, r io.Reader, mode os.FileMode) error {
+	targetPath, err := resolveWorkPath(workDir, name)
+	if err != nil {
+		return newAPIError(errValidation, fmt.Errorf("%s: %w", name, err))
+	}
+	if err := checkNoSymlinks(workDir, targetPath); err != nil {
+		return newAPIError(errValidation, fmt.Errorf("%s: %w", name, err))
+	}
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	if mode == 0 {
+		mode = 0o644
+		if head, _ := br.Peek(2); string(head) == "#!" {
+			mode = 0o755
+		}
+	}
+
+	f, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, br); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeUploads streams the remaining parts of a multipart /run body into
+// workDir, one file per part, without buffering them in memory. The part's
+// filename (or, failing that, its form name) is the path under /work.
+func writeUploads(workDir string, mr *multipart.Reader) error {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return bodyError(err, newAPIError(errValidation, fmt.Errorf("read multipart body: %w", err)))
+		}
+		// Part.FileName strips directories; read the raw parameter so nested
+		// paths survive (resolveWorkPath still vets them).
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		name := params["filename"]
+		if name == "" {
+			name = part.FormName()
+		}
+		err = writeWorkFile(workDir, name, part, 0)
+		_ = part.Close()
+		if err != nil {
+			return bodyError(err, err)
+		}
+	}
+}
+
+/* ---------------- Fetched files ---------------- */
+
+var (
+	// Per-file cap on fetch_files downloads.
+	maxFetchBytes int64 = 256 << 20
+
+	fetchClient = &http.Client{
+		Timeout: 2 * time.Minute,
+		Transport: &http.Transport{
+			// No proxy: the address checked below must be the one dialed.
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second, Control: checkFetchDial}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: checkFetchRedirect,
+	}
+)
+
+// checkFetchDial refuses a fetch_files connection to a loopback, link-local,
+// private, unspecified or multicast address. It runs on the resolved address
+// of every dial, redirects included, so a hostname that resolves (or is
+// rebound) to an internal address is caught too.
+func checkFetchDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("refusing to dial %s", address)
+	}
+	if allowFetchPrivate {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("destination %s is not a public address", ip)
+	}
+	return nil
+}
+
+// checkFetchRedirect keeps redirects on http(s) and caps how many are
+// followed; where they lead is checked by checkFetchDial.
+func checkFetchRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to a %s URL", req.URL.Scheme)
+	}
+	return nil
+}
+
+type fetchSpec struct {
+	url    string
+	sha256 []byte // nil when not verified
+}
+
+// parseFetchSpec parses a fetch_files value: a URL, optionally prefixed
+// with "sha256:<64 hex digits>:".
+func parseFetchSpec(v string) (fetchSpec, error) {
+	var spec fetchSpec
+	if rest, ok := strings.CutPrefix(v, "sha256:"); ok {
+		sum, rawURL, ok := strings.Cut(rest, ":")
+		b, err := hex.DecodeString(sum)
+		if !ok || err != nil || len(b) != sha256.Size {
+			return spec, fmt.Errorf("want sha256:<64 hex digits>:<url>")
+		}
+		spec.sha256, v = b, rawURL
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return spec, fmt.Errorf("must be an absolute http(s) URL")
+	}
+	spec.url = v
+	return spec, nil
+}
+
+// fetchFiles downloads each of fetch into workDir, in sorted order. A failed
+// download, one over maxFetchBytes or one with the wrong checksum fails the
+// run with FETCH_FAILED and leaves no partial file behind. Cancelling ctx
+// aborts the download in progress.
+func fetchFiles(ctx context.Context, workDir string, fetch map[string]string) error {
+	names := make([]string, 0, len(fetch))
+	for name := range fetch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec, err := parseFetchSpec(fetch[name])
+		if err != nil {
+			return newAPIError(errValidation, fmt.Errorf("fetch_files %s: %w", name, err))
+		}
+		if err := fetchFile(ctx, workDir, name, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchFile(ctx context.Context, workDir, name string, spec fetchSpec) error {
+	failed := func(format string, args ...any) error {
+		return newAPIError(errFetchFailed, fmt.Errorf("fetch_files %s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, spec.url, nil)
+	if err != nil {
+		return failed("%v", err)
+	}
+	resp, err := fetchClient.Do(hreq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		// Drop the query (often a presigned token) from what we echo back.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return failed("%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return failed("server returned %s", resp.Status)
+	}
+	limit := live(&maxFetchBytes)
+	if resp.ContentLength > limit {
+		return failed("%d bytes exceeds the %d byte limit", resp.ContentLength, limit)
+	}
+
+	lr := &io.LimitedReader{R: resp.Body, N: limit + 1}
+	h := sha256.New()
+	err = writeWorkFile(workDir, name, io.TeeReader(lr, h), 0)
+	var ae *apiError
+	if errors.As(err, &ae) {
+		return err
+	}
+
+	target, _ := resolveWorkPath(workDir, name)
+	switch sum := h.Sum(nil); {
+	case err != nil:
+		_ = os.Remove(target)
+		return failed("%v", err)
+	case lr.N == 0:
+		_ = os.Remove(target)
+		return failed("download exceeds the %d byte limit", limit)
+	case spec.sha256 != nil && !bytes.Equal(sum, spec.sha256):
+		_ = os.Remove(target)
+		return failed("sha256 mismatch: got %x", sum)
+	}
+	return nil
+}
+
+/* ---------------- Output files ---------------- */
+
+const (
+	// Caps the total size of files returned from output_globs.
+	maxOutputBytes = 64 << 20
+
+	tarContentType = "application/x-tar"
+	// First entry of a tar response: the RunResponse without Outputs.
+	tarManifestName = ".sandboxd-response.json"
+	// Last entry of a tar response to a return_scratch run.
+	scratchTarName = ".sandboxd-scratch.tar"
+)
+
+func validateOutputGlob(pattern string) error {
+	if pattern == "" || filepath.IsAbs(pattern) {
+		return fmt.Errorf("must be a non-empty relative pattern")
+	}
+	clean := filepath.Clean(pattern)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(os.PathSeparator)) {
+		return fmt.Errorf("path traversal is not allowed")
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readBack mounts image (the rootfs, or a read_only image's overlay drive)
+// read-only after the VM is gone and fills in resp's outputs (regular files
+// under /work matching output_globs, up to maxOutputBytes in total) and core
+// dump. root is the guest's / within the image: "" or "/upper". Symlinks are
+// skipped, as anything the guest left behind is untrusted.
+func readBack(mountDir, image, root string, req RunRequest, resp *RunResponse) error {
+	if err := mountImage(context.Background(), image, mountDir, "ro"); err != nil {
+		return newAPIError(errImageUnavailable, fmt.Errorf("mount rootfs for outputs: %w", err))
+	}
+	defer func() {
+		_ = unmountImage(mountDir)
+	}()
+
+	root = mountDir + root
+	if len(req.OutputGlobs) > 0 {
+		resp.Outputs, resp.OutputsTruncated = readOutputs(root+"/work", req.OutputGlobs, maxOutputBytes)
+	}
+	if req.CaptureCore {
+		resp.Core = coreDump(root, resp.ExitCode)
+	}
+	return nil
+}
+
+func readOutputs(workDir string, globs []string, limit int64) (map[string][]byte, bool) {
+	outputs := map[string][]byte{}
+	truncated := false
+	var total int64
+
+	for _, g := range globs {
+		matches, _ := filepath.Glob(filepath.Join(workDir, g))
+		for _, m := range matches {
+			rel, err := filepath.Rel(workDir, m)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+				continue
+			}
+			if _, seen := outputs[rel]; seen {
+				continue
+			}
+			if checkNoSymlinks(workDir, m) != nil {
+				continue
+			}
+			fi, err := os.Lstat(m)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			if total+fi.Size() > limit {
+				truncated = true
+				continue
+			}
+			f, err := os.OpenFile(m, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				continue
+			}
+			data, err := io.ReadAll(io.LimitReader(f, fi.Size()))
+			_ = f.Close()
+			if err != nil {
+				continue
+			}
+			outputs[rel] = data
+			total += int64(len(data))
+		}
+	}
+	return outputs, truncated
+}
+
+/* ---------------- Scratch drives ---------------- */
+
+const (
+	guestScratchDir   = "/scratch"
+	defaultScratchMiB = 256
+)
+
+// createScratchDrive makes an empty, sparse ext4 image of mib (or
+// defaultScratchMiB) at path for return_scratch.
+func createScratchDrive(path string, mib int) error {
+	if mib == 0 {
+		mib = defaultScratchMiB
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(mib) << 20)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := runMountTool("mkfs.ext4", "-q", "-F", path); err != nil {
+		return newAPIError(errImageUnavailable, fmt.Errorf("create scratch drive: %w", err))
+	}
+	return nil
+}
+
+// tarScratch mounts the scratch drive read-only after the VM is gone and
+// archives it.
+func tarScratch(mountDir, drive string) ([]byte, error) {
+	if err := mountImage(context.Background(), drive, mountDir, "ro"); err != nil {
+		return nil, newAPIError(errImageUnavailable, fmt.Errorf("mount scratch drive: %w", err))
+	}
+	defer func() {
+		_ = unmountImage(mountDir)
+	}()
+	return tarDir(mountDir)
+}
+
+// tarDir archives the directories, regular files and symlinks under root,
+// leaving out ext4's lost+found. Symlinks are stored as links, never
+// followed.
+func tarDir(root string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if rel == "lost+found" && d.IsDir() {
+			return filepath.SkipDir
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case fi.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !fi.IsDir() && !fi.Mode().IsRegular():
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, fi.Size())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/* ---------------- Core dumps ---------------- */
+
+// Caps the core file returned by capture_core; larger cores are cut short
+// and marked truncated.
+const maxCoreBytes = 16 << 20
+
+// coreSignals names the signals a shell reports as exit code 128+N.
+var coreSignals = map[int]string{
+	1: "SIGHUP", 2: "SIGINT", 3: "SIGQUIT", 4: "SIGILL", 5: "SIGTRAP",
+	6: "SIGABRT", 7: "SIGBUS", 8: "SIGFPE", 9: "SIGKILL", 11: "SIGSEGV",
+	13: "SIGPIPE", 14: "SIGALRM", 15: "SIGTERM", 24: "SIGXCPU", 25: "SIGXFSZ",
+	31: "SIGSYS",
+}
+
+// coreDump reports the signal behind exitCode and the newest regular file in
+// guestCoreDir under root, or nil if there is neither.
+func coreDump(root string, exitCode int) *CoreDump {
+	core := &CoreDump{Signal: coreSignals[exitCode-128]}
+
+	var newest os.FileInfo
+	var entries []os.DirEntry
+	coreDir := filepath.Join(root, guestCoreDir)
+	if checkNoSymlinks(root, coreDir) == nil {
+		entries, _ = os.ReadDir(coreDir)
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if newest == nil || fi.ModTime().After(newest.ModTime()) {
+			newest = fi
+		}
+	}
+	if newest != nil {
+		if f, err := os.OpenFile(filepath.Join(coreDir, newest.Name()), os.O_RDONLY|syscall.O_NOFOLLOW, 0); err == nil {
+			core.Data, _ = io.ReadAll(io.LimitReader(f, maxCoreBytes))
+			_ = f.Close()
+			core.Name, core.Size = newest.Name(), newest.Size()
+			core.Truncated = newest.Size() > int64(len(core.Data))
+		}
+	}
+
+	if core.Signal == "" && core.Name == "" {
+		return nil
+	}
+	return core
+}
+
+func acceptsTar(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == tarContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTarResponse streams resp as a tar archive: a JSON manifest with
+// everything but the outputs and scratch, followed by one entry per output
+// file and the scratch archive, if any.
+func writeTarResponse(w io.Writer, resp RunResponse) error {
+	outputs, scratch := resp.Outputs, resp.Scratch
+	resp.Outputs, resp.Scratch = nil, nil
+	manifest, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	if err := writeTarEntry(tw, tarManifestName, manifest, 0o644, now); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeTarEntry(tw, filepath.ToSlash(name), outputs[name], 0o644, now); err != nil {
+			return err
+		}
+	}
+	if scratch != nil {
+		if err := writeTarEntry(tw, scratchTarName, scratch, 0o644, now); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte, mode int64, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    mode,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+/* ---------------- Executors ---------------- */
+
+// Executor runs one request to completion. Everything that runs commands
+// (/run, callbacks, /prewarm) goes through the configured executor.
+type Executor interface {
+	Execute(ctx context.Context, req RunRequest) (RunResponse, error)
+}
+
+const (
+	executorFirecracker = "firecracker"
+	executorNamespace   = "namespace"
+	executorGVisor      = "gvisor"
+	executorFake        = "fake"
+	executorAuto        = "auto"
+)
+
+var executor Executor = firecrackerExecutor{}
+
+// selectExecutor resolves the -executor flag. "auto" uses firecracker when
+// it is installed and /dev/kvm exists, then gVisor if runsc is installed,
+// and falls back to namespaces.
+func selectExecutor(name string) (Executor, error) {
+	switch name {
+	case executorFirecracker:
+		return firecrackerExecutor{}, nil
+	case executorNamespace:
+		return namespaceExecutor{}, nil
+	case executorGVisor:
+		return gvisorExecutor{}, nil
+	case executorFake:
+		log.Printf("using the fake executor: commands run on the host, unisolated")
+		return fakeShellExecutor{}, nil
+	case executorAuto:
+		_, lookErr := exec.LookPath("firecracker")
+		_, kvmErr := os.Stat("/dev/kvm")
+		if lookErr == nil && kvmErr == nil {
+			return firecrackerExecutor{}, nil
+		}
+		if _, err := exec.LookPath(runscPath); err == nil {
+			log.Printf("firecracker or /dev/kvm unavailable; using the gvisor executor")
+			return gvisorExecutor{}, nil
+		}
+		log.Printf("firecracker, /dev/kvm or runsc unavailable; using the namespace executor (weaker isolation)")
+		return namespaceExecutor{}, nil
+	}
+	return nil, fmt.Errorf("unknown executor %q", name)
+}
+
+// firecrackerExecutor boots a microVM per run.
+type firecrackerExecutor struct{}
+
+func (firecrackerExecutor) Execute(ctx context.Context, req RunRequest) (RunResponse, error) {
+	return runExecution(ctx, req.execID, req)
+}
+
+// namespaceExecutor runs the same guest scripts chrooted into the loop-mounted
+// rootfs in fresh mount, PID, UTS, IPC and network namespaces. It is meant
+// for CI and laptops without KVM: the command runs as root on the host
+// kernel, so this is not a security boundary.
+type namespaceExecutor struct{}
+
+func (namespaceExecutor) Execute(ctx context.Context, req RunRequest) (RunResponse, error) {
+	return runMounted(ctx, req, executorNamespace, namespaceCommand)
+}
+
+// namespaceCommand runs the wrapper chrooted into mountDir in fresh
+// namespaces.
+func namespaceCommand(ctx context.Context, execID, mountDir, runDir string) (*exec.Cmd, func(), error) {
+	// The path is resolved after the chroot, i.e. this is the image's sh.
+	cmd := exec.CommandContext(ctx, "/bin/sh", guestRunScript)
+	cmd.Dir = "/"
+	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Chroot: mountDir,
+		// The shell is PID 1 of its namespace, so killing it on timeout
+		// takes everything it started with it.
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWNET,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	return cmd, func() {}, nil
+}
+
+// gvisorExecutor runs the guest scripts in a gVisor (runsc) sandbox whose
+// root is the loop-mounted rootfs. It needs neither KVM nor nested
+// virtualization, and the command talks to gVisor's user-space kernel
+// rather than the host's.
+type gvisorExecutor struct{}
+
+func (gvisorExecutor) Execute(ctx context.Context, req RunRequest) (RunResponse, error) {
+	return runMounted(ctx, req, executorGVisor, gvisorCommand)
+}
+
+// runscPath is the runsc binary the gvisor executor uses.
+var runscPath = "runsc"
+
+// gvisorCommand writes an OCI bundle for the mounted rootfs under runDir
+// and returns "runsc run" for it. The cleanup force-deletes the sandbox,
+// which a timeout leaves behind when it kills runsc.
+func gvisorCommand(ctx context.Context, execID, mountDir, runDir string) (*exec.Cmd, func(), error) {
+	bundle := filepath.Join(runDir, "bundle")
+	state := filepath.Join(runDir, "runsc")
+	for _, dir := range []string{bundle, state} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return nil, nil, err
+		}
+	}
+	spec, err := json.MarshalIndent(gvisorSpec(mountDir), "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(filepath.Join(bundle, "config.json"), spec, 0o644); err != nil {
+		return nil, nil, err
+	}
+
+	// No network, and writes go straight to the mounted image (gVisor's
+	// default overlay would keep them in memory, away from output_globs).
+	global := []string{"--root", state, "--network=none", "--overlay2=none"}
+	cmd := exec.CommandContext(ctx, runscPath, append(global, "run", "--bundle", bundle, execID)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	cleanup := func() {
+		_ = exec.Command(runscPath, append(global, "delete", "--force", execID)...).Run()
+	}
+	return cmd, cleanup, nil
+}
+
+// gvisorSpec is the OCI runtime config for a run: the wrapper as root in
+// fresh namespaces, with the mounts init would otherwise set up.
+// CAP_SYS_ADMIN lets the wrapper mount tmpfs /work and devpts; it only
+// reaches gVisor's kernel.
+func gvisorSpec(rootfs string) map[string]any {
+	caps := []string{
+		"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FOWNER", "CAP_FSETID", "CAP_KILL",
+		"CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP", "CAP_SETFCAP", "CAP_MKNOD",
+		"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_AUDIT_WRITE", "CAP_SYS_ADMIN",
+	}
+	mount := func(dest, typ string, options ...string) map[string]any {
+		return map[string]any{"destination": dest, "type": typ, "source": typ, "options": options}
+	}
+	namespaces := []map[string]string{}
+	for _, ns := range []string{"pid", "ipc", "uts", "mount", "network"} {
+		namespaces = append(namespaces, map[string]string{"type": ns})
+	}
+	return map[string]any{
+		"ociVersion": "1.0.2",
+		"hostname":   "sandbox",
+		"root":       map[string]any{"path": rootfs, "readonly": false},
+		"process": map[string]any{
+			"args": []string{"/bin/sh", guestRunScript},
+			"cwd":  "/",
+			"env":  []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"},
+			"user": map[string]int{"uid": 0, "gid": 0},
+			"capabilities": map[string][]string{
+				"bounding": caps, "effective": caps, "permitted": caps,
+			},
+		},
+		"mounts": []map[string]any{
+			mount("/proc", "proc"),
+			mount("/dev", "tmpfs", "nosuid", "mode=755"),
+			mount("/dev/pts", "devpts", "nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"),
+			mount("/sys", "sysfs", "nosuid", "noexec", "nodev", "ro"),
+			mount("/tmp", "tmpfs", "nosuid", "nodev"),
+		},
+		"linux": map[string]any{"namespaces": namespaces},
+	}
+}
+
+// fakeShellExecutor is for testing sandboxd itself where there is no KVM or
+// root, e.g. in CI. It pretends to boot, then runs cmd with the host's sh in
+// a fresh directory standing in for /work, with files injected, env set and
+// timeout_ms enforced. output_globs are read back from there. It needs no
+// image; the image is only looked up for its env. Options that only mean
+// something in a guest are ignored, and those whose results it cannot fake
+// are refused. Nothing is isolated.
+type fakeShellExecutor struct{}
+
+func (fakeShellExecutor) Execute(parent context.Context, req RunRequest) (RunResponse, error) {
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"steps", len(req.Steps) > 0}, {"setup", req.Setup != ""}, {"tty", req.Tty}, {"live_files", req.LiveFiles},
+		{"return_scratch", req.ReturnScratch}, {"capture_core", req.CaptureCore}, {"fetch_files", len(req.FetchFiles) > 0},
+		{"hostname", req.Hostname != ""}, {"hosts_entries", len(req.HostsEntries) > 0},
+	} {
+		if o.set {
+			return RunResponse{}, newAPIError(errValidation, fmt.Errorf("%s is not supported by the %s executor", o.name, executorFake))
+		}
+	}
+	start := time.Now()
+	execID := req.execID
+	img, err := lookupImage(req.Image)
+	if err != nil {
+		return RunResponse{}, err
+	}
+
+	runDir := filepath.Join(runBaseDir, execID)
+	workDir := filepath.Join(runDir, "work")
+	if err := os.MkdirAll(workDir, 0o755); err != nil {
+		return RunResponse{}, err
+	}
+	defer os.RemoveAll(runDir)
+
+	log.Printf("run %s (%s): %q", execID, executorFake, req.Cmd)
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	registerExecution(execID, req.Cmd, cancel)
+	defer unregisterExecution(execID)
+
+	prepStart := time.Now()
+	if err := injectFiles(workDir, req.Files); err != nil {
+		return RunResponse{}, err
+	}
+	if req.uploads != nil {
+		if err := writeUploads(workDir, req.uploads); err != nil {
+			return RunResponse{}, err
+		}
+	}
+	timings := Timings{ImagePrepMs: time.Since(prepStart).Milliseconds()}
+
+	runCtx, stop := context.WithTimeout(ctx, execTimeout(req.TimeoutMs))
+	defer stop()
+	script := req.Cmd
+	if req.Pipefail {
+		script = pipefailPrelude() + script
+	}
+	cmd := exec.CommandContext(runCtx, "sh", "-c", script)
+	cmd.Dir = workDir
+	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=" + workDir}
+	for _, env := range []map[string]string{img.Env, req.Env} {
+		for name, value := range env {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+	}
+	// Kill whatever the command started too, and do not wait on anything
+	// that held on to its output.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = 100 * time.Millisecond
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin, _ := stdinBytes(req); stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	execStart := time.Now()
+	runErr := cmd.Run()
+	timings.ExecMs = time.Since(execStart).Milliseconds()
+	switch {
+	case ctx.Err() != nil:
+		return cancelledResponse(ctx, req, "", stdout.String()), nil
+	case runCtx.Err() != nil:
+		return RunResponse{Stdout: stdout.String(), Stderr: timeoutMessage, ExitCode: live(&timeoutExitCode), OutputIncomplete: true, ExitReason: exitReasonTimeout}, nil
+	}
+
+	resp := RunResponse{Stdout: stdout.String(), Stderr: stderr.String(), ExitReason: exitReasonExited}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(runErr, &exitErr):
+		resp.ExitCode = exitErr.ExitCode()
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			resp.ExitCode = 128 + int(ws.Signal())
+		}
+	case runErr != nil && !errors.Is(runErr, exec.ErrWaitDelay):
+		return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("start %s: %w", executorFake, runErr))
+	}
+	if len(req.OutputGlobs) > 0 {
+		resp.Outputs, resp.OutputsTruncated = readOutputs(workDir, req.OutputGlobs, maxOutputBytes)
+	}
+	if req.Timings {
+		timings.TotalMs = time.Since(start).Milliseconds()
+		resp.Timings = &timings
+	}
+	return resp, nil
+}
+
+// runMounted is the body of the executors that run the guest scripts
+// directly against the loop-mounted rootfs instead of booting it: command
+// starts the wrapper and the rest (injection, timeout, output parsing)
+// is shared.
+func runMounted(parent context.Context, req RunRequest, name string, command func(ctx context.Context, execID, mountDir, runDir string) (*exec.Cmd, func(), error)) (RunResponse, error) {
+	if req.ReturnScratch {
+		return RunResponse{}, newAPIError(errValidation, fmt.Errorf("return_scratch is not supported by the %s executor", name))
+	}
+	if req.LiveFiles {
+		return RunResponse{}, newAPIError(errValidation, fmt.Errorf("live_files is not supported by the %s executor", name))
+	}
+	start := time.Now()
+	execID := req.execID
+	img, err := lookupImage(req.Image)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	req.imageEnv = img.Env
+
+	runDir := filepath.Join(runBaseDir, execID)
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		return RunResponse{}, err
+	}
+	defer os.RemoveAll(runDir)
+
+	unlock, err := lockRootfs(img)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	defer unlock()
+
+	log.Printf("run %s (%s): %q", execID, name, req.Cmd)
+	// dmesg here would be the host's kernel log (or gVisor's made-up one),
+	// not a guest's.
+	req.Dmesg = false
+	req.hostKernel = true
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	registerExecution(execID, req.Cmd, cancel)
+	defer unregisterExecution(execID)
+
+	mountDir := filepath.Join(runDir, "rootfs")
+	if err := os.Mkdir(mountDir, 0o755); err != nil {
+		return RunResponse{}, err
+	}
+	prepStart := time.Now()
+	if err := prepareRootfs(ctx, mountDir, img, req); err != nil {
+		return RunResponse{}, err
+	}
+	// No VM here, so there is nothing to start or boot.
+	timings := Timings{ImagePrepMs: time.Since(prepStart).Milliseconds()}
+	if err := mountImage(ctx, img.RootfsPath, mountDir, ""); err != nil {
+		return RunResponse{}, newAPIError(errImageUnavailable, fmt.Errorf("mount rootfs: %w", err))
+	}
+	defer func() {
+		_ = unmountImage(mountDir)
+	}()
+
+	runCtx, stop := context.WithTimeout(ctx, execTimeout(req.TimeoutMs)+backstop())
+	defer stop()
+
+	cmd, cleanup, err := command(runCtx, execID, mountDir, runDir)
+	if err != nil {
+		return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("prepare %s sandbox: %w", name, err))
+	}
+	// Before the unmount, which would otherwise find the rootfs busy.
+	defer cleanup()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	execStart := time.Now()
+	runErr := cmd.Run()
+	timings.ExecMs = time.Since(execStart).Milliseconds()
+	switch {
+	case ctx.Err() != nil:
+		return cancelledResponse(ctx, req, "", partialStdout(stdout.String())), nil
+	case runCtx.Err() != nil:
+		_, partial := extractFlagMarker(stdout.String(), terminateMarker)
+		return RunResponse{Stdout: partial, Stderr: timeoutMessage, ExitCode: live(&timeoutExitCode), OutputIncomplete: true, ExitReason: exitReasonTimeout}, nil
+	}
+
+	resp := RunResponse{Stdout: stdout.String(), Stderr: stderr.String(), ExitReason: exitReasonExited}
+	if req.Tty {
+		// The terminal turns \n into \r\n; the console path undoes that too.
+		resp.Stdout = strings.ReplaceAll(resp.Stdout, "\r\n", "\n")
+		resp.StreamsCombined = true
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(runErr, &exitErr):
+		resp.ExitCode = exitErr.ExitCode()
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			resp.ExitCode = 128 + int(ws.Signal())
+		}
+	case runErr != nil:
+		return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("start %s sandbox: %w", name, runErr))
+	}
+	terminated(&resp)
+
+	if req.Timings {
+		timings.CommandMs, resp.Stdout = extractCommandTiming(resp.Stdout)
+		resp.Timings = &timings
+	}
+	if req.CaptureRusage {
+		resp.Rusage, resp.Stdout = extractRusage(resp.Stdout)
+	}
+	if full, rest := extractFlagMarker(resp.Stdout, workFullMarker); full {
+		resp.ResourceExhausted, resp.Stdout = "disk", rest
+	}
+	if req.Setup != "" {
+		splitSetup(&resp)
+	}
+	if len(req.Steps) > 0 {
+		resp.StepResults = parseStepResults(resp.Stdout)
+	}
+	if len(req.OutputGlobs) > 0 {
+		resp.Outputs, resp.OutputsTruncated = readOutputs(mountDir+"/work", req.OutputGlobs, maxOutputBytes)
+	}
+	if req.CaptureCore {
+		resp.Core = coreDump(mountDir, resp.ExitCode)
+	}
+	timings.TotalMs = time.Since(start).Milliseconds()
+	return resp, nil
+}
+
+/* ---------------- HTTP handler ---------------- */
+
+// runHandler only deals in HTTP: it decodes and validates the request, hands
+// it to the executor and encodes the result.
+func runHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("POST only")))
+		return
+	}
+
+	ctx, root := startServerSpan(r, "POST "+r.URL.Path)
+	// /run/async keeps the result for /run/result/{exec_id}.
+	poll := r.URL.Path == "/run/async"
+	async := false
+	defer func() {
+		if !async {
+			root.finish(nil)
+		}
+	}()
+
+	_, validateSpan := startSpan(ctx, "validate")
+	bodyLimit := live(&maxBodyBytes)
+	if err := contentTooLarge(r, bodyLimit); err != nil {
+		validateSpan.finish(err)
+		writeError(w, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, bodyLimit)
+	req, err := decodeRunRequest(r)
+	if err == nil {
+		err = validateRunRequest(req)
+	}
+	validateSpan.finish(err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	execID, err := newExecID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var claim *idempotentRun
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		c, leader, err := claimIdempotencyKey(key, r.URL.Path, req, execID, req.CallbackURL != "" || poll)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !leader {
+			replayIdempotent(w, r, req, c)
+			return
+		}
+		claim = c
+		// A retry after a dropped connection should find the run still
+		// going, so it must not die with this request.
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	breakerDone, err := admitBreaker()
+	if err != nil {
+		claim.finish(RunResponse{}, err)
+		writeError(w, err)
+		return
+	}
+	if err := admitRun(); err != nil {
+		breakerDone(err)
+		claim.finish(RunResponse{}, err)
+		writeError(w, err)
+		return
+	}
+	defer func() {
+		if !async {
+			finishRun()
+		}
+	}()
+
+	req.execID = execID
+	root.setAttr("sandboxd.exec_id", execID)
+	w.Header().Set(schemaVersionHeader, strconv.Itoa(responseSchemaVersion))
+
+	if req.CallbackURL != "" || poll {
+		// The run outlives this request, so it must not inherit r.Context()'s
+		// cancellation (only its trace).
+		async = true
+		if poll {
+			startResult(execID)
+		}
+		go func() {
+			defer finishRun()
+			resp, err := executeRun(context.WithoutCancel(ctx), req)
+			breakerDone(err)
+			resp.SchemaVersion = responseSchemaVersion
+			if req.ParseJSONStdout && err == nil {
+				resp.StdoutJSON = stdoutJSON(resp.Stdout)
+			}
+			recordRun(req, resp, err)
+			claim.finish(resp, err)
+			if poll {
+				finishResult(execID, resp, err)
+			}
+			if req.CallbackURL != "" {
+				deliverCallback(execID, req.CallbackURL, resp, err)
+			}
+			root.finish(err)
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"exec_id": execID})
+		return
+	}
+
+	resp, err := executeRun(ctx, req)
+	breakerDone(err)
+	if err != nil {
+		root.setAttr("sandboxd.error_code", errorBodyFor(err).Code)
+		recordRun(req, resp, err)
+		claim.finish(resp, err)
+		writeError(w, err)
+		return
+	}
+	resp.ExecID = execID
+	resp.SchemaVersion = responseSchemaVersion
+	if req.ParseJSONStdout {
+		resp.StdoutJSON = stdoutJSON(resp.Stdout)
+	}
+	recordRun(req, resp, nil)
+	claim.finish(resp, nil)
+	root.setAttr("sandboxd.exit_code", strconv.Itoa(resp.ExitCode))
+	_, respSpan := startSpan(ctx, "response")
+	writeRunResponse(w, r, req, resp)
+	respSpan.finish(nil)
+}
+
+var errOverallTimeout = errors.New("overall timeout exceeded")
+
+// maxOverallTimeoutMs is the largest overall_timeout_ms a request may ask
+// for: the longest command plus as long again for everything around it.
+func maxOverallTimeoutMs() int {
+	return 2 * live(&maxTimeoutMs)
+}
+
+// overallTimeout converts overall_timeout_ms. Requests are validated
+// against maxOverallTimeoutMs, but keep the conversion from overflowing
+// whatever gets here.
+func overallTimeout(overallMs int) time.Duration {
+	if int64(overallMs) > math.MaxInt64/int64(time.Millisecond) {
+		return math.MaxInt64
+	}
+	return time.Duration(overallMs) * time.Millisecond
+}
+
+// executeRun runs req on the executor within its overall_timeout_ms. A run
+// cut short by it is reported like a timeout, with whatever output and
+// step results it had by then; where it was stopped before the command
+// ran, that is nothing.
+func executeRun(ctx context.Context, req RunRequest) (RunResponse, error) {
+	if req.OverallTimeoutMs <= 0 {
+		return executor.Execute(ctx, req)
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, overallTimeout(req.OverallTimeoutMs), errOverallTimeout)
+	defer cancel()
+	resp, err := executor.Execute(ctx, req)
+	if !errors.Is(context.Cause(ctx), errOverallTimeout) || (err == nil && resp.ExitReason != exitReasonKilled) {
+		// Finished (or failed on its own) in time.
+		return resp, err
+	}
+	if err != nil {
+		resp = RunResponse{}
+	}
+	resp.ExitCode = live(&timeoutExitCode)
+	resp.ExitReason = exitReasonOverall
+	resp.OutputIncomplete = true
+	resp.Stderr = fmt.Sprintf("%s (overall_timeout_ms %d)", errOverallTimeout, req.OverallTimeoutMs)
+	return resp, nil
+}
+
+// validateRunRequest checks everything that can be checked before a run
+// starts. All failures are VALIDATION_ERRORs.
+func validateRunRequest(req RunRequest) error {
+	invalid := func(format string, args ...any) error {
+		return newAPIError(errValidation, fmt.Errorf(format, args...))
+	}
+
+	switch {
+	case req.Cmd == "" && len(req.Steps) == 0:
+		return invalid("cmd is required")
+	case req.Cmd != "" && len(req.Steps) > 0:
+		return invalid("cmd and steps are mutually exclusive")
+	case len(req.Steps) > maxSteps:
+		return invalid("at most %d steps are allowed", maxSteps)
+	}
+	for i, step := range req.Steps {
+		if step.Cmd == "" {
+			return invalid("steps[%d]: cmd is required", i)
+		}
+	}
+	if err := validateTimeout(req.TimeoutMs); err != nil {
+		return err
+	}
+	switch {
+	case req.OverallTimeoutMs < 0:
+		return invalid("overall_timeout_ms must not be negative")
+	case req.OverallTimeoutMs > maxOverallTimeoutMs():
+		return invalid("overall_timeout_ms must be at most %d", maxOverallTimeoutMs())
+	}
+	if _, err := lookupImage(req.Image); err != nil {
+		return err
+	}
+	if _, err := seccompProfileName(req.Seccomp); err != nil {
+		return err
+	}
+	if shell, err := guestShellPath(req.Shell); err != nil {
+		return err
+	} else if req.Pipefail && noPipefailShells[shell] {
+		return invalid("pipefail is not supported by %s", shell)
+	}
+	if _, err := fakeTimeSpec(req.FakeTime); err != nil {
+		return invalid("%w", err)
+	}
+	if req.TmpfsWorkMB < 0 || req.TmpfsWorkMB > maxTmpfsWorkMB {
+		return invalid("tmpfs_work_mb must be between 0 and %d", maxTmpfsWorkMB)
+	}
+	if limit := live(&maxScratchMiB); req.ScratchMiB < 0 || req.ScratchMiB > limit {
+		return invalid("scratch_mib must be between 0 and %d", limit)
+	}
+	if req.ScratchMiB > 0 && !req.ReturnScratch {
+		return invalid("scratch_mib needs return_scratch")
+	}
+	if req.Stdin != "" && req.StdinB64 != "" {
+		return invalid("stdin and stdin_b64 are mutually exclusive")
+	}
+	if _, err := stdinBytes(req); err != nil {
+		return invalid("%w", err)
+	}
+	if hasStdin(req) && (req.Tty || req.LiveFiles) {
+		return invalid("stdin cannot be combined with tty or live_files")
+	}
+	if req.LiveFiles && req.Tty {
+		return invalid("live_files cannot be combined with tty")
+	}
+	if req.WorkQuotaMiB < 0 || req.WorkQuotaMiB > maxTmpfsWorkMB {
+		return invalid("work_quota_mib must be between 0 and %d", maxTmpfsWorkMB)
+	}
+	if req.WorkQuotaMiB > 0 && req.TmpfsWorkMB > 0 {
+		return invalid("work_quota_mib and tmpfs_work_mb are mutually exclusive")
+	}
+	if req.KeepAliveOnFailure && !live(&allowKeepAlive) {
+		return invalid("keep_alive_on_failure requires the server to run with -debug-keep-alive")
+	}
+	if req.ExtraBootArgs != "" {
+		if !live(&allowExtraBootArgs) {
+			return invalid("extra_boot_args requires the server to run with -allow-extra-boot-args")
+		}
+		if err := validateExtraBootArgs(req.ExtraBootArgs); err != nil {
+			return invalid("%w", err)
+		}
+	}
+	if err := validateFileNames(req); err != nil {
+		return err
+	}
+	if err := validateEnv(req.Env); err != nil {
+		return invalid("%w", err)
+	}
+	if err := validateHosts(req.Hostname, req.HostsEntries); err != nil {
+		return invalid("%w", err)
+	}
+	for _, g := range req.OutputGlobs {
+		if err := validateOutputGlob(g); err != nil {
+			return invalid("output_globs %q: %w", g, err)
+		}
+	}
+	if len(req.FetchFiles) > 0 && !allowFetchFiles {
+		return invalid("fetch_files requires the server to run with -allow-fetch-files")
+	}
+	for name, v := range req.FetchFiles {
+		if _, err := parseFetchSpec(v); err != nil {
+			return invalid("fetch_files %s: %w", name, err)
+		}
+	}
+	if req.StrictPaths {
+		names := make([]string, 0, len(req.Files)+len(req.FetchFiles))
+		for name := range req.Files {
+			names = append(names, name)
+		}
+		for name := range req.FetchFiles {
+			names = append(names, name)
+		}
+		if err := checkPortablePaths(names); err != nil {
+			return invalid("strict_paths: %w", err)
+		}
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			return invalid("%w", err)
+		}
+		if req.uploads != nil {
+			// Parts are streamed from the request body, which is gone by
+			// the time an asynchronous run gets to them.
+			return invalid("callback_url cannot be combined with multipart uploads")
+		}
+	}
+	return nil
+}
+
+// validateFileNames checks every files and fetch_files name, and every
+// files mode, and reports all the bad ones in one VALIDATION_ERROR rather
+// than stopping at the first.
+func validateFileNames(req RunRequest) error {
+	var bad []fieldError
+	check := func(field string, names []string, mode func(string) error) {
+		sort.Strings(names)
+		for _, name := range names {
+			reason := ""
+			_, err := resolveWorkPath("/work", name)
+			switch {
+			case errors.Is(err, errEmptyPath):
+				reason = "empty"
+			case errors.Is(err, errAbsolutePath):
+				reason = "absolute"
+			case err != nil:
+				reason = "traversal"
+			case mode != nil:
+				if err = mode(name); err != nil {
+					reason = "mode"
+				}
+			}
+			if err != nil {
+				bad = append(bad, fieldError{Field: field, Name: name, Reason: reason, Message: err.Error()})
+			}
+		}
+	}
+	names := make([]string, 0, len(req.Files))
+	for name := range req.Files {
+		names = append(names, name)
+	}
+	check("files", names, func(name string) error {
+		_, err := req.Files[name].fileMode()
+		return err
+	})
+	names = make([]string, 0, len(req.FetchFiles))
+	for name := range req.FetchFiles {
+		names = append(names, name)
+	}
+	check("fetch_files", names, nil)
+
+	if len(bad) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(bad))
+	for i, f := range bad {
+		msgs[i] = fmt.Sprintf("%s %q: %s", f.Field, f.Name, f.Message)
+	}
+	return &apiError{code: errValidation, err: errors.New(strings.Join(msgs, "; ")), fields: bad}
+}
+
+// decodeRunRequest parses the /run body according to its Content-Type:
+// JSON (the default), msgpack, multipart uploads, or a plain-text script.
+func decodeRunRequest(r *http.Request) (RunRequest, error) {
+	var req RunRequest
+	contentType := r.Header.Get("Content-Type")
+	mt, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mt == "multipart/form-data":
+		if err := decodeMultipartRequest(r, &req); err != nil {
+			return req, err
+		}
+	case isMsgpack(contentType):
+		if err := decodeMsgpackRequest(r.Body, &req, strictRequest(r)); err != nil {
+			return req, bodyError(err, newAPIError(errValidation, fmt.Errorf("invalid msgpack: %w", err)))
+		}
+	case mt == "text/plain":
+		if err := decodeTextRequest(r, &req); err != nil {
+			return req, err
+		}
+	case strictRequest(r):
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return req, bodyError(err, newAPIError(errValidation, fmt.Errorf("read body: %w", err)))
+		}
+		if err := unmarshalRunRequest(data, &req, true); err != nil {
+			return req, err
+		}
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, bodyError(err, newAPIError(errValidation, fmt.Errorf("invalid JSON")))
+		}
+	}
+	return req, nil
+}
+
+// strictRequest reports whether r's body must not have unknown fields:
+// -strict-json, unless the request's strictHeader says otherwise.
+func strictRequest(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.Header.Get(strictHeader)); err == nil {
+		return v
+	}
+	return live(&strictJSON)
+}
+
+// runRequestFields are the JSON keys of RunRequest.
+var runRequestFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(RunRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// unmarshalRunRequest decodes a JSON RunRequest. In strict mode an unknown
+// key is an error: all of them are listed at the top level, and the first
+// one inside a nested object (such as a steps entry) is reported. Keys must
+// match exactly, where encoding/json would ignore case.
+func unmarshalRunRequest(data []byte, req *RunRequest, strict bool) error {
+	if !strict {
+		return json.Unmarshal(data, req)
+	}
+	var top map[string]json.RawMessage
+	if json.Unmarshal(data, &top) == nil {
+		var unknown []string
+		for key := range top {
+			if !runRequestFields[key] {
+				unknown = append(unknown, key)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return newAPIError(errValidation, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", ")))
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return newAPIError(errValidation, fmt.Errorf("invalid JSON: %w", err))
+	}
+	return nil
+}
+
+// decodeTextRequest treats the whole body as the command, so a script can be
+// posted with curl --data-binary @script.sh. timeout_ms comes from the query.
+func decodeTextRequest(r *http.Request, req *RunRequest) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err, newAPIError(errValidation, fmt.Errorf("read body: %w", err)))
+	}
+	req.Cmd = string(body)
+
+	if v := r.URL.Query().Get("timeout_ms"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return newAPIError(errValidation, fmt.Errorf("invalid timeout_ms"))
+		}
+		req.TimeoutMs = n
+	}
+	return nil
+}
+
+// decodeMultipartRequest reads the leading "metadata" part (a JSON
+// RunRequest) and leaves the remaining file parts to be streamed into the
+// rootfs by prepareRootfs.
+func decodeMultipartRequest(r *http.Request, req *RunRequest) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return newAPIError(errValidation, err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		return bodyError(err, newAPIError(errValidation, fmt.Errorf("read metadata part: %w", err)))
+	}
+	if part.FormName() != "metadata" {
+		return newAPIError(errValidation, fmt.Errorf("first multipart part must be \"metadata\", got %q", part.FormName()))
+	}
+	if strictRequest(r) {
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return bodyError(err, newAPIError(errValidation, fmt.Errorf("read metadata part: %w", err)))
+		}
+		if err := unmarshalRunRequest(data, req, true); err != nil {
+			return err
+		}
+	} else if err := json.NewDecoder(part).Decode(req); err != nil {
+		return bodyError(err, newAPIError(errValidation, fmt.Errorf("invalid metadata JSON")))
+	}
+	req.uploads = mr
+	return nil
+}
+
+// runExecution runs req in a fresh VM. Anything that happens once the guest
+// is booting (timeouts, kills, guest failures) is reported in the
+// RunResponse; an error means the run could not be set up at all.
+func runExecution(parent context.Context, execID string, req RunRequest) (RunResponse, error) {
+	start := time.Now()
+	img, err := lookupImage(req.Image)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	req.imageEnv = img.Env
+	req.heartbeat = live(&guestHeartbeat)
+	img.extraBootArgs = req.ExtraBootArgs
+	if req.Deterministic {
+		img.extraBootArgs = strings.TrimSpace(img.extraBootArgs + " " + deterministicBootArgs)
+	}
+
+	runDir := filepath.Join(runBaseDir, execID)
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		return RunResponse{}, err
+	}
+	consolePath := filepath.Join(runDir, "console.log")
+	// Set when keep_alive_on_failure hands the VM (and runDir) to a reaper.
+	var kept *KeptVM
+	defer func() {
+		if kept != nil {
+			return
+		}
+		// Debug runs keep their console transcript around for inspection.
+		if req.Debug {
+			log.Printf("run %s: console transcript kept at %s", execID, consolePath)
+			return
+		}
+		_ = os.RemoveAll(runDir)
+	}()
+
+	// A read_only image is never written to, so any number of runs share it.
+	unlock := func() {}
+	if !img.ReadOnly {
+		if unlock, err = lockRootfs(img); err != nil {
+			return RunResponse{}, err
+		}
+	}
+	// A kept VM still has the rootfs open; the reaper releases it.
+	defer func() {
+		if kept == nil {
+			unlock()
+		}
+	}()
+
+	log.Printf("run %s: %q", execID, req.Cmd)
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	registerExecution(execID, req.Cmd, cancel)
+	defer unregisterExecution(execID)
+
+	releaseMem, err := admitMemory(ctx, live(&vmMemMiB))
+	if err != nil {
+		if ctx.Err() != nil {
+			return killedResponse(req, consolePath), nil
+		}
+		return RunResponse{}, err
+	}
+	// The memory goes back along with the rootfs, which for a kept VM is
+	// when the reaper runs.
+	unlockRootfs := unlock
+	unlock = func() {
+		unlockRootfs()
+		releaseMem()
+	}
+
+	mountDir := filepath.Join(runDir, "rootfs")
+	if err := os.Mkdir(mountDir, 0o755); err != nil {
+		return RunResponse{}, err
+	}
+	defer os.Remove(mountDir)
+
+	prepStart := time.Now()
+	_, prepSpan := startSpan(ctx, "image-prep")
+	var overlayDrive, scratchDrive string
+	if req.ReturnScratch {
+		scratchDrive = filepath.Join(runDir, "scratch.ext4")
+		req.scratchDevice = "/dev/vdb"
+		if img.ReadOnly {
+			req.scratchDevice = "/dev/vdc"
+		}
+		err = createScratchDrive(scratchDrive, req.ScratchMiB)
+	}
+	switch {
+	case err != nil:
+	case img.ReadOnly:
+		overlayDrive = filepath.Join(runDir, "overlay.ext4")
+		err = prepareOverlay(ctx, overlayDrive, runDir, req)
+	default:
+		err = prepareRootfs(ctx, mountDir, img, req)
+	}
+	prepSpan.finish(err)
+	if ctx.Err() != nil {
+		return killedResponse(req, consolePath), nil
+	}
+	if err != nil {
+		return RunResponse{}, err
+	}
+	timings := Timings{ImagePrepMs: time.Since(prepStart).Milliseconds()}
+
+	// live_files are written to the serial console, i.e. firecracker's
+	// stdin.
+	var stdinR, stdinW *os.File
+	if req.LiveFiles {
+		if stdinR, stdinW, err = os.Pipe(); err != nil {
+			return RunResponse{}, err
+		}
+		defer stdinW.Close()
+	}
+
+	vmStart := time.Now()
+	bootCtx, bootSpan := startSpan(ctx, "firecracker-boot")
+	fc, consoleFile, socketPath, err := startVM(bootCtx, runDir, consolePath, stdinR)
+	if stdinR != nil {
+		_ = stdinR.Close()
+	}
+	if err != nil {
+		bootSpan.finish(err)
+		if ctx.Err() != nil {
+			return killedResponse(req, consolePath), nil
+		}
+		return RunResponse{}, newAPIError(errBootFailed, err)
+	}
+	defer consoleFile.Close()
+
+	defer func() {
+		if kept != nil {
+			return
+		}
+		if fc.Process != nil {
+			_ = fc.Process.Kill()
+		}
+		_ = fc.Wait()
+	}()
+
+	// A DELETE on /executions/{id} cancels ctx; tear the VM down right away.
+	stopKill := context.AfterFunc(ctx, func() {
+		if fc.Process != nil {
+			_ = fc.Process.Kill()
+		}
+	})
+	defer stopKill()
+
+	var metricsPath string
+	if req.Debug {
+		metricsPath = enableVMMetrics(bootCtx, socketPath, runDir)
+	}
+
+	bootStart := time.Now()
+	timings.VMStartMs = bootStart.Sub(vmStart).Milliseconds()
+	err = bootGuest(bootCtx, socketPath, img, overlayDrive, scratchDrive)
+	bootSpan.finish(err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return killedResponse(req, consolePath), nil
+		}
+		return RunResponse{}, newAPIError(errBootFailed, err)
+	}
+
+	if stdinW != nil {
+		setLiveFeed(execID, &liveFeed{w: stdinW, consolePath: consolePath})
+	}
+
+	timeout := execTimeout(req.TimeoutMs) + backstop()
+	execCtx, execSpan := startSpan(ctx, "exec")
+	defer func() { execSpan.finish(nil) }()
+
+	// Boot grace: wait for init-start marker (does not consume timeout_ms).
+	// A guest that never gets there fails fast with AGENT_TIMEOUT (or the
+	// panic/halt that stopped it) instead of eating the exec budget.
+	_, initSpan := startSpan(execCtx, "waitForGuestInitStarted")
+	err = waitForGuestInitStarted(ctx, consolePath, live(&initTimeout))
+	initSpan.finish(err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return killedResponse(req, consolePath), nil
+		}
+		logGuestSilence(execID, consolePath)
+		return RunResponse{}, err
+	}
+	execStart := time.Now()
+	timings.BootMs = execStart.Sub(bootStart).Milliseconds()
+
+	// Now start the real execution timeout.
+	done := make(chan struct{})
+	var (
+		stdout   string
+		exitCode int
+		waitErr  error
+	)
+
+	go func() {
+		_, waitSpan := startSpan(execCtx, "waitForGuestCompletion")
+		stdout, exitCode, waitErr = waitForGuestCompletion(ctx, consolePath, timeout, req.heartbeat, func() bool {
+			return processExited(fc.Process)
+		})
+		waitSpan.finish(waitErr)
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// A cancelled ctx decides the response whichever case below wins the
+	// race with it, so a DELETE always reads as killed.
+	cancelled := func() (RunResponse, error) {
+		timer.Stop()
+		_ = fc.Wait()
+		// waitForGuestCompletion stops on ctx too, after a final read.
+		<-done
+		return cancelledResponse(ctx, req, consolePath, partialStdout(stdout)), nil
+	}
+
+	select {
+	case <-done:
+		timer.Stop()
+		if ctx.Err() != nil {
+			return cancelled()
+		}
+		timings.ExecMs = time.Since(execStart).Milliseconds()
+		var vmMetrics *VMMetrics
+		if metricsPath != "" {
+			vmMetrics = collectVMMetrics(ctx, socketPath, metricsPath)
+		}
+		if req.KeepAliveOnFailure && (waitErr != nil || exitCode != 0) {
+			kept = keepVM(execID, fc, runDir, socketPath, consolePath, unlock)
+		} else {
+			if fc.Process != nil {
+				_ = fc.Process.Kill()
+			}
+			_ = fc.Wait()
+		}
+
+		stderr := ""
+		if waitErr != nil {
+			logGuestSilence(execID, consolePath)
+			if errorBodyFor(waitErr).Code == errKernelPanic {
+				return RunResponse{}, waitErr
+			}
+			stderr = waitErr.Error()
+		}
+		resp := RunResponse{
+			Stdout:           stdout,
+			Stderr:           stderr,
+			ExitCode:         exitCode,
+			KeptVM:           kept,
+			OutputIncomplete: waitErr != nil,
+			StreamsCombined:  req.Tty,
+			ExitReason:       exitReason(waitErr),
+		}
+		terminated(&resp)
+		_, resp.Stdout = extractFlagMarker(resp.Stdout, clockSyncedMarker)
+		_, resp.Stdout = extractFlagMarker(resp.Stdout, liveFilesMarker)
+		resp.Stdout = stripHeartbeats(resp.Stdout)
+		if req.Timings {
+			timings.CommandMs, resp.Stdout = extractCommandTiming(resp.Stdout)
+			resp.Timings = &timings
+		}
+		if req.CaptureRusage {
+			resp.Rusage, resp.Stdout = extractRusage(resp.Stdout)
+		}
+		if oom, rest := extractOOM(resp.Stdout); oom {
+			resp.ResourceExhausted, resp.Stdout = "memory", rest
+		}
+		if full, rest := extractFlagMarker(resp.Stdout, workFullMarker); full {
+			resp.Stdout = rest
+			if resp.ResourceExhausted == "" {
+				resp.ResourceExhausted = "disk"
+			}
+		}
+		if req.Dmesg {
+			resp.Dmesg, resp.Stdout = extractDmesg(resp.Stdout)
+		}
+		if req.Setup != "" {
+			splitSetup(&resp)
+		}
+		if len(req.Steps) > 0 {
+			resp.StepResults = parseStepResults(resp.Stdout)
+		}
+		if req.Debug {
+			resp.Console = consoleTail(consolePath)
+			resp.VMMetrics = vmMetrics
+		}
+		if len(req.OutputGlobs) > 0 || req.CaptureCore {
+			image, root := img.RootfsPath, ""
+			if overlayDrive != "" {
+				image, root = overlayDrive, "/upper"
+			}
+			if err := readBack(mountDir, image, root, req, &resp); err != nil {
+				return RunResponse{}, err
+			}
+		}
+		if scratchDrive != "" {
+			if resp.Scratch, err = tarScratch(mountDir, scratchDrive); err != nil {
+				return RunResponse{}, err
+			}
+		}
+		timings.TotalMs = time.Since(start).Milliseconds()
+		return resp, nil
+
+	case <-timer.C:
+		if ctx.Err() != nil {
+			return cancelled()
+		}
+		if req.KeepAliveOnFailure {
+			kept = keepVM(execID, fc, runDir, socketPath, consolePath, unlock)
+		} else {
+			if fc.Process != nil {
+				_ = fc.Process.Kill()
+			}
+			_ = fc.Wait()
+		}
+		logGuestSilence(execID, consolePath)
+
+		// Whatever reached the console before the kill; the command may
+		// have had more to say.
+		b, _ := os.ReadFile(consolePath)
+		resp := RunResponse{
+			Stdout:           partialStdout(strings.ReplaceAll(string(b), "\r\n", "\n")),
+			Stderr:           timeoutMessage,
+			ExitCode:         live(&timeoutExitCode),
+			KeptVM:           kept,
+			OutputIncomplete: true,
+			StreamsCombined:  req.Tty,
+			ExitReason:       exitReasonTimeout,
+		}
+		if req.Timings {
+			timings.ExecMs = time.Since(execStart).Milliseconds()
+			timings.TotalMs = time.Since(start).Milliseconds()
+			resp.Timings = &timings
+		}
+		if req.Debug {
+			resp.Console = consoleTail(consolePath)
+		}
+		return resp, nil
+
+	case <-ctx.Done():
+		return cancelled()
+	}
+}
+
+// partialStdout strips the host's markers from the console text of a run
+// that was stopped before it reported.
+func partialStdout(text string) string {
+	_, text = extractFlagMarker(text, terminateMarker)
+	_, text = extractFlagMarker(text, clockSyncedMarker)
+	_, text = extractFlagMarker(text, liveFilesMarker)
+	return stripHeartbeats(text)
+}
+
+// watchdogSlack is how long the guest has to report after its watchdog's
+// SIGKILL before the host kills it too.
+const watchdogSlack = time.Second
+
+// backstop is how much longer than timeout_ms the host waits before it
+// kills a run itself. With -term-grace the guest's watchdog enforces the
+// timeout and reports, so the host must not race it.
+func backstop() time.Duration {
+	grace := live(&termGrace)
+	if grace <= 0 {
+		return 0
+	}
+	return grace + watchdogSlack
+}
+
+// terminated turns a run the guest watchdog stopped (with SIGTERM, or
+// SIGKILL after termGrace) into a timeout, keeping whatever it printed.
+func terminated(resp *RunResponse) {
+	term, rest := extractFlagMarker(resp.Stdout, terminateMarker)
+	if !term {
+		return
+	}
+	resp.Stdout = rest
+	resp.ExitCode = live(&timeoutExitCode)
+	resp.ExitReason = exitReasonTimeout
+	if resp.Stderr != "" && !strings.HasSuffix(resp.Stderr, "\n") {
+		resp.Stderr += "\n"
+	}
+	resp.Stderr += timeoutMessage
+}
+
+// logGuestSilence records why a guest never reported back. Whatever the guest
+// managed to print (init errors, a panic, a failed mount) is only on the serial
+// console, so surface its tail in the host log instead of a bare timeout.
+func logGuestSilence(execID, consolePath string) {
+	tail := tailLines(consoleTail(consolePath), 20)
+	if tail == "" {
+		tail = "(console empty)"
+	}
+	log.Printf("run %s: guest did not report completion; console tail:\n%s", execID, tail)
+}
+
+// keepVM leaves a failed run's VM running for post-mortem debugging and
+// schedules it (and its run dir) to be reaped after keepAliveTTL.
+func keepVM(execID string, fc *exec.Cmd, runDir, socketPath, consolePath string, release func()) *KeptVM {
+	ttl := live(&keepAliveTTL)
+	kept := &KeptVM{
+		PID:         fc.Process.Pid,
+		SocketPath:  socketPath,
+		ConsolePath: consolePath,
+		LogPath:     fcLogPath(runDir),
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	log.Printf("run %s: keeping VM (pid %d, socket %s) until %s", execID, kept.PID, socketPath, kept.ExpiresAt.Format(time.RFC3339))
+	time.AfterFunc(ttl, func() {
+		_ = fc.Process.Kill()
+		_ = fc.Wait()
+		_ = os.RemoveAll(runDir)
+		if release != nil {
+			release()
+		}
+		log.Printf("run %s: reaped kept VM", execID)
+	})
+	return kept
+}
+
+// cancelledResponse answers for a run whose ctx was done while the command
+// ran. A DELETE gets killedResponse; a run cut short by overall_timeout_ms
+// keeps the stdout and step results it got to, for executeRun to report.
+func cancelledResponse(ctx context.Context, req RunRequest, consolePath, stdout string) RunResponse {
+	resp := killedResponse(req, consolePath)
+	if errors.Is(context.Cause(ctx), errOverallTimeout) {
+		resp.Stdout = stdout
+		if len(req.Steps) > 0 {
+			resp.StepResults = parseStepResults(stdout)
+		}
+	}
+	return resp
+}
+
+func killedResponse(req RunRequest, consolePath string) RunResponse {
+	resp := RunResponse{
+		Stdout:     "",
+		Stderr:     "execution killed",
+		ExitCode:   137,
+		ExitReason: exitReasonKilled,
+	}
+	if req.Debug {
+		resp.Console = consoleTail(consolePath)
+	}
+	return resp
+}
+
+// writeRunResponse encodes resp. By default every completed run is a 200 and
+// callers inspect exit_code; with fail_on_nonzero a nonzero exit maps to an
+// HTTP error status (body unchanged) for clients that key off status alone.
+func writeRunResponse(w http.ResponseWriter, r *http.Request, req RunRequest, resp RunResponse) {
+	status := http.StatusOK
+	if req.FailOnNonzero && resp.ExitCode != 0 {
+		status = http.StatusUnprocessableEntity
+		if resp.ExitCode == live(&timeoutExitCode) {
+			status = http.StatusGatewayTimeout
+		}
+	}
+
+	if acceptsTar(r) {
+		w.Header().Set("Content-Type", tarContentType)
+		w.WriteHeader(status)
+		if err := writeTarResponse(w, resp); err != nil {
+			log.Printf("write tar response: %v", err)
+		}
+		return
+	}
+
+	if acceptsMsgpack(r) {
+		data, err := marshalMsgpack(resp)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", msgpackContentType)
+		w.WriteHeader(status)
+		_, _ = w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+/* ---------------- Execution registry ---------------- */
+
+type execution struct {
+	id        string
+	cmd       string
+	startedAt time.Time
+	cancel    context.CancelFunc
+	// feed is set for live_files runs once their VM is up.
+	feed *liveFeed
+}
+
+type executionInfo struct {
+	ExecID    string    `json:"exec_id"`
+	Cmd       string    `json:"cmd"`
+	StartedAt time.Time `json:"started_at"`
+	ElapsedMs int64     `json:"elapsed_ms"`
+}
+
+var (
+	executionsMu sync.Mutex
+	executions   = map[string]*execution{}
+
+	// redactCommands hides commands from /executions, which may otherwise
+	// expose secrets passed on the command line.
+	redactCommands bool
+)
+
+func registerExecution(id, cmd string, cancel context.CancelFunc) {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+	executions[id] = &execution{id: id, cmd: cmd, startedAt: time.Now(), cancel: cancel}
+}
+
+func unregisterExecution(id string) {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+	delete(executions, id)
+}
+
+func listExecutions() []executionInfo {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+
+	now := time.Now()
+	out := make([]executionInfo, 0, len(executions))
+	for _, e := range executions {
+		cmd := e.cmd
+		if live(&redactCommands) {
+			cmd = "[redacted]"
+		}
+		out = append(out, executionInfo{
+			ExecID:    e.id,
+			Cmd:       cmd,
+			StartedAt: e.startedAt,
+			ElapsedMs: now.Sub(e.startedAt).Milliseconds(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// killExecution cancels a run; runHandler then kills firecracker and cleans
+// up its run dir and mounts on the way out.
+func killExecution(id string) bool {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+	e, ok := executions[id]
+	if !ok {
+		return false
+	}
+	e.cancel()
+	return true
+}
+
+func executionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("GET only")))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(listExecutions())
+}
+
+func executionHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/executions/")
+	if id, ok := strings.CutSuffix(id, "/files"); ok && !strings.Contains(id, "/") {
+		liveFilesHandler(w, r, id)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("DELETE only")))
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, newAPIError(errValidation, fmt.Errorf("invalid execution id")))
+		return
+	}
+	if !killExecution(id) {
+		writeError(w, newAPIError(errNotFound, fmt.Errorf("execution not found")))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ---------------- Live files ---------------- */
+
+const (
+	// Cap on one POST /executions/{id}/files body. The console moves
+	// data slowly; this is for feeding inputs, not bulk transfer.
+	maxLiveFilesBytes = 1 << 20
+	// How long a write to a guest that stopped reading may block.
+	liveFilesWriteTimeout = 30 * time.Second
+)
+
+// liveFeed sends files to a live_files run over its serial console. Each
+// file is a frame the wrapper's receiver understands:
+//
+//	sandboxd-file <base64 name> <octal mode> <N>
+//	<N lines of base64 content>
+//
+// The receiver writes it next to its destination and renames it into
+// place, so a command watching /work only ever sees complete files.
+type liveFeed struct {
+	mu          sync.Mutex
+	w           *os.File
+	consolePath string
+	ready       bool
+}
+
+func setLiveFeed(id string, feed *liveFeed) {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+	if e, ok := executions[id]; ok {
+		e.feed = feed
+	}
+}
+
+func lookupLiveFeed(id string) (*liveFeed, error) {
+	executionsMu.Lock()
+	defer executionsMu.Unlock()
+	e, ok := executions[id]
+	if !ok {
+		return nil, newAPIError(errNotFound, fmt.Errorf("execution not found"))
+	}
+	if e.feed == nil {
+		return nil, newAPIError(errValidation, fmt.Errorf("execution %s does not accept live_files (or has not booted yet)", id))
+	}
+	return e.feed, nil
+}
+
+// send waits for the receiver to come up, then writes the files' frames.
+func (f *liveFeed) send(ctx context.Context, files map[string]FileSpec) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for deadline := time.Now().Add(live(&initTimeout)); !f.ready; time.Sleep(20 * time.Millisecond) {
+		b, _ := os.ReadFile(f.consolePath)
+		if strings.Contains(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n"+liveFilesMarker+"\n") {
+			f.ready = true
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return newAPIError(errAgentTimeout, fmt.Errorf("the guest is not receiving files (the image needs stty, head and base64)"))
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		mode, _ := files[name].fileMode()
+		if mode == 0 {
+			// As writeWorkFile does.
+			mode = 0o644
+			if strings.HasPrefix(files[name].Content, "#!") {
+				mode = 0o755
+			}
+		}
+		content := base64.StdEncoding.EncodeToString([]byte(files[name].Content))
+		lines := (len(content) + 75) / 76
+		fmt.Fprintf(&buf, "sandboxd-file %s %o %d\n", base64.StdEncoding.EncodeToString([]byte(name)), mode.Perm(), lines)
+		for len(content) > 0 {
+			n := min(76, len(content))
+			buf.WriteString(content[:n] + "\n")
+			content = content[n:]
+		}
+	}
+	_ = f.w.SetWriteDeadline(time.Now().Add(liveFilesWriteTimeout))
+	if _, err := f.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("send files to the guest: %w", err)
+	}
+	return nil
+}
+
+// liveFilesHandler serves POST /executions/{id}/files: {"files": {...}}, as
+// in /run. It returns once the files are on their way; they show up in
+// /work a moment later.
+func liveFilesHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("POST only")))
+		return
+	}
+	if err := contentTooLarge(r, maxLiveFilesBytes); err != nil {
+		writeError(w, err)
+		return
+	}
+	var body struct {
+		Files map[string]FileSpec `json:"files"`
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLiveFilesBytes))
+	if err != nil {
+		writeError(w, bodyError(err, newAPIError(errValidation, err)))
+		return
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		writeError(w, newAPIError(errValidation, fmt.Errorf("invalid JSON: %w", err)))
+		return
+	}
+	if len(body.Files) == 0 {
+		writeError(w, newAPIError(errValidation, fmt.Errorf("files is required")))
+		return
+	}
+	if err := validateFileNames(RunRequest{Files: body.Files}); err != nil {
+		writeError(w, err)
+		return
+	}
+	feed, err := lookupLiveFeed(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := feed.send(r.Context(), body.Files); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ---------------- Memory admission ---------------- */
+
+// Guest memory committed to running VMs. memReleased is closed (and
+// replaced) whenever some is given back, waking every waiting run to try
+// again; there is no queue order.
+var (
+	memMu        sync.Mutex
+	memCommitted int
+	memWaiting   int
+	memReleased  = make(chan struct{})
+)
+
+// admitMemory commits mib of the memory budget to a run, waiting up to
+// admissionTimeout for room. The returned release gives it back and may be
+// called more than once.
+func admitMemory(ctx context.Context, mib int) (release func(), err error) {
+	memMu.Lock()
+	budget, wait := live(&memBudgetMiB), live(&admissionTimeout)
+	if budget <= 0 {
+		memMu.Unlock()
+		return func() {}, nil
+	}
+	if mib > budget {
+		memMu.Unlock()
+		return nil, newAPIError(errResourceExhausted, fmt.Errorf("a %d MiB VM does not fit the %d MiB memory budget", mib, budget))
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for memCommitted+mib > budget {
+		if wait <= 0 {
+			memMu.Unlock()
+			return nil, newAPIError(errResourceExhausted, fmt.Errorf("memory budget full: %d of %d MiB committed", memCommitted, budget))
+		}
+		released := memReleased
+		memWaiting++
+		memMu.Unlock()
+		select {
+		case <-released:
+		case <-deadline.C:
+			wait = 0
+		case <-ctx.Done():
+			memMu.Lock()
+			memWaiting--
+			memMu.Unlock()
+			return nil, ctx.Err()
+		}
+		memMu.Lock()
+		memWaiting--
+	}
+	memCommitted += mib
+	memMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			memMu.Lock()
+			memCommitted -= mib
+			close(memReleased)
+			memReleased = make(chan struct{})
+			memMu.Unlock()
+		})
+	}, nil
+}
+
+// metricsHandler serves the admission gauges in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("GET only")))
+		return
+	}
+	memMu.Lock()
+	committed, waiting, budget := memCommitted, memWaiting, live(&memBudgetMiB)
+	memMu.Unlock()
+	breakerOpenValue := 0
+	if state := breakerStatus(); state != "" && state != breakerClosed {
+		breakerOpenValue = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, help string
+		value      int
+	}{
+		{"sandboxd_memory_committed_mib", "Guest memory committed to running VMs.", committed},
+		{"sandboxd_memory_budget_mib", "The -mem-budget-mib setting (0 is no limit).", budget},
+		{"sandboxd_memory_waiting_runs", "Runs waiting for room in the memory budget.", waiting},
+		{"sandboxd_breaker_open", "1 while the circuit breaker is open or half-open (probing).", breakerOpenValue},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+}
+
+/* ---------------- Run budget ---------------- */
+
+// shutdownGrace bounds how long the server waits for open connections once
+// the last of maxRuns is done and its results are fetched; the runs
+// themselves are over by then.
+const shutdownGrace = 30 * time.Second
+
+var (
+	runsMu       sync.Mutex
+	runsAdmitted int
+	runsInFlight int
+	// runsDone is closed when the last of maxRuns has finished.
+	runsDone = make(chan struct{})
+)
+
+// admitRun counts a run against maxRuns, or refuses it once they are all
+// taken. Every admitted run must call finishRun when it is done.
+func admitRun() error {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	if maxRuns > 0 && runsAdmitted >= maxRuns {
+		return errRunsTaken()
+	}
+	runsAdmitted++
+	runsInFlight++
+	return nil
+}
+
+func errRunsTaken() error {
+	return newAPIError(errShuttingDown, fmt.Errorf("the server has taken its %d runs (-max-runs) and is shutting down", maxRuns))
+}
+
+// awaitResults returns once the /run/async results held in memory have
+// all been fetched or have expired (after resultTTL), so the server does
+// not take the last runs' results with it. A shared store keeps them.
+func awaitResults() {
+	s, ok := resultStore.(*memoryResultStore)
+	if !ok {
+		return
+	}
+	for s.pending() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func finishRun() {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	runsInFlight--
+	// Nothing is admitted after the last run, so this is true only once.
+	if maxRuns > 0 && runsAdmitted >= maxRuns && runsInFlight == 0 {
+		close(runsDone)
+	}
+}
+
+type healthStatus struct {
+	Status   string `json:"status"` // "ok", "draining" or "degraded"
+	InFlight int    `json:"in_flight"`
+	// Breaker is the circuit breaker's state, if it is on.
+	Breaker string `json:"breaker,omitempty"`
+	// Set only with -max-runs.
+	MaxRuns       int  `json:"max_runs,omitempty"`
+	RunsRemaining *int `json:"runs_remaining,omitempty"`
+}
+
+func runsLeft() healthStatus {
+	runsMu.Lock()
+	defer runsMu.Unlock()
+	h := healthStatus{Status: "ok", InFlight: runsInFlight}
+	if maxRuns > 0 {
+		remaining := max(maxRuns-runsAdmitted, 0)
+		h.MaxRuns, h.RunsRemaining = maxRuns, &remaining
+		if remaining == 0 {
+			h.Status = "draining"
+		}
+	}
+	return h
+}
+
+// healthzHandler answers 200 while the server takes runs and 503 once it
+// is draining or its breaker is open, so that load balancers stop sending
+// it work.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("GET only")))
+		return
+	}
+	h := runsLeft()
+	if h.Breaker = breakerStatus(); h.Breaker == breakerOpen && h.Status == "ok" {
+		h.Status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if h.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(h)
+}
+
+/* ---------------- Circuit breaker ---------------- */
+
+// The breaker sheds load while the host itself is in trouble (loop devices
+// or disk space run out, firecracker will not start). Once too many of the
+// last breakerWindow runs failed that way, runs get HOST_DEGRADED for
+// breakerCooldown. After that a single run is let through as a probe at a
+// time; the first to get an answer either closes the breaker or opens it
+// for another cooldown.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var (
+	breakerMu       sync.Mutex
+	breakerState    = breakerClosed
+	breakerOutcomes []bool // of the last runs, true for a host failure
+	breakerOpenedAt time.Time
+	breakerProbing  bool
+)
+
+// hostFailure reports whether err is about the host rather than the run: a
+// rootfs or drive that could not be set up, a VM that did not start or a
+// guest that never came up.
+func hostFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch errorBodyFor(err).Code {
+	case errImageUnavailable, errBootFailed, errAgentTimeout:
+		return true
+	}
+	return false
+}
+
+// admitBreaker lets a run through unless the breaker is open. A run that
+// is let through must pass its outcome to done.
+func admitBreaker() (done func(runErr error), err error) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	if live(&breakerFailurePct) <= 0 {
+		return func(error) {}, nil
+	}
+	probe := false
+	if breakerState != breakerClosed {
+		if wait := live(&breakerCooldown) - time.Since(breakerOpenedAt); wait > 0 || breakerProbing {
+			return nil, newAPIError(errHostDegraded, fmt.Errorf("the host is degraded and not taking runs (circuit breaker open; retry in %s)", max(wait, 0).Round(time.Second)))
+		}
+		breakerState, breakerProbing, probe = breakerHalfOpen, true, true
+	}
+	var once sync.Once
+	return func(runErr error) { once.Do(func() { recordBreaker(probe, runErr) }) }, nil
+}
+
+func recordBreaker(probe bool, runErr error) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	pct, window, cooldown := live(&breakerFailurePct), live(&breakerWindow), live(&breakerCooldown)
+	failed := hostFailure(runErr)
+	if runErr != nil && !failed {
+		// Refused, invalid or killed: that says nothing about the host.
+		if probe {
+			breakerProbing = false
+		}
+		return
+	}
+	if probe {
+		breakerProbing = false
+		if failed {
+			breakerState, breakerOpenedAt = breakerOpen, time.Now()
+			log.Printf("circuit breaker: probe run failed (%v); open for another %s", runErr, cooldown)
+		} else {
+			breakerState, breakerOutcomes = breakerClosed, nil
+			log.Printf("circuit breaker: probe run succeeded; closed")
+		}
+		return
+	}
+	if breakerState != breakerClosed {
+		// Admitted before the breaker opened.
+		return
+	}
+
+	breakerOutcomes = append(breakerOutcomes, failed)
+	if n := len(breakerOutcomes) - window; n > 0 {
+		breakerOutcomes = breakerOutcomes[n:]
+	}
+	if len(breakerOutcomes) < window {
+		return
+	}
+	failures := 0
+	for _, f := range breakerOutcomes {
+		if f {
+			failures++
+		}
+	}
+	if failures*100 >= pct*window {
+		breakerState, breakerOpenedAt, breakerOutcomes = breakerOpen, time.Now(), nil
+		log.Printf("circuit breaker: %d of the last %d runs failed on the host (last: %v); open for %s", failures, window, runErr, cooldown)
+	}
+}
+
+// breakerStatus is the breaker's state for /healthz and /metrics, "" if it
+// is off. An open breaker whose cooldown is up shows as half_open.
+func breakerStatus() string {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	switch {
+	case live(&breakerFailurePct) <= 0:
+		return ""
+	case breakerState == breakerOpen && time.Since(breakerOpenedAt) >= live(&breakerCooldown):
+		return breakerHalfOpen
+	}
+	return breakerState
+}
+
+/* ---------------- Pre-warming ---------------- */
+
+// prewarmCmd is what the throwaway VMs run to check the path end to end.
+const prewarmCmd = "echo sandboxd-prewarm-ok"
+
+type prewarmResult struct {
+	Image       string `json:"image"`
+	KernelBytes int64  `json:"kernel_bytes"`
+	RootfsBytes int64  `json:"rootfs_bytes"`
+	RunMs       int64  `json:"run_ms"`
+	OK          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+}
+
+// readThrough reads a file once so that it is in the page cache for the
+// next boot.
+func readThrough(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, f)
+}
+
+// prewarmImage primes the page cache with the image's kernel and rootfs and
+// then boots a throwaway VM to verify that runs work.
+func prewarmImage(ctx context.Context, name string) prewarmResult {
+	res := prewarmResult{Image: name}
+	fail := func(err error) prewarmResult {
+		res.Error = err.Error()
+		return res
+	}
+
+	img, err := lookupImage(name)
+	if err != nil {
+		return fail(err)
+	}
+	if res.KernelBytes, err = readThrough(img.KernelPath); err != nil {
+		return fail(err)
+	}
+	if res.RootfsBytes, err = readThrough(img.RootfsPath); err != nil {
+		return fail(err)
+	}
+
+	execID, err := newExecID()
+	if err != nil {
+		return fail(err)
+	}
+	breakerDone, err := admitBreaker()
+	if err != nil {
+		return fail(err)
+	}
+	start := time.Now()
+	resp, err := executor.Execute(ctx, RunRequest{Cmd: prewarmCmd, Image: name, execID: execID})
+	breakerDone(err)
+	res.RunMs = time.Since(start).Milliseconds()
+	switch {
+	case err != nil:
+		return fail(err)
+	case resp.ExitCode != 0:
+		return fail(fmt.Errorf("exit code %d: %s", resp.ExitCode, resp.Stderr))
+	case !strings.Contains(resp.Stdout, "sandboxd-prewarm-ok"):
+		return fail(fmt.Errorf("command output missing from console"))
+	}
+	res.OK = true
+	return res
+}
+
+// prewarmImages warms the named images one after another, or every
+// registered image if names is empty.
+func prewarmImages(ctx context.Context, names []string) []prewarmResult {
+	if len(names) == 0 {
+		imagesMu.RLock()
+		for name := range imageProfiles {
+			names = append(names, name)
+		}
+		imagesMu.RUnlock()
+		sort.Strings(names)
+	}
+	results := make([]prewarmResult, 0, len(names))
+	for _, name := range names {
+		results = append(results, prewarmImage(ctx, name))
+	}
+	return results
+}
+
+// prewarmHandler serves POST /prewarm[?image=NAME...]. It answers 503 if any
+// image failed so deploy checks can gate on the status alone.
+func prewarmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("POST only")))
+		return
+	}
+
+	results := prewarmImages(r.Context(), r.URL.Query()["image"])
+	status := http.StatusOK
+	for _, res := range results {
+		if !res.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+/* ---------------- Completion callbacks ---------------- */
+
+type callbackPayload struct {
+	ExecID string       `json:"exec_id"`
+	Result *RunResponse `json:"result,omitempty"`
+	Error  *errorBody   `json:"error,omitempty"`
+}
+
+var (
+	// callbackSecret, if set, signs callback bodies with HMAC-SHA256 in the
+	// X-Sandboxd-Signature header ("sha256=<hex>").
+	callbackSecret   string
+	callbackAttempts = 5
+	callbackBackoff  = time.Second
+
+	callbackClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+func signCallback(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(callbackSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback POSTs the outcome of an asynchronous run, retrying with
+// doubling backoff on network errors, 429 and 5xx. Other 4xx answers are
+// treated as final.
+func deliverCallback(execID, callbackURL string, resp RunResponse, runErr error) {
+	payload := callbackPayload{ExecID: execID}
+	if runErr != nil {
+		body := errorBodyFor(runErr)
+		payload.Error = &body
+	} else {
+		resp.ExecID = execID
+		payload.Result = &resp
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("run %s: encode callback: %v", execID, err)
+		return
+	}
+
+	backoff := callbackBackoff
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		err := postCallback(execID, callbackURL, body)
+		if err == nil {
+			return
+		}
+		var final finalCallbackError
+		if errors.As(err, &final) || attempt == callbackAttempts {
+			log.Printf("run %s: callback delivery failed after %d attempt(s): %v", execID, attempt, err)
+			return
+		}
+		log.Printf("run %s: callback attempt %d failed: %v; retrying in %s", execID, attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// finalCallbackError marks delivery failures that retrying won't fix.
+type finalCallbackError struct{ err error }
+
+func (e finalCallbackError) Error() string { return e.err.Error() }
+
+func postCallback(execID, callbackURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return finalCallbackError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sandboxd-Exec-Id", execID)
+	if callbackSecret != "" {
+		req.Header.Set("X-Sandboxd-Signature", signCallback(body))
+	}
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	default:
+		return finalCallbackError{fmt.Errorf("callback rejected with status %d", resp.StatusCode)}
+	}
+}
+
+/* ---------------- Async results ---------------- */
+
+// ResultStore keeps /run/async results between the run and the poll that
+// fetches them. Entries are opaque to it and expire after their ttl. The
+// in-memory store is the default; a shared Redis lets several instances
+// behind a load balancer answer each other's polls, and survives restarts.
+type ResultStore interface {
+	Put(id string, value []byte, ttl time.Duration) error
+	// Get reports ok false for a missing or expired entry.
+	Get(id string) (value []byte, ok bool, err error)
+	Delete(id string) error
+}
+
+var resultStore ResultStore = newMemoryResultStore()
+
+// openResultStore resolves the -result-store flag: "memory" or
+// redis://[:password@]host[:port][/db].
+func openResultStore(spec string) (ResultStore, error) {
+	if spec == "memory" {
+		return newMemoryResultStore(), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("result store %q: want memory or redis://[:password@]host[:port][/db]", spec)
+	}
+	s := &redisResultStore{addr: u.Host}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil || s.db < 0 {
+			return nil, fmt.Errorf("result store %q: invalid database %q", spec, db)
+		}
+	}
+	return s, nil
+}
+
+type memoryResultStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryResult
+}
+
+type memoryResult struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryResultStore() *memoryResultStore {
+	return &memoryResultStore{entries: make(map[string]*memoryResult)}
+}
+
+func (s *memoryResultStore) Put(id string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &memoryResult{value: value, expires: time.Now().Add(ttl)}
+	s.entries[id] = e
+	time.AfterFunc(ttl, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.entries[id] == e {
+			delete(s.entries, id)
+		}
+	})
+	return nil
+}
+
+func (s *memoryResultStore) Get(id string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false, nil
+	}
+	return e.value, true, nil
+}
+
+func (s *memoryResultStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// pending counts the entries not yet fetched, expired or not.
+func (s *memoryResultStore) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// redisResultStore speaks just enough RESP for SET, GET and DEL over one
+// connection, redialed when it breaks.
+type redisResultStore struct {
+	addr, password string
+	db             int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+const (
+	redisKeyPrefix = "sandboxd:result:"
+	redisTimeout   = 5 * time.Second
+)
+
+// redisError is an error reply; the connection is still usable after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (s *redisResultStore) Put(id string, value []byte, ttl time.Duration) error {
+	_, err := s.do("SET", redisKeyPrefix+id, string(value), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+func (s *redisResultStore) Get(id string) ([]byte, bool, error) {
+	reply, err := s.do("GET", redisKeyPrefix+id)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	return reply, true, nil
+}
+
+func (s *redisResultStore) Delete(id string) error {
+	_, err := s.do("DEL", redisKeyPrefix+id)
+	return err
+}
+
+// do sends one command and returns a bulk reply (nil for a nil reply) or
+// nothing for the other kinds. A connection that fails is dropped and the
+// command tried once more on a fresh one; SET, GET and DEL can be repeated.
+func (s *redisResultStore) do(args ...string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.dial(); err != nil {
+				continue
+			}
+		}
+		var reply []byte
+		if reply, err = s.roundTrip(args); err == nil {
+			return reply, nil
+		}
+		var re redisError
+		if errors.As(err, &re) {
+			return nil, err
+		}
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return nil, err
+}
+
+func (s *redisResultStore) dial() error {
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	s.conn, s.rd = conn, bufio.NewReader(conn)
+	setup := [][]string{}
+	if s.password != "" {
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	for _, args := range setup {
+		if _, err := s.roundTrip(args); err != nil {
+			_ = conn.Close()
+			s.conn = nil
+			return fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+	return nil
+}
+
+func (s *redisResultStore) roundTrip(args []string) ([]byte, error) {
+	_ = s.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil, nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(s.rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// storedResult is what goes into the ResultStore for a run.
+type storedResult struct {
+	Done  bool         `json:"done"`
+	Resp  *RunResponse `json:"resp,omitempty"`
+	Error *errorBody   `json:"error,omitempty"`
+}
+
+func putResult(execID string, res storedResult, ttl time.Duration) {
+	b, err := json.Marshal(res)
+	if err == nil {
+		err = resultStore.Put(execID, b, ttl)
+	}
+	if err != nil {
+		log.Printf("run %s: store result: %v", execID, err)
+	}
+}
+
+// startResult registers a /run/async run so polls see it as running. The
+// entry outlives the longest possible run, in case this server dies with it.
+func startResult(execID string) {
+	putResult(execID, storedResult{}, time.Duration(live(&maxTimeoutMs))*time.Millisecond+live(&resultTTL))
+}
+
+// finishResult stores the outcome until it is fetched or resultTTL passes.
+func finishResult(execID string, resp RunResponse, err error) {
+	res := storedResult{Done: true}
+	if err != nil {
+		body := errorBodyFor(err)
+		res.Error = &body
+	} else {
+		resp.ExecID = execID
+		res.Resp = &resp
+	}
+	putResult(execID, res, live(&resultTTL))
+}
+
+// takeResult returns the state of a run; a finished one is handed out
+// only once (per instance, if several race for it in a shared store).
+func takeResult(execID string) (storedResult, bool, error) {
+	b, ok, err := resultStore.Get(execID)
+	if err != nil || !ok {
+		return storedResult{}, false, err
+	}
+	var res storedResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return storedResult{}, false, fmt.Errorf("stored result for %s: %w", execID, err)
+	}
+	if res.Done {
+		if err := resultStore.Delete(execID); err != nil {
+			return storedResult{}, false, err
+		}
+	}
+	return res, true, nil
+}
+
+type resultPayload struct {
+	ExecID string       `json:"exec_id"`
+	Status string       `json:"status"` // "running", "done" or "failed"
+	Result *RunResponse `json:"result,omitempty"`
+	Error  *errorBody   `json:"error,omitempty"`
+}
+
+// resultHandler serves GET /run/result/{exec_id}: 202 while the run is
+// going, then 200 with the result (or the error that stopped it) once.
+func resultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("GET only")))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/run/result/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, newAPIError(errValidation, fmt.Errorf("invalid execution id")))
+		return
+	}
+	res, ok, err := takeResult(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, newAPIError(errNotFound, fmt.Errorf("no result for %s (unknown, already fetched or expired)", id)))
+		return
+	}
+
+	payload := resultPayload{ExecID: id, Status: "running"}
+	status := http.StatusAccepted
+	switch {
+	case !res.Done:
+	case res.Error != nil:
+		payload.Status, payload.Error, status = "failed", res.Error, http.StatusOK
+	default:
+		payload.Status, payload.Result, status = "done", res.Resp, http.StatusOK
+	}
+	w.Header().Set(schemaVersionHeader, strconv.Itoa(responseSchemaVersion))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+/* ---------------- Idempotency keys ---------------- */
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotentRun is the run that first used a key. Later requests with the
+// key wait for it instead of running again.
+type idempotentRun struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	execID      string
+	async       bool
+	done        chan struct{}
+	finishedAt  time.Time
+
+	// Set before done is closed.
+	resp RunResponse
+	err  error
+}
+
+var (
+	idempotencyMu   sync.Mutex
+	idempotencyKeys = make(map[string]*idempotentRun)
+)
+
+// claimIdempotencyKey returns the run registered for key, or registers a
+// new one for execID, in which case leader is true and the caller must
+// finish it. Reusing a key for a different request is a validation error.
+func claimIdempotencyKey(key, path string, req RunRequest, execID string, async bool) (run *idempotentRun, leader bool, err error) {
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, false, newAPIError(errValidation, fmt.Errorf("%s must be at most %d bytes", idempotencyKeyHeader, maxIdempotencyKeyLength))
+	}
+	if req.uploads != nil {
+		// The parts are streamed, so there is nothing to compare a retry to.
+		return nil, false, newAPIError(errValidation, fmt.Errorf("%s cannot be combined with multipart uploads", idempotencyKeyHeader))
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, false, err
+	}
+	fingerprint := sha256.Sum256(append([]byte(path+"\n"), body...))
+
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	if run, ok := idempotencyKeys[key]; ok {
+		if run.fingerprint != fingerprint {
+			return nil, false, newAPIError(errValidation, fmt.Errorf("%s %q was already used for a different request", idempotencyKeyHeader, key))
+		}
+		return run, false, nil
+	}
+
+	if len(idempotencyKeys) >= live(&maxIdempotencyKeys) {
+		// Forget the oldest finished run; runs in flight are never dropped.
+		var oldest string
+		for k, r := range idempotencyKeys {
+			if !r.finishedAt.IsZero() && (oldest == "" || r.finishedAt.Before(idempotencyKeys[oldest].finishedAt)) {
+				oldest = k
+			}
+		}
+		if oldest != "" {
+			delete(idempotencyKeys, oldest)
+		}
+	}
+	run = &idempotentRun{key: key, fingerprint: fingerprint, execID: execID, async: async, done: make(chan struct{})}
+	idempotencyKeys[key] = run
+	return run, true, nil
+}
+
+// finish publishes the outcome to waiting retries. Successful results are
+// kept for idempotencyTTL; failures to set up the run are not, so a retry
+// gets to try again. A nil run is a request without a key.
+func (run *idempotentRun) finish(resp RunResponse, err error) {
+	if run == nil {
+		return
+	}
+	forget := func() {
+		idempotencyMu.Lock()
+		defer idempotencyMu.Unlock()
+		if idempotencyKeys[run.key] == run {
+			delete(idempotencyKeys, run.key)
+		}
+	}
+
+	idempotencyMu.Lock()
+	run.resp, run.err, run.finishedAt = resp, err, time.Now()
+	idempotencyMu.Unlock()
+	close(run.done)
+	if err != nil {
+		forget()
+		return
+	}
+	time.AfterFunc(live(&idempotencyTTL), forget)
+}
+
+// replayIdempotent answers a repeated request with the first one's
+// outcome, waiting for it if it is still running. Asynchronous runs get
+// their original exec_id back.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, req RunRequest, run *idempotentRun) {
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.Header().Set(schemaVersionHeader, strconv.Itoa(responseSchemaVersion))
+	if run.async {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"exec_id": run.execID})
+		return
+	}
+
+	select {
+	case <-run.done:
+	case <-r.Context().Done():
+		return
+	}
+	if run.err != nil {
+		writeError(w, run.err)
+		return
+	}
+	writeRunResponse(w, r, req, run.resp)
+}
+
+/* ---------------- WebSocket sessions ---------------- */
+
+// Just enough of RFC 6455 for /session: a server-side handshake, unfragmented
+// writes and reassembly of (masked) client frames.
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	wsMaxMessage = 1 << 20
+
+	sessionCmd = "exec sh -i"
+)
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		return nil, fmt.Errorf("GET only")
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("websocket upgrade required")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection cannot be hijacked")
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// readMessage returns the next data message, answering pings along the way.
+// A close frame from the client is reported as io.EOF.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+			return nil, err
+		}
+		fin := hdr[0]&0x80 != 0
+		op := hdr[0] & 0x0f
+		n := uint64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > wsMaxMessage || uint64(len(msg))+n > wsMaxMessage {
+			return nil, fmt.Errorf("websocket message too large")
+		}
+
+		var mask [4]byte
+		masked := hdr[1]&0x80 != 0
+		if masked {
+			if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+				return nil, err
+			}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch op {
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		}
+
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	hdr := []byte{0x80 | op}
+	switch {
+	case len(payload) < 126:
+		hdr = append(hdr, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(payload)))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(payload)))
+	}
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) close(code uint16, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	_ = c.writeFrame(wsOpClose, append(payload, reason...))
+	_ = c.conn.Close()
+}
+
+var errSessionNotUp = errors.New("session ended before the guest came up")
+
+// sessionHandler boots a guest running an interactive shell on its serial
+// console and bridges it to a WebSocket: text messages from the client are
+// written to the shell's stdin (a newline is appended if missing), and console
+// output (stdout and stderr combined) is streamed back as text messages. The
+// session ends when the shell exits, the client closes, or timeout_ms elapses.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	timeoutMs := 0
+	if v := r.URL.Query().Get("timeout_ms"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, newAPIError(errValidation, fmt.Errorf("invalid timeout_ms")))
+			return
+		}
+		timeoutMs = n
+	}
+	if err := validateTimeout(timeoutMs); err != nil {
+		writeError(w, err)
+		return
+	}
+	// A session is a run as far as -max-runs and the breaker go.
+	breakerDone, err := admitBreaker()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := admitRun(); err != nil {
+		breakerDone(err)
+		writeError(w, err)
+		return
+	}
+	defer finishRun()
+	// The breaker hears whether the guest came up; a session that ends
+	// before that for other reasons says nothing about the host.
+	bootErr := errSessionNotUp
+	defer func() { breakerDone(bootErr) }()
+
+	req := RunRequest{Cmd: sessionCmd, TimeoutMs: timeoutMs, Image: r.URL.Query().Get("image")}
+	img, err := lookupImage(req.Image)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	req.imageEnv = img.Env
+	if !img.ReadOnly {
+		unlock, err := lockRootfs(img)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer unlock()
+	}
+
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		writeError(w, newAPIError(errValidation, err))
+		return
+	}
+	defer ws.conn.Close()
+
+	execID, err := newExecID()
+	if err != nil {
+		ws.close(1011, err.Error())
+		return
+	}
+	runDir := filepath.Join(runBaseDir, execID)
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		ws.close(1011, err.Error())
+		return
+	}
+	defer os.RemoveAll(runDir)
+	consolePath := filepath.Join(runDir, "console.log")
+
+	log.Printf("session %s: started", execID)
+
+	// The hijacked connection is not tied to r.Context(); the reader
+	// goroutine below cancels on client close instead.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerExecution(execID, req.Cmd, cancel)
+	defer unregisterExecution(execID)
+
+	releaseMem, err := admitMemory(ctx, live(&vmMemMiB))
+	if err != nil {
+		ws.close(1013, err.Error())
+		return
+	}
+	defer releaseMem()
+
+	mountDir := filepath.Join(runDir, "rootfs")
+	if err := os.Mkdir(mountDir, 0o755); err != nil {
+		ws.close(1011, err.Error())
+		return
+	}
+	defer os.Remove(mountDir)
+
+	var overlayDrive string
+	if img.ReadOnly {
+		overlayDrive = filepath.Join(runDir, "overlay.ext4")
+		err = prepareOverlay(ctx, overlayDrive, runDir, req)
+	} else {
+		err = prepareRootfs(ctx, mountDir, img, req)
+	}
+	if err != nil {
+		bootErr = err
+		ws.close(1011, err.Error())
+		return
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		ws.close(1011, err.Error())
+		return
+	}
+	defer stdinW.Close()
+
+	fc, consoleFile, socketPath, err := startVM(ctx, runDir, consolePath, stdinR)
+	_ = stdinR.Close()
+	if err != nil {
+		bootErr = newAPIError(errBootFailed, err)
+		ws.close(1011, err.Error())
+		return
+	}
+	defer consoleFile.Close()
+
+	defer func() {
+		if fc.Process != nil {
+			_ = fc.Process.Kill()
+		}
+		_ = fc.Wait()
+	}()
+
+	stopKill := context.AfterFunc(ctx, func() {
+		if fc.Process != nil {
+			_ = fc.Process.Kill()
+		}
+	})
+	defer stopKill()
+
+	if err := bootGuest(ctx, socketPath, img, overlayDrive, ""); err != nil {
+		bootErr = newAPIError(errBootFailed, err)
+		ws.close(1011, err.Error())
+		return
+	}
+	if err := waitForGuestInitStarted(ctx, consolePath, live(&initTimeout)); err != nil {
+		bootErr = err
+		logGuestSilence(execID, consolePath)
+		ws.close(1011, "boot timeout: "+err.Error())
+		return
+	}
+	bootErr = nil
+
+	go func() {
+		defer cancel()
+		for {
+			msg, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			if !bytes.HasSuffix(msg, []byte("\n")) {
+				msg = append(msg, '\n')
+			}
+			if _, err := stdinW.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(execTimeout(req.TimeoutMs))
+	defer timer.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	var (
+		offset  int64
+		partial string
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			ws.close(1000, "session closed")
+			return
+		case <-timer.C:
+			ws.close(1000, timeoutMessage)
+			return
+		case <-ticker.C:
+		}
+
+		chunk, err := readConsoleFrom(consolePath, offset)
+		if err != nil || len(chunk) == 0 {
+			continue
+		}
+		offset += int64(len(chunk))
+		if err := ws.writeFrame(wsOpText, chunk); err != nil {
+			return
+		}
+
+		// The exit marker may straddle two reads; only check complete lines.
+		lines := strings.Split(strings.ReplaceAll(partial+string(chunk), "\r\n", "\n"), "\n")
+		partial = lines[len(lines)-1]
+		for _, line := range lines[:len(lines)-1] {
+			if strings.HasPrefix(line, "[guest] exit code:") {
+				ws.close(1000, strings.TrimPrefix(line, "[guest] "))
+				return
+			}
+		}
+	}
+}
+
+func readConsoleFrom(consolePath string, offset int64) ([]byte, error) {
+	f, err := os.Open(consolePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+/* ---------------- msgpack ---------------- */
+
+// A small msgpack codec so high-throughput clients can skip JSON string
+// escaping for large file maps. Requests are decoded into generic values and
+// mapped onto RunRequest through the existing JSON tags, so both wire formats
+// share one schema. Binary (bin) values decode as raw strings: file contents
+// and stdin can be sent as bytes with no base64 step. JSON would replace
+// invalid UTF-8 with U+FFFD, so those two are set on RunRequest directly.
+
+const msgpackContentType = "application/msgpack"
+
+func isMsgpack(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == msgpackContentType || mt == "application/x-msgpack")
+}
+
+func acceptsMsgpack(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isMsgpack(strings.TrimSpace(part)) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeMsgpackRequest(body io.Reader, req *RunRequest, strict bool) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	d := &msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("trailing data after msgpack value")
+	}
+	raw := takeMsgpackBytes(v)
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := unmarshalRunRequest(js, req, strict); err != nil {
+		return err
+	}
+	for name, content := range raw.files {
+		f := req.Files[name]
+		f.Content = content
+		req.Files[name] = f
+	}
+	if raw.stdin != nil {
+		req.Stdin = *raw.stdin
+	}
+	return nil
+}
+
+// msgpackBytes holds the file contents and stdin of a decoded request that
+// are not valid UTF-8.
+type msgpackBytes struct {
+	files map[string]string
+	stdin *string
+}
+
+// takeMsgpackBytes moves the non-UTF-8 file contents and stdin out of v,
+// leaving empty strings in their place, so they survive the JSON step.
+func takeMsgpackBytes(v any) msgpackBytes {
+	out := msgpackBytes{files: map[string]string{}}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return out
+	}
+	if s, ok := m["stdin"].(string); ok && !utf8.ValidString(s) {
+		out.stdin = &s
+		m["stdin"] = ""
+	}
+	files, _ := m["files"].(map[string]any)
+	for name, f := range files {
+		switch f := f.(type) {
+		case string:
+			if !utf8.ValidString(f) {
+				out.files[name] = f
+				files[name] = ""
+			}
+		case map[string]any:
+			if c, ok := f["content"].(string); ok && !utf8.ValidString(c) {
+				out.files[name] = c
+				f["content"] = ""
+			}
+		}
+	}
+	return out
+}
+
+// marshalMsgpack encodes v (via its JSON representation) as msgpack.
+func marshalMsgpack(v any) ([]byte, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, generic)
+}
+
+func appendMsgpack(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(f)), nil
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...), nil
+	case []any:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+		}
+		for _, item := range v {
+			var err error
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+		}
+		keys := make([]string, 0, n)
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			var err error
+			if b, err = appendMsgpack(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n < 128:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+const msgpackMaxDepth = 32
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, fmt.Errorf("msgpack: nesting too deep")
+	}
+	tb, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	t := tb[0]
+
+	switch {
+	case t <= 0x7f:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return d.decodeMap(int(t&0x0f), depth)
+	case t&0xf0 == 0x90:
+		return d.decodeArray(int(t&0x0f), depth)
+	case t&0xe0 == 0xa0:
+		return d.decodeString(int(t & 0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		// bin and str both decode to string.
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[t]
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (t - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded width.
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", t)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) ([]any, error) {
+	// Every element takes at least one byte; reject lengths the input can't hold.
+	if n > len(d.data)-d.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	out := make([]any, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (map[string]any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	out := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map keys must be strings")
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+/* ---------------- Guest seccomp ---------------- */
+
+// The rootfs has no seccomp tooling of its own, so the host copies its own
+// binary into the image and the wrapper runs the command through it:
+// "guest-exec" installs the profile's filter and execs the command. This
+// needs a statically linked sandboxd (CGO_ENABLED=0).
+const (
+	guestHelper = "/sandboxd/sandboxd"
+
+	seccompNone    = "none"
+	seccompDefault = "default"
+	seccompStrict  = "strict"
+)
+
+type seccompProfile struct {
+	// Syscalls that fail with EPERM.
+	deny []uintptr
+	// unixSocketsOnly refuses every socket(2) family but AF_UNIX; otherwise
+	// only raw and packet sockets are refused.
+	unixSocketsOnly bool
+}
+
+var seccompDenyDefault = []uintptr{
+	syscall.SYS_PTRACE,
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_REBOOT,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+}
+
+var seccompProfiles = map[string]seccompProfile{
+	seccompNone:    {},
+	seccompDefault: {deny: seccompDenyDefault},
+	seccompStrict: {
+		deny: append(append([]uintptr{}, seccompDenyDefault...),
+			syscall.SYS_UNSHARE,
+			syscall.SYS_KEYCTL,
+			syscall.SYS_ADD_KEY,
+			syscall.SYS_REQUEST_KEY,
+			syscall.SYS_PERF_EVENT_OPEN,
+			syscall.SYS_ACCT,
+			syscall.SYS_SETTIMEOFDAY,
+			syscall.SYS_CLOCK_SETTIME,
+		),
+		unixSocketsOnly: true,
+	},
+}
+
+// seccompProfileName maps the request field to a profile; empty means none.
+func seccompProfileName(name string) (string, error) {
+	if name == "" {
+		return seccompNone, nil
+	}
+	if _, ok := seccompProfiles[name]; !ok {
+		return "", newAPIError(errValidation, fmt.Errorf("unknown seccomp profile %q", name))
+	}
+	return name, nil
+}
+
+// needsGuestHelper reports whether the command has to run through
+// "sandboxd guest-exec" (seccomp or a tty).
+func needsGuestHelper(req RunRequest) bool {
+	return (req.Seccomp != "" && req.Seccomp != seccompNone) || req.Tty
+}
+
+// installGuestHelper copies the running binary into the mounted rootfs.
+func installGuestHelper(mountDir string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(self)
+	if err != nil {
+		return err
+	}
+	hostPath := filepath.Join(mountDir, guestHelper)
+	if err := checkNoSymlinks(mountDir, hostPath); err != nil {
+		return err
+	}
+	return writeFileNoFollow(hostPath, data, 0o755)
+}
+
+// Classic BPF as used by seccomp (linux/filter.h, linux/seccomp.h).
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+const (
+	bpfLdAbs              = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK               = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK               = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfAndK               = 0x54 // BPF_ALU | BPF_AND | BPF_K
+	bpfRetK               = 0x06 // BPF_RET | BPF_K
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data; args are little-endian u64s.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16
+	seccompDataArg1 = 24
+
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	// x32 syscalls on amd64 share the arch but set this bit in nr.
+	x32SyscallBit = 0x40000000
+)
+
+var auditArch = map[string]uint32{
+	"amd64": 0xc000003e, // AUDIT_ARCH_X86_64
+	"arm64": 0xc00000b7, // AUDIT_ARCH_AARCH64
+}
+
+// seccompFilter compiles a profile into a filter program. Foreign
+// architectures are killed outright; denied calls fail with EPERM.
+func seccompFilter(p seccompProfile, arch uint32) []sockFilter {
+	eperm := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	prog := []sockFilter{
+		{bpfLdAbs, 0, 0, seccompDataArch},
+		{bpfJeqK, 1, 0, arch},
+		{bpfRetK, 0, 0, seccompRetKillProcess},
+		{bpfLdAbs, 0, 0, seccompDataNr},
+		{bpfJgeK, 0, 1, x32SyscallBit},
+		{bpfRetK, 0, 0, eperm},
+	}
+	for _, nr := range p.deny {
+		prog = append(prog,
+			sockFilter{bpfJeqK, 0, 1, uint32(nr)},
+			sockFilter{bpfRetK, 0, 0, eperm},
+		)
+	}
+
+	var sock []sockFilter
+	if p.unixSocketsOnly {
+		sock = []sockFilter{
+			{bpfLdAbs, 0, 0, seccompDataArg0},
+			{bpfJeqK, 0, 1, syscall.AF_UNIX},
+			{bpfRetK, 0, 0, seccompRetAllow},
+			{bpfRetK, 0, 0, eperm},
+		}
+	} else {
+		sock = []sockFilter{
+			{bpfLdAbs, 0, 0, seccompDataArg0},
+			{bpfJeqK, 0, 1, syscall.AF_PACKET},
+			{bpfRetK, 0, 0, eperm},
+			{bpfLdAbs, 0, 0, seccompDataArg1},
+			{bpfAndK, 0, 0, 0xf}, // strip SOCK_NONBLOCK/SOCK_CLOEXEC
+			{bpfJeqK, 0, 1, syscall.SOCK_RAW},
+			{bpfRetK, 0, 0, eperm},
+			{bpfRetK, 0, 0, seccompRetAllow},
+		}
+	}
+	prog = append(prog, sockFilter{bpfJeqK, 0, uint8(len(sock)), syscall.SYS_SOCKET})
+	prog = append(prog, sock...)
+	return append(prog, sockFilter{bpfRetK, 0, 0, seccompRetAllow})
+}
+
+// installSeccomp applies the named profile to the calling thread, which is
+// locked so that the filter is inherited by whatever it execs next.
+func installSeccomp(name string) error {
+	p, ok := seccompProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown seccomp profile %q", name)
+	}
+	if name == seccompNone {
+		return nil
+	}
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp not supported on %s", runtime.GOARCH)
+	}
+
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", errno)
+	}
+	filter := seccompFilter(p, arch)
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_SECCOMP): %w", errno)
+	}
+	return nil
+}
+
+// guestExec is the "guest-exec" subcommand run by the wrapper inside the
+// guest: sandboxd guest-exec [-tty] -seccomp PROFILE -- CMD [ARGS...].
+func guestExec(args []string) {
+	fs := flag.NewFlagSet("guest-exec", flag.ExitOnError)
+	profile := fs.String("seccomp", seccompNone, "seccomp profile to apply before exec")
+	tty := fs.Bool("tty", false, "run the command on a pseudo-terminal and relay its output")
+	_ = fs.Parse(args)
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "sandboxd guest-exec: %v\n", err)
+		os.Exit(guestErrorExitCode)
+	}
+	if fs.NArg() == 0 {
+		fail(errors.New("no command"))
+	}
+	path, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	if err := installSeccomp(*profile); err != nil {
+		fail(err)
+	}
+	if *tty {
+		// The filter is on this (locked) thread, so the child inherits it.
+		code, err := runWithPTY(path, fs.Args(), os.Stdout)
+		if err != nil {
+			fail(err)
+		}
+		os.Exit(code)
+	}
+	fail(syscall.Exec(path, fs.Args(), os.Environ()))
+}
+
+/* ---------------- Guest PTY ---------------- */
+
+// openPTY allocates a pseudo-terminal pair via /dev/ptmx (devpts must be
+// mounted) and gives it a conventional 80x24 size.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	ioctl := func(req uintptr, arg unsafe.Pointer) error {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), req, uintptr(arg)); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+
+	var unlock int32
+	if err := ioctl(syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlock pty: %w", err)
+	}
+	var n uint32
+	if err := ioctl(syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("get pty number: %w", err)
+	}
+	ws := struct{ rows, cols, x, y uint16 }{24, 80, 0, 0}
+	_ = ioctl(syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// runWithPTY runs argv (resolved to path) as a session leader with a pty as
+// its controlling terminal and copies the terminal output to out until the
+// command exits. It returns the command's exit code.
+func runWithPTY(path string, argv []string, out io.Writer) (int, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return 0, err
+	}
+	defer master.Close()
+
+	cmd := exec.Command(path, argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Reads fail with EIO once the last slave fd is closed.
+	_, _ = io.Copy(out, master)
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	case err != nil:
+		return 0, err
+	}
+	return 0, nil
+}
+
+/* ---------------- Tracing ---------------- */
+
+// A minimal OpenTelemetry-compatible tracer: spans carry W3C trace context
+// (an incoming traceparent header is honored) and are exported in batches
+// as OTLP/HTTP JSON. With no endpoint configured, startSpan returns a nil
+// span and every span method is a no-op.
+
+var (
+	// otlpEndpoint is the collector base URL, e.g. http://localhost:4318;
+	// spans are POSTed to <endpoint>/v1/traces.
+	otlpEndpoint string
+
+	// Finished spans waiting for export; nil when tracing is off.
+	spanQueue chan *span
+
+	spanBatchSize     = 256
+	spanFlushInterval = 5 * time.Second
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	server   bool
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	errMsg   string
+}
+
+type spanContextKey struct{}
+
+func newSpan(name string, traceID [16]byte, parentID [8]byte) *span {
+	s := &span{traceID: traceID, parentID: parentID, name: name, start: time.Now()}
+	_, _ = rand.Read(s.spanID[:])
+	return s
+}
+
+// startSpan starts a child of the span in ctx, or a new trace if there is
+// none.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if spanQueue == nil {
+		return ctx, nil
+	}
+	var s *span
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok && parent != nil {
+		s = newSpan(name, parent.traceID, parent.spanID)
+	} else {
+		var traceID [16]byte
+		_, _ = rand.Read(traceID[:])
+		s = newSpan(name, traceID, [8]byte{})
+	}
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// startServerSpan starts the root span for an incoming request, continuing
+// the caller's trace if it sent a valid traceparent.
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	if spanQueue == nil {
+		return r.Context(), nil
+	}
+	ctx, s := startSpan(r.Context(), name)
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID = traceID, parentID
+	}
+	s.server = true
+	s.setAttr("http.method", r.Method)
+	s.setAttr("url.path", r.URL.Path)
+	return ctx, s
+}
+
+// parseTraceparent parses a version-00 W3C traceparent header.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// finish ends the span, marking it failed if err is set, and queues it for
+// export. Spans are dropped rather than blocking when the queue is full.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.errMsg = err.Error()
+	}
+	select {
+	case spanQueue <- s:
+	default:
+	}
+}
+
+// exportSpans batches spans from queue and sends them to endpoint until the
+// queue is closed.
+func exportSpans(endpoint string, queue <-chan *span) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		body, _ := json.Marshal(otlpTraces(batch))
+		batch = batch[:0]
+		resp, err := client.Post(strings.TrimSuffix(endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("trace export: %v", err)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("trace export: collector returned %s", resp.Status)
+		}
+	}
+
+	for {
+		select {
+		case s, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// otlpTraces renders spans as an OTLP ExportTraceServiceRequest in the
+// protobuf JSON mapping (hex ids, nanosecond times as strings).
+func otlpTraces(spans []*span) map[string]any {
+	out := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		kind := 1 // SPAN_KIND_INTERNAL
+		if s.server {
+			kind = 2 // SPAN_KIND_SERVER
+		}
+		keys := make([]string, 0, len(s.attrs))
+		for k := range s.attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		attrs := make([]map[string]any, 0, len(keys))
+		for _, k := range keys {
+			attrs = append(attrs, map[string]any{"key": k, "value": map[string]string{"stringValue": s.attrs[k]}})
+		}
+		status := map[string]any{"code": 1} // STATUS_CODE_OK
+		if s.errMsg != "" {
+			status = map[string]any{"code": 2, "message": s.errMsg}
+		}
+
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		}
+		if s.parentID != ([8]byte{}) {
+			o["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		out = append(out, o)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []any{
+				map[string]any{"key": "service.name", "value": map[string]string{"stringValue": "sandboxd"}},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "sandboxd"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+/* ---------------- CORS ---------------- */
+
+// CORS is off unless -cors-origins names the origins allowed to call the
+// API from a browser. Since /run executes code, there is no wildcard.
+var (
+	corsOrigins = map[string]bool{}
+	corsMethods = "GET, POST"
+	corsHeaders = "Content-Type, Accept"
+)
+
+// withCORS adds CORS headers for allowlisted origins and answers preflight
+// requests itself.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(corsOrigins) == 0 {
+			h(w, r)
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && corsOrigins[origin]
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// parseCORSOrigins fills corsOrigins from a comma-separated list.
+func parseCORSOrigins(list string) {
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+}
+
+/* ---------------- Startup checks ---------------- */
+
+// requiredTools are the host binaries every run shells out to.
+var requiredTools = []string{"firecracker", "mount", "umount"}
+
+// missingTools checks requiredTools; the namespace executor does without
+// firecracker, the gvisor executor needs runsc instead, read_only images
+// need mkfs.ext4, and the fake executor needs none of them.
+func missingTools() []string {
+	if _, ok := executor.(fakeShellExecutor); ok {
+		return nil
+	}
+	var missing []string
+	for _, tool := range requiredTools {
+		if tool == "firecracker" {
+			switch executor.(type) {
+			case namespaceExecutor:
+				continue
+			case gvisorExecutor:
+				tool = runscPath
+			}
+		}
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if _, ok := executor.(firecrackerExecutor); ok && hasReadOnlyImage() {
+		if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+			missing = append(missing, "mkfs.ext4")
+		}
+	}
+	return missing
+}
+
+// hasReadOnlyImage reports whether any registered profile is read_only,
+// which makes every run build an overlay drive with mkfs.ext4.
+func hasReadOnlyImage() bool {
+	imagesMu.RLock()
+	defer imagesMu.RUnlock()
+	for _, p := range imageProfiles {
+		if p.ReadOnly {
+			return true
+		}
+	}
+	return false
+}
+
+/* ---------------- Startup cleanup ---------------- */
+
+// checkRunBase makes sure base exists, is writable and has at least
+// minFreeMiB available to unprivileged writers.
+func checkRunBase(base string, minFreeMiB int) error {
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(base, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(base, &st); err != nil {
+		return err
+	}
+	if free := st.Bavail * uint64(st.Bsize) >> 20; free < uint64(minFreeMiB) {
+		return fmt.Errorf("only %d MiB free, need %d (see -run-dir-min-free-mib)", free, minFreeMiB)
+	}
+	return nil
+}
+
+// lockRunBase takes an exclusive flock on runBaseDir for the life of the
+// process. Holding it means no other sandboxd shares the directory.
+func lockRunBase(base string) (bool, error) {
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(filepath.Join(base, ".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	// Intentionally leaked: the lock is released when the process exits.
+	return true, nil
+}
+
+// mountsUnder returns mount points below base, deepest first.
+func mountsUnder(base string) ([]string, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		// mountinfo escapes spaces and friends as octal (\040).
+		mp, err := strconv.Unquote(`"` + fields[4] + `"`)
+		if err != nil {
+			mp = fields[4]
+		}
+		if strings.HasPrefix(mp, base+string(os.PathSeparator)) {
+			out = append(out, mp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return len(out[i]) > len(out[j]) })
+	return out, nil
+}
+
+// sweepRunDirs cleans up after an unclean shutdown: it unmounts anything
+// still mounted under base and removes per-run dirs older than maxAge
+// (all of them when maxAge is 0).
+func sweepRunDirs(base string, maxAge time.Duration) error {
+	mounts, err := mountsUnder(base)
+	if err != nil {
+		return err
+	}
+	for _, mp := range mounts {
+		if err := exec.Command("umount", mp).Run(); err != nil {
+			if err := exec.Command("umount", "-l", mp).Run(); err != nil {
+				log.Printf("cleanup: failed to unmount %s: %v", mp, err)
+				continue
+			}
+		}
+		log.Printf("cleanup: unmounted stale %s", mp)
+	}
+
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	stillMounted := map[string]bool{}
+	if remaining, err := mountsUnder(base); err == nil {
+		for _, mp := range remaining {
+			rel, _ := filepath.Rel(base, mp)
+			stillMounted[strings.Split(rel, string(os.PathSeparator))[0]] = true
+		}
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if stillMounted[e.Name()] {
+			// Never RemoveAll through a live mount: it would wipe the image.
+			log.Printf("cleanup: keeping %s, still mounted", e.Name())
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if maxAge > 0 && now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(base, e.Name())); err != nil {
+			log.Printf("cleanup: failed to remove %s: %v", e.Name(), err)
+			continue
+		}
+		log.Printf("cleanup: removed stale run dir %s", e.Name())
+	}
+	return nil
+}
+
+/* ---------------- Rootfs builder ---------------- */
+
+// guestInitScript is the init installed by build-rootfs. It implements the
+// guest contract for every cmd_transport: it logs the markers sandboxd
+// waits for, runs the command from argv, $CMD or guestRunScript, and powers
+// the VM off.
+const guestInitScript = `#!/bin/sh
+# Also mounts /proc in the merged tree when the overlay branch re-execs.
+mount -t proc proc /proc 2>/dev/null
+if [ -z "$SANDBOXD_OVERLAY" ] && grep -qw sandboxd.overlay /proc/cmdline; then
+	# read_only image: stack the run's drive on the rootfs and start over
+	# inside the merged tree. 125 is guestErrorExitCode.
+	export SANDBOXD_OVERLAY=1
+	mount -t devtmpfs devtmpfs /dev 2>/dev/null
+	mount -t tmpfs tmpfs /tmp &&
+		mkdir -p /tmp/overlay /tmp/root &&
+		mount /dev/vdb /tmp/overlay &&
+		mount -t overlay overlay -o lowerdir=/,upperdir=/tmp/overlay/upper,workdir=/tmp/overlay/ovlwork /tmp/root &&
+		exec chroot /tmp/root "$0" "$@"
+	echo "[guest] init started"
+	echo "sandboxd: could not set up the overlay" >&2
+	echo "[guest] exit code: 125"
+	reboot -f 2>/dev/null || echo o > /proc/sysrq-trigger
+fi
+mount -t sysfs sysfs /sys 2>/dev/null
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+mount -t tmpfs tmpfs /tmp 2>/dev/null
+export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin HOME=/root
+echo "[guest] init started"
+if [ $# -gt 0 ]; then
+	"$@"
+elif [ -n "$CMD" ]; then
+	sh -c "$CMD"
+else
+	sh ` + guestRunScript + `
+fi
+echo "[guest] exit code: $?"
+sync
+reboot -f 2>/dev/null || echo o > /proc/sysrq-trigger
+`
+
+type rootfsBuild struct {
+	Base   string // directory or tarball (any compression tar detects)
+	OCI    string // OCI image layout or docker save archive, instead of Base
+	Out    string // ext4 image to create
+	SizeMB int
+	Init   string // path of the installed init inside the image
+
+	// Register, if set, is an -images file to add the result to as Name,
+	// booting Kernel.
+	Register string
+	Name     string
+	Kernel   string
+}
+
+// buildRootfs makes an ext4 image from a base filesystem with the guest
+// side of sandboxd installed: the init above, the guest-exec helper, and
+// the /sandboxd and /work directories. It needs mkfs.ext4 with -d support
+// (e2fsprogs 1.43+) but not root.
+func buildRootfs(b rootfsBuild) error {
+	if (b.Base == "") == (b.OCI == "") || b.Out == "" {
+		return fmt.Errorf("-out and one of -base and -oci are required")
+	}
+	if !filepath.IsAbs(b.Init) {
+		return fmt.Errorf("-init must be an absolute path")
+	}
+	if b.SizeMB <= 0 {
+		return fmt.Errorf("-size-mb must be positive")
+	}
+
+	staging, err := os.MkdirTemp("", "sandboxd-rootfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if b.OCI != "" {
+		if err := flattenOCI(b.OCI, staging); err != nil {
+			return fmt.Errorf("flatten %s: %w", b.OCI, err)
+		}
+	} else {
+		info, err := os.Stat(b.Base)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = runMountTool("cp", "-a", b.Base+"/.", staging)
+		} else {
+			err = runMountTool("tar", "-xf", b.Base, "-C", staging)
+		}
+		if err != nil {
+			return fmt.Errorf("unpack %s: %w", b.Base, err)
+		}
+	}
+
+	for _, dir := range []string{"/sandboxd", "/work", "/proc", "/sys", "/dev", "/tmp"} {
+		if err := os.MkdirAll(filepath.Join(staging, dir), 0o755); err != nil {
+			return err
+		}
+	}
+	// The base's init is often a symlink (e.g. to busybox); replace the
+	// link rather than writing through it.
+	initPath := filepath.Join(staging, b.Init)
+	if err := os.MkdirAll(filepath.Dir(initPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(initPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeFileNoFollow(initPath, []byte(guestInitScript), 0o755); err != nil {
+		return err
+	}
+	if err := installGuestHelper(staging); err != nil {
+		return fmt.Errorf("install guest helper: %w", err)
+	}
+
+	if err := os.Remove(b.Out); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return runMountTool("mkfs.ext4", "-q", "-F", "-d", staging, b.Out, fmt.Sprintf("%dM", b.SizeMB))
+}
+
+// buildRootfsCommand is the "build-rootfs" subcommand.
+func buildRootfsCommand(args []string) {
+	fs := flag.NewFlagSet("build-rootfs", flag.ExitOnError)
+	var b rootfsBuild
+	fs.StringVar(&b.Base, "base", "", "base filesystem: a directory or a tarball (e.g. an Alpine minirootfs)")
+	fs.StringVar(&b.OCI, "oci", "", "base image instead of -base: an OCI image layout or a docker save archive (directory or tarball)")
+	fs.StringVar(&b.Out, "out", "", "ext4 image to write")
+	fs.IntVar(&b.SizeMB, "size-mb", 512, "image size in MiB")
+	fs.StringVar(&b.Init, "init", "/sbin/init", "where to install the sandboxd init (the profile's init_path)")
+	fs.StringVar(&b.Register, "register", "", "-images file to add the image to (created if missing)")
+	fs.StringVar(&b.Name, "name", "", "profile name for -register")
+	fs.StringVar(&b.Kernel, "kernel", "", "kernel_path for -register")
+	_ = fs.Parse(args)
+
+	if b.Register != "" && (b.Name == "" || b.Kernel == "") {
+		fmt.Fprintln(os.Stderr, "build-rootfs: -register needs -name and -kernel")
+		os.Exit(2)
+	}
+	if err := buildRootfs(b); err != nil {
+		fmt.Fprintln(os.Stderr, "build-rootfs:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %s (init_path %s, cmd_transport any)\n", b.Out, b.Init)
+	if b.Register != "" {
+		if err := registerRootfs(b); err != nil {
+			fmt.Fprintln(os.Stderr, "build-rootfs:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("registered %q in %s\n", b.Name, b.Register)
+	}
+}
+
+// registerRootfs adds a built image to an -images file as b.Name, replacing
+// any profile of that name and leaving the others as they are. A running
+// server picks it up on POST /admin/reload.
+func registerRootfs(b rootfsBuild) error {
+	rootfs, err := filepath.Abs(b.Out)
+	if err != nil {
+		return err
+	}
+	kernel, err := filepath.Abs(b.Kernel)
+	if err != nil {
+		return err
+	}
+	p := imageProfile{KernelPath: kernel, RootfsPath: rootfs, InitPath: b.Init, CmdTransport: cmdTransportEnv}
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	profiles := map[string]json.RawMessage{}
+	data, err := os.ReadFile(b.Register)
+	if err == nil {
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return fmt.Errorf("%s: %w", b.Register, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if profiles[b.Name], err = json.Marshal(p); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(profiles, "", "  "); err != nil {
+		return err
+	}
+	tmp := b.Register + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.Register)
+}
+
+/* ---------------- OCI images ---------------- */
+
+// ociManifest is the part of an OCI image index or manifest that
+// flattening needs: an index lists manifests, a manifest lists layers.
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	Digest   string `json:"digest"`
+	Platform *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+var ociDigestRe = regexp.MustCompile(`^([a-z0-9]+):([a-f0-9]{32,})$`)
+
+// flattenOCI applies an image's layers, bottom first, to root. src is an
+// OCI image layout (index.json and blobs/) or a docker save archive
+// (manifest.json), either as a directory or as a tarball of one. Nothing is
+// pulled from a registry; "skopeo copy docker://... oci-archive:x.tar" or
+// "docker save" produce the input.
+func flattenOCI(src, root string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dir := src
+	if !info.IsDir() {
+		if dir, err = os.MkdirTemp("", "sandboxd-oci-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := runMountTool("tar", "-xf", src, "-C", dir); err != nil {
+			return err
+		}
+	}
+
+	layers, err := ociLayers(dir)
+	if err != nil {
+		return err
+	}
+	// Directory modes are applied last: a read-only directory from one
+	// layer must not stop a later layer (or build-rootfs) writing into it
+	// when we are not root.
+	dirModes := map[string]os.FileMode{}
+	for _, layer := range layers {
+		if err := applyLayer(root, layer, dirModes); err != nil {
+			return fmt.Errorf("layer %s: %w", filepath.Base(layer), err)
+		}
+	}
+	dirs := make([]string, 0, len(dirModes))
+	for d := range dirModes {
+		dirs = append(dirs, d)
+	}
+	// Deepest first, so a parent losing its x bit cannot hide a child.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, d := range dirs {
+		if err := os.Chmod(d, dirModes[d]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ociLayers returns the layer files of the image unpacked in dir, bottom
+// first. A multi-platform index resolves to the linux image for this
+// host's architecture.
+func ociLayers(dir string) ([]string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); os.IsNotExist(err) {
+		return dockerSaveLayers(dir)
+	}
+	blob := func(d ociDescriptor) (string, error) {
+		m := ociDigestRe.FindStringSubmatch(d.Digest)
+		if m == nil {
+			return "", fmt.Errorf("bad digest %q", d.Digest)
+		}
+		return filepath.Join(dir, "blobs", m[1], m[2]), nil
+	}
+	read := func(path string) (ociManifest, error) {
+		var m ociManifest
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return m, err
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return m, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		return m, nil
+	}
+
+	m, err := read(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	// index.json may point at a manifest or, for multi-platform images, at
+	// another index.
+	for depth := 0; len(m.Manifests) > 0; depth++ {
+		if depth == 4 {
+			return nil, fmt.Errorf("image indexes nested too deep")
+		}
+		d, err := pickManifest(m.Manifests)
+		if err != nil {
+			return nil, err
+		}
+		path, err := blob(d)
+		if err != nil {
+			return nil, err
+		}
+		if m, err = read(path); err != nil {
+			return nil, err
+		}
+	}
+	var layers []string
+	for _, d := range m.Layers {
+		path, err := blob(d)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, path)
+	}
+	return layers, nil
+}
+
+func pickManifest(ds []ociDescriptor) (ociDescriptor, error) {
+	if len(ds) == 1 {
+		return ds[0], nil
+	}
+	for _, d := range ds {
+		if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+			return d, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("no linux/%s image among %d manifests", runtime.GOARCH, len(ds))
+}
+
+// dockerSaveLayers reads the layer list from an older docker save archive,
+// which has manifest.json instead of an OCI layout.
+func dockerSaveLayers(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("neither an OCI layout nor a docker save archive: %w", err)
+	}
+	var images []struct{ Layers []string }
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("manifest.json: %w", err)
+	}
+	if len(images) != 1 {
+		return nil, fmt.Errorf("manifest.json has %d images, want 1", len(images))
+	}
+	var layers []string
+	for _, l := range images[0].Layers {
+		if !filepath.IsLocal(l) {
+			return nil, fmt.Errorf("manifest.json: bad layer path %q", l)
+		}
+		layers = append(layers, filepath.Join(dir, l))
+	}
+	return layers, nil
+}
+
+// applyLayer extracts one layer tarball (plain or gzip) into root, honoring
+// whiteouts. Ownership and device nodes are kept only when running as root;
+// otherwise everything belongs to the caller, as with build-rootfs -base.
+func applyLayer(root, path string, dirModes map[string]os.FileMode) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return fmt.Errorf("zstd layers are not supported (skopeo copy --dest-compress-format gzip converts them)")
+	}
+
+	asRoot := os.Geteuid() == 0
+	// Paths this layer has put down, which an opaque whiteout in the same
+	// layer must not remove.
+	written := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := filepath.Split(name)
+		if err := checkNoSymlinks(root, filepath.Join(root, dir)); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+
+		if base == ".wh..wh..opq" {
+			entries, err := os.ReadDir(filepath.Join(root, dir))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range entries {
+				if p := filepath.Join(dir, e.Name()); !written[p] {
+					if err := os.RemoveAll(filepath.Join(root, p)); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			if err := os.RemoveAll(filepath.Join(root, dir, strings.TrimPrefix(base, ".wh."))); err != nil {
+				return err
+			}
+			continue
+		}
+		for p := name; p != "/" && !written[p]; p = filepath.Dir(p) {
+			written[p] = true
+		}
+
+		target := filepath.Join(root, name)
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			dirModes[target] = mode
+		case tar.TypeReg:
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0o600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				_ = out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			old := filepath.Join(root, filepath.Clean("/"+hdr.Linkname))
+			if err := checkNoSymlinks(root, filepath.Dir(old)); err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			if err := os.Link(old, target); err != nil {
+				return err
+			}
+		case tar.TypeFifo:
+			if err := syscall.Mkfifo(target, 0o600); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock:
+			if !asRoot {
+				// The guest init mounts devtmpfs over /dev anyway.
+				continue
+			}
+			kind := uint32(syscall.S_IFCHR)
+			if hdr.Typeflag == tar.TypeBlock {
+				kind = syscall.S_IFBLK
+			}
+			dev := int((hdr.Devmajor&0xfff)<<8 | hdr.Devminor&0xff | (hdr.Devminor&^0xff)<<12)
+			if err := syscall.Mknod(target, kind|0o600, dev); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+
+		if asRoot {
+			if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		// chown clears setuid bits, so the mode goes on after it.
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+			_ = os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
+
+/* ---------------- Record and replay ---------------- */
+
+// recordedRun is one line of a -record file.
+type recordedRun struct {
+	Time     time.Time    `json:"time"`
+	Request  RunRequest   `json:"request"`
+	Response *RunResponse `json:"response,omitempty"`
+	Error    *errorBody   `json:"error,omitempty"`
+}
+
+var (
+	// recordFile, if set, gets a recordedRun appended for every /run.
+	recordFile *os.File
+	recordMu   sync.Mutex
+)
+
+// recordRun appends a run to the record file. Multipart uploads are not
+// kept (they were streamed straight into the image), so such runs replay
+// without their uploaded files.
+func recordRun(req RunRequest, resp RunResponse, runErr error) {
+	if recordFile == nil {
+		return
+	}
+	rec := recordedRun{Time: time.Now().UTC(), Request: req}
+	if runErr != nil {
+		body := errorBodyFor(runErr)
+		rec.Error = &body
+	} else {
+		rec.Response = &resp
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("record: %v", err)
 		return
 	}
 
-	for name, content := range req.Files {
-		targetPath, err := resolveWorkPath(workDir, name)
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if _, err := recordFile.Write(append(line, '\n')); err != nil {
+		log.Printf("record: %v", err)
+	}
+}
+
+// replayRuns re-submits every recorded request to baseURL and writes a
+// report of the runs whose outcome differs. It returns how many differed.
+func replayRuns(r io.Reader, baseURL string, out io.Writer) (int, error) {
+	client := &http.Client{}
+	// A line holds the response as well as the request, so it has no size
+	// bound worth enforcing here; read whole lines however long.
+	br := bufio.NewReader(r)
+
+	differ := 0
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return differ, nil
+		}
+		if err != nil && err != io.EOF {
+			return differ, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec recordedRun
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return differ, fmt.Errorf("line %d: %w", n, err)
+		}
+		// Replays run synchronously so that their results can be compared.
+		rec.Request.CallbackURL = ""
+		body, err := json.Marshal(rec.Request)
+		if err != nil {
+			return differ, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		resp, err := client.Post(strings.TrimSuffix(baseURL, "/")+"/run", "application/json", bytes.NewReader(body))
 		if err != nil {
-			_ = unmountErr()
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			return differ, fmt.Errorf("line %d: %w", n, err)
 		}
-		if err := os.WriteFile(targetPath, []byte(content), 0o644); err != nil {
-			_ = unmountErr()
-			http.Error(w, err.Error(), 500)
-			return
+		var got struct {
+			RunResponse
+			Error *errorBody `json:"error"`
 		}
-		if strings.HasPrefix(content, "#!") {
-			if err := os.Chmod(targetPath, 0o755); err != nil {
-				_ = unmountErr()
-				http.Error(w, err.Error(), 500)
-				return
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if err != nil {
+			return differ, fmt.Errorf("line %d: decode response: %w", n, err)
+		}
+
+		if diffs := diffRecordedRun(rec, got.RunResponse, got.Error); len(diffs) > 0 {
+			differ++
+			fmt.Fprintf(out, "line %d (%q): %d difference(s)\n", n, truncateForDiff(rec.Request.Cmd), len(diffs))
+			for _, d := range diffs {
+				fmt.Fprintf(out, "  %s\n", d)
 			}
+		} else {
+			fmt.Fprintf(out, "line %d: same\n", n)
 		}
 	}
+}
 
-	if err := unmountErr(); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// diffRecordedRun compares the parts of a result that a deterministic
+// command reproduces: the error code or exit code, stdout, stderr and the
+// names of returned outputs. Ids, timings and console noise are ignored.
+func diffRecordedRun(rec recordedRun, got RunResponse, gotErr *errorBody) []string {
+	var diffs []string
+	field := func(name string, want, have any) {
+		if !reflect.DeepEqual(want, have) {
+			diffs = append(diffs, fmt.Sprintf("%s: recorded %s, replayed %s", name, diffValue(want), diffValue(have)))
+		}
+	}
+
+	wantCode, gotCode := "", ""
+	if rec.Error != nil {
+		wantCode = rec.Error.Code
+	}
+	if gotErr != nil {
+		gotCode = gotErr.Code
+	}
+	field("error", wantCode, gotCode)
+	if rec.Error != nil || gotErr != nil {
+		return diffs
+	}
+
+	want := RunResponse{}
+	if rec.Response != nil {
+		want = *rec.Response
+	}
+	field("exit_code", want.ExitCode, got.ExitCode)
+	field("stdout", want.Stdout, got.Stdout)
+	field("stderr", want.Stderr, got.Stderr)
+	field("outputs", outputNames(want.Outputs), outputNames(got.Outputs))
+	return diffs
+}
+
+func outputNames(outputs map[string][]byte) []string {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func diffValue(v any) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(truncateForDiff(s))
+	}
+	return fmt.Sprint(v)
+}
+
+func truncateForDiff(s string) string {
+	const max = 200
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
+
+// replayCommand is the "replay" subcommand: sandboxd replay [-url URL] FILE.
+func replayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	baseURL := fs.String("url", "http://localhost:7777", "sandboxd instance to replay against")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: sandboxd replay [-url URL] FILE.jsonl")
+		os.Exit(2)
 	}
 
-	fc, consoleFile, err := startFirecracker()
+	f, err := os.Open(fs.Arg(0))
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		os.Exit(1)
 	}
-	defer consoleFile.Close()
+	defer f.Close()
 
-	defer func() {
-		if fc.Process != nil {
-			_ = fc.Process.Kill()
+	differ, err := replayRuns(f, *baseURL, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		os.Exit(1)
+	}
+	if differ > 0 {
+		os.Exit(1)
+	}
+}
+
+/* ---------------- Config file ---------------- */
+
+// flagEnv names the environment variable behind each flag that has one;
+// the config file never overrides a variable that is set.
+var flagEnv = map[string]string{
+	"callback-secret":   "SANDBOXD_CALLBACK_SECRET",
+	"timeout-exit-code": "SANDBOXD_TIMEOUT_EXIT_CODE",
+	"timeout-message":   "SANDBOXD_TIMEOUT_MESSAGE",
+	"otlp-endpoint":     "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"run-dir":           "SANDBOXD_RUN_DIR",
+	"admin-token":       "SANDBOXD_ADMIN_TOKEN",
+	"executor":          "SANDBOXD_EXECUTOR",
+	"result-store":      "SANDBOXD_RESULT_STORE",
+}
+
+// Flags whose values are not printed with the effective configuration.
+var secretFlags = map[string]bool{"callback-secret": true, "admin-token": true, "result-store": true}
+
+// liveFlags may change on /admin/reload. They are numbers, booleans and
+// durations, read through live (default-image through imagesMu); strings
+// and anything only read at startup need a restart. Each is read when it
+// is needed, so a run under way may see one setting change and not the
+// next.
+var liveFlags = map[string]bool{
+	"max-timeout-ms":        true,
+	"max-body-bytes":        true,
+	"max-fetch-bytes":       true,
+	"init-timeout":          true,
+	"timeout-exit-code":     true,
+	"mount-retries":         true,
+	"mount-backoff":         true,
+	"start-retries":         true,
+	"start-backoff":         true,
+	"keep-alive-ttl":        true,
+	"result-ttl":            true,
+	"idempotency-ttl":       true,
+	"max-idempotency-keys":  true,
+	"debug-keep-alive":      true,
+	"allow-extra-boot-args": true,
+	"redact-commands":       true,
+	"vcpus":                 true,
+	"mem-mib":               true,
+	"mem-budget-mib":        true,
+	"term-grace":            true,
+	"guest-heartbeat":       true,
+	"max-scratch-mib":       true,
+	"strict-json":           true,
+	"admission-timeout":     true,
+	"breaker-failure-pct":   true,
+	"breaker-window":        true,
+	"breaker-cooldown":      true,
+	"default-image":         true,
+}
+
+// liveMu guards the variables behind liveFlags: reload sets them with it
+// held, and handlers and runs read them through live.
+var liveMu sync.RWMutex
+
+// live reads a variable that /admin/reload may change.
+func live[T any](p *T) T {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return *p
+}
+
+// applyConfigFile loads a JSON config file whose keys are flag names
+// ({"listen": ":8080", "max-timeout-ms": 30000, ...}) plus "images", a set
+// of image profiles as in the -images file. A value only applies if its
+// flag was not given on the command line or through its environment
+// variable. Unknown keys are errors, so typos do not go unnoticed.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "images" {
+			var profiles map[string]imageProfile
+			if err := json.Unmarshal(settings[name], &profiles); err != nil {
+				return fmt.Errorf("%s: images: %w", path, err)
+			}
+			if err := registerImageProfiles(profiles); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			continue
 		}
-		_ = fc.Wait()
-	}()
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		value, err := configValue(settings[name])
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+		if explicit[name] {
+			continue
+		}
+		if env, ok := flagEnv[name]; ok {
+			if _, ok := os.LookupEnv(env); ok {
+				continue
+			}
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
 
-	if err := waitForSocket(fcSocket, 10*time.Second); err != nil {
-		logText, readErr := os.ReadFile(fcLog)
-		if readErr == nil {
-			text := strings.ReplaceAll(string(logText), "\r\n", "\n")
-			text = strings.TrimRight(text, "\n")
-			lines := []string{}
-			if text != "" {
-				lines = strings.Split(text, "\n")
-				if len(lines) > 50 {
-					lines = lines[len(lines)-50:]
+func readConfigFile(path string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// configReloader re-applies the -config file for /admin/reload.
+type configReloader struct {
+	mu   sync.Mutex
+	fs   *flag.FlagSet
+	path string
+	// Flags given on the command line, which the file never overrides.
+	pinned map[string]bool
+	// The file as last applied. Settings that need a restart keep their
+	// old value here, so every reload reports them until one happens.
+	loaded map[string]json.RawMessage
+}
+
+// reloader is nil unless sandboxd was started with -config.
+var reloader *configReloader
+
+// adminToken enables the /admin endpoints; see adminReloadHandler.
+var adminToken string
+
+// newConfigReloader must be called before the file is first applied, while
+// fs still only knows about command-line flags.
+func newConfigReloader(fs *flag.FlagSet, path string) *configReloader {
+	c := &configReloader{fs: fs, path: path, pinned: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) { c.pinned[f.Name] = true })
+	return c
+}
+
+type reloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// reload diffs the file against what was last applied. Changed live flags
+// and images are set, the result is validated like at startup, and on any
+// error everything is put back. Other changes are only reported. Images
+// dropped from the file stay registered until a restart.
+func (c *configReloader) reload() (reloadResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	settings, err := readConfigFile(c.path)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			return reloadResult{}, newAPIError(errValidation, err)
+		}
+		return reloadResult{}, err
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range []map[string]json.RawMessage{c.loaded, settings} {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	res := reloadResult{Applied: []string{}, RestartRequired: []string{}}
+	loaded := make(map[string]json.RawMessage, len(settings))
+	for name, raw := range settings {
+		loaded[name] = raw
+	}
+	keepOld := func(name string) {
+		res.RestartRequired = append(res.RestartRequired, name)
+		if old, ok := c.loaded[name]; ok {
+			loaded[name] = old
+		} else {
+			delete(loaded, name)
+		}
+	}
+
+	updates := make(map[string]string)
+	var images map[string]imageProfile
+	for _, name := range names {
+		raw, inNew := settings[name]
+		old, inOld := c.loaded[name]
+		if name != "images" && (c.fs.Lookup(name) == nil || name == "config") {
+			return reloadResult{}, newAPIError(errValidation, fmt.Errorf("%s: unknown setting %q", c.path, name))
+		}
+		if inNew && inOld && jsonEqual(raw, old) {
+			continue
+		}
+		if c.pinned[name] {
+			continue
+		}
+		if env, ok := flagEnv[name]; ok {
+			if _, ok := os.LookupEnv(env); ok {
+				continue
+			}
+		}
+
+		switch {
+		case name == "images" && inNew:
+			if err := json.Unmarshal(raw, &images); err != nil {
+				return reloadResult{}, newAPIError(errValidation, fmt.Errorf("%s: images: %w", c.path, err))
+			}
+			res.Applied = append(res.Applied, name)
+			var oldImages map[string]json.RawMessage
+			_ = json.Unmarshal(old, &oldImages)
+			for image := range oldImages {
+				if _, ok := images[image]; !ok {
+					res.RestartRequired = append(res.RestartRequired, "images."+image)
 				}
 			}
-			snippet := strings.Join(lines, "\n")
-			if snippet != "" {
-				http.Error(w, fmt.Sprintf("%s\nfirecracker log:\n%s", err.Error(), snippet), 500)
-				return
+		case !inNew || !liveFlags[name]:
+			keepOld(name)
+		default:
+			value, err := configValue(raw)
+			if err != nil {
+				return reloadResult{}, newAPIError(errValidation, fmt.Errorf("%s: %s: %w", c.path, name, err))
 			}
+			updates[name] = value
+			res.Applied = append(res.Applied, name)
 		}
-		http.Error(w, err.Error(), 500)
-		return
 	}
 
-	if err := fcPut("/machine-config", map[string]any{
-		"vcpu_count":   1,
-		"mem_size_mib": 256,
-		"smt":          false,
-	}); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	imagesMu.Lock()
+	defer imagesMu.Unlock()
+	liveMu.Lock()
+	defer liveMu.Unlock()
+
+	previous := make(map[string]string, len(updates))
+	previousImages := make(map[string]imageProfile, len(imageProfiles))
+	for name, p := range imageProfiles {
+		previousImages[name] = p
+	}
+	rollback := func() {
+		for name, value := range previous {
+			_ = c.fs.Set(name, value)
+		}
+		imageProfiles = previousImages
 	}
 
-	cmdForGuest := req.Cmd
-	if len(req.Files) > 0 {
-		cmdForGuest = fmt.Sprintf("cd /work && %s", req.Cmd)
+	for name, value := range updates {
+		previous[name] = c.fs.Lookup(name).Value.String()
+		if err := c.fs.Set(name, value); err != nil {
+			rollback()
+			return reloadResult{}, newAPIError(errValidation, fmt.Errorf("%s: %s: %w", c.path, name, err))
+		}
 	}
-	bootArgs := fmt.Sprintf(
-		"console=ttyS0 quiet loglevel=0 reboot=k panic=1 pci=off init=/sbin/init CMD=\"%s\"",
-		cmdForGuest,
-	)
+	if images != nil {
+		if err := registerImageProfiles(images); err != nil {
+			rollback()
+			return reloadResult{}, newAPIError(errValidation, fmt.Errorf("%s: %w", c.path, err))
+		}
+	}
+	if err := validateConfig(c.fs.Lookup("listen").Value.String()); err != nil {
+		rollback()
+		return reloadResult{}, newAPIError(errValidation, err)
+	}
+	c.loaded = loaded
+	logEffectiveConfig(c.fs)
+	return res, nil
+}
 
-	if err := fcPut("/boot-source", map[string]any{
-		"kernel_image_path": kernelPath,
-		"boot_args":         bootArgs,
-	}); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+// jsonEqual compares two JSON values ignoring insignificant whitespace.
+func jsonEqual(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
 	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
 
-	if err := fcPut("/drives/rootfs", map[string]any{
-		"drive_id":       "rootfs",
-		"path_on_host":   rootfsPath,
-		"is_root_device": true,
-		"is_read_only":   false,
-	}); err != nil {
-		http.Error(w, err.Error(), 500)
+// adminReloadHandler serves POST /admin/reload. Admin endpoints are off
+// unless -admin-token is set, and then need "Authorization: Bearer <token>".
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, newAPIError(errMethodNotAllowed, fmt.Errorf("POST only")))
 		return
 	}
-
-	if err := fcPut("/actions", map[string]any{
-		"action_type": "InstanceStart",
-	}); err != nil {
-		http.Error(w, err.Error(), 500)
+	if adminToken == "" {
+		writeError(w, newAPIError(errNotFound, fmt.Errorf("admin endpoints are disabled (see -admin-token)")))
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeError(w, newAPIError(errUnauthorized, fmt.Errorf("missing or wrong admin token")))
+		return
+	}
+	if reloader == nil {
+		writeError(w, newAPIError(errValidation, fmt.Errorf("sandboxd was started without -config")))
 		return
 	}
 
-	// ---- Timeout semantics fix ----
-	timeoutMs := req.TimeoutMs
-	if timeoutMs <= 0 {
-		timeoutMs = 5000
+	res, err := reloader.reload()
+	if err != nil {
+		log.Printf("config reload failed, keeping the current config: %v", err)
+		writeError(w, err)
+		return
 	}
+	log.Printf("config reloaded: applied %v, restart required for %v", res.Applied, res.RestartRequired)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
 
-	// Boot grace: wait for init-start marker (does not consume timeout_ms).
-	// If boot is slow, fail with a clear error.
-	if err := waitForGuestInitStarted(5 * time.Second); err != nil {
-		resp := RunResponse{
-			Stdout:   "",
-			Stderr:   "boot timeout: " + err.Error(),
-			ExitCode: 124,
+// configValue turns a JSON value into flag syntax: strings as they are,
+// numbers and booleans formatted, and lists of strings comma-joined (as
+// -cors-origins takes them).
+func configValue(raw json.RawMessage) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case json.Number:
+		return x.String(), nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	case []any:
+		items := make([]string, len(x))
+		for i, item := range x {
+			str, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("lists may only hold strings")
+			}
+			items[i] = str
 		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(resp)
-		return
+		return strings.Join(items, ","), nil
 	}
+	return "", fmt.Errorf("unsupported value %s", raw)
+}
 
-	// Now start the real execution timeout.
-	done := make(chan struct{})
-	var (
-		stdout   string
-		exitCode int
-		waitErr  error
-	)
+// validateConfig checks the settings that flag parsing alone cannot.
+func validateConfig(listenAddr string) error {
+	if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	if _, ok := imageProfiles[defaultImage]; !ok {
+		return fmt.Errorf("default-image: no image profile named %q", defaultImage)
+	}
+	switch {
+	case vmVcpus < 1 || vmVcpus > 32:
+		return fmt.Errorf("vcpus must be between 1 and 32")
+	case vmMemMiB < 32:
+		return fmt.Errorf("mem-mib must be at least 32")
+	case memBudgetMiB < 0:
+		return fmt.Errorf("mem-budget-mib must not be negative")
+	case maxScratchMiB < 1:
+		return fmt.Errorf("max-scratch-mib must be positive")
+	case termGrace < 0:
+		return fmt.Errorf("term-grace must not be negative")
+	case guestHeartbeat != 0 && guestHeartbeat < 100*time.Millisecond:
+		return fmt.Errorf("guest-heartbeat must be 0 or at least 100ms")
+	case admissionTimeout < 0:
+		return fmt.Errorf("admission-timeout must not be negative")
+	case maxRuns < 0:
+		return fmt.Errorf("max-runs must not be negative")
+	case breakerFailurePct < 0 || breakerFailurePct > 100:
+		return fmt.Errorf("breaker-failure-pct must be between 0 and 100")
+	case breakerWindow < 1:
+		return fmt.Errorf("breaker-window must be positive")
+	case breakerCooldown <= 0:
+		return fmt.Errorf("breaker-cooldown must be positive")
+	case overlayMiB < 1:
+		return fmt.Errorf("overlay-mib must be positive")
+	case maxTimeoutMs <= 0:
+		return fmt.Errorf("max-timeout-ms must be positive")
+	case maxBodyBytes <= 0:
+		return fmt.Errorf("max-body-bytes must be positive")
+	case !filepath.IsAbs(runBaseDir):
+		return fmt.Errorf("run-dir must be an absolute path")
+	}
+	return nil
+}
 
-	go func() {
-		stdout, exitCode, waitErr = waitForGuestCompletion(time.Duration(timeoutMs) * time.Millisecond)
-		close(done)
-	}()
+// logEffectiveConfig logs every setting, however it was arrived at, and
+// the registered images.
+func logEffectiveConfig(fs *flag.FlagSet) {
+	var b strings.Builder
+	b.WriteString("effective configuration:")
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(&b, "\n  %s = %s", f.Name, value)
+	})
 
-	timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
-	defer timer.Stop()
+	names := make([]string, 0, len(imageProfiles))
+	for name := range imageProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := imageProfiles[name]
+		fmt.Fprintf(&b, "\n  image %s: kernel %s, rootfs %s, init %s (%s)", name, p.KernelPath, p.RootfsPath, p.InitPath, p.CmdTransport)
+	}
+	log.Print(b.String())
+}
 
-	select {
-	case <-done:
-		timer.Stop()
-		if fc.Process != nil {
-			_ = fc.Process.Kill()
+/* ---------------- main ---------------- */
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "guest-exec":
+			guestExec(os.Args[2:])
+			return
+		case "build-rootfs":
+			buildRootfsCommand(os.Args[2:])
+			return
+		case "replay":
+			replayCommand(os.Args[2:])
+			return
 		}
-		_ = fc.Wait()
+	}
 
-		stderr := ""
-		if waitErr != nil {
-			stderr = waitErr.Error()
+	flag.StringVar(&runBaseDir, "run-dir", envOr("SANDBOXD_RUN_DIR", runBaseDir), "base directory for per-run scratch space: mounts, sockets, consoles (env SANDBOXD_RUN_DIR)")
+	flag.IntVar(&runBaseMinFreeMiB, "run-dir-min-free-mib", runBaseMinFreeMiB, "refuse to start if the run dir has less free space than this")
+	flag.BoolVar(&redactCommands, "redact-commands", false, "hide commands in /executions")
+	flag.BoolVar(&strictJSON, "strict-json", strictJSON, "reject /run bodies with unknown fields (the "+strictHeader+" header overrides it per request)")
+	flag.StringVar(&callbackSecret, "callback-secret", envOr("SANDBOXD_CALLBACK_SECRET", ""), "shared secret for signing callback_url deliveries (env SANDBOXD_CALLBACK_SECRET)")
+	flag.IntVar(&timeoutExitCode, "timeout-exit-code", envIntOr("SANDBOXD_TIMEOUT_EXIT_CODE", timeoutExitCode), "exit_code reported for timed-out runs (env SANDBOXD_TIMEOUT_EXIT_CODE)")
+	flag.StringVar(&timeoutMessage, "timeout-message", envOr("SANDBOXD_TIMEOUT_MESSAGE", timeoutMessage), "stderr reported for timed-out runs (env SANDBOXD_TIMEOUT_MESSAGE)")
+	flag.DurationVar(&initTimeout, "init-timeout", initTimeout, "how long a booted guest gets to start init before the run fails with AGENT_TIMEOUT")
+	flag.IntVar(&maxScratchMiB, "max-scratch-mib", maxScratchMiB, "largest scratch_mib a request may ask for")
+	flag.DurationVar(&termGrace, "term-grace", termGrace, "on timeout, SIGTERM the command and wait this long before killing the VM (0 kills at once)")
+	flag.DurationVar(&guestHeartbeat, "guest-heartbeat", guestHeartbeat, "how often the guest reports it is alive while the command runs; a run that misses 3 in a row is stopped (0 disables)")
+	flag.IntVar(&maxTimeoutMs, "max-timeout-ms", maxTimeoutMs, "largest timeout_ms a request may ask for")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "largest /run request body accepted, multipart uploads included")
+	flag.Int64Var(&maxFetchBytes, "max-fetch-bytes", maxFetchBytes, "largest file fetch_files may download")
+	flag.IntVar(&mountRetries, "mount-retries", mountRetries, "retries for loop mounts that find no free loop device")
+	flag.DurationVar(&mountBackoff, "mount-backoff", mountBackoff, "initial backoff between loop mount retries (doubles each attempt)")
+	flag.BoolVar(&allowKeepAlive, "debug-keep-alive", false, "honor keep_alive_on_failure (debugging only)")
+	flag.BoolVar(&allowExtraBootArgs, "allow-extra-boot-args", false, "honor extra_boot_args (trusted clients only)")
+	flag.BoolVar(&allowFetchFiles, "allow-fetch-files", false, "honor fetch_files")
+	flag.BoolVar(&allowFetchPrivate, "allow-fetch-private", false, "let fetch_files reach loopback, link-local and private addresses")
+	flag.DurationVar(&idempotencyTTL, "idempotency-ttl", idempotencyTTL, "how long the result of a run with an Idempotency-Key is replayed to retries")
+	flag.IntVar(&maxIdempotencyKeys, "max-idempotency-keys", maxIdempotencyKeys, "how many Idempotency-Key results are remembered at most")
+	flag.DurationVar(&resultTTL, "result-ttl", resultTTL, "how long a finished /run/async result is kept if nobody fetches it")
+	flag.DurationVar(&keepAliveTTL, "keep-alive-ttl", keepAliveTTL, "how long a VM kept by keep_alive_on_failure lives before it is reaped")
+	flag.IntVar(&startRetries, "start-retries", startRetries, "retries for transient firecracker startup failures")
+	flag.DurationVar(&startBackoff, "start-backoff", startBackoff, "initial backoff between firecracker startup retries (doubles each attempt)")
+	staleAge := flag.Duration("stale-age", time.Hour, "on startup, remove run dirs older than this when another instance shares the run dir")
+	imagesPath := flag.String("images", "", "JSON file of additional image profiles")
+	corsOriginList := flag.String("cors-origins", "", "comma-separated origins allowed to call /run and /executions from a browser (CORS is off if empty)")
+	flag.StringVar(&corsMethods, "cors-methods", corsMethods, "Access-Control-Allow-Methods for allowed origins")
+	flag.StringVar(&corsHeaders, "cors-headers", corsHeaders, "Access-Control-Allow-Headers for allowed origins")
+	resultStoreSpec := flag.String("result-store", envOr("SANDBOXD_RESULT_STORE", "memory"), "where /run/async results wait to be fetched: memory or redis://[:password@]host[:port][/db] (env SANDBOXD_RESULT_STORE)")
+	executorName := flag.String("executor", envOr("SANDBOXD_EXECUTOR", executorFirecracker), "run backend: firecracker, gvisor (runsc, no KVM needed), namespace (chroot + namespaces, no KVM needed, weak isolation), fake (host sh, for testing sandboxd only) or auto (env SANDBOXD_EXECUTOR)")
+	flag.StringVar(&runscPath, "runsc", runscPath, "runsc binary for the gvisor executor")
+	prewarm := flag.Bool("prewarm", false, "boot a throwaway VM per image before accepting requests")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", envOr("OTEL_EXPORTER_OTLP_ENDPOINT", ""), "OTLP/HTTP collector to export trace spans to, e.g. http://localhost:4318 (tracing is off if empty)")
+	listenAddr := flag.String("listen", ":7777", "address to serve the API on")
+	flag.StringVar(&defaultImage, "default-image", defaultImage, "image profile used by requests that name none")
+	flag.IntVar(&vmVcpus, "vcpus", vmVcpus, "vCPUs per VM")
+	flag.IntVar(&vmMemMiB, "mem-mib", vmMemMiB, "memory per VM in MiB")
+	flag.IntVar(&memBudgetMiB, "mem-budget-mib", memBudgetMiB, "total guest memory of all running VMs in MiB; runs beyond it wait or get 429 (0 means no limit)")
+	flag.DurationVar(&admissionTimeout, "admission-timeout", admissionTimeout, "how long a run waits for -mem-budget-mib to have room before it gets 429")
+	flag.IntVar(&maxRuns, "max-runs", maxRuns, "shut down after this many runs have finished (0 is no limit)")
+	flag.IntVar(&breakerFailurePct, "breaker-failure-pct", breakerFailurePct, "refuse runs for -breaker-cooldown once this percentage of the last -breaker-window runs failed on the host (0 disables)")
+	flag.IntVar(&breakerWindow, "breaker-window", breakerWindow, "how many recent runs the circuit breaker looks at")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", breakerCooldown, "how long an open circuit breaker refuses runs before letting a probe run through")
+	flag.IntVar(&overlayMiB, "overlay-mib", overlayMiB, "writable space per run on read_only images, in MiB")
+	flag.StringVar(&adminToken, "admin-token", envOr("SANDBOXD_ADMIN_TOKEN", ""), "bearer token for /admin/reload; admin endpoints are off if empty (env SANDBOXD_ADMIN_TOKEN)")
+	recordPath := flag.String("record", "", "append every /run request and its result to this JSONL file (see sandboxd replay)")
+	configPath := flag.String("config", "", "JSON config file of flag settings (keys are flag names) and \"images\"; flags and env override it")
+	flag.Parse()
+
+	if *configPath != "" {
+		reloader = newConfigReloader(flag.CommandLine, *configPath)
+		if err := applyConfigFile(flag.CommandLine, *configPath); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		loaded, err := readConfigFile(*configPath)
+		if err != nil {
+			log.Fatalf("config: %v", err)
 		}
+		reloader.loaded = loaded
+	}
 
-		resp := RunResponse{
-			Stdout:   stdout,
-			Stderr:   stderr,
-			ExitCode: exitCode,
+	if *recordPath != "" {
+		f, err := os.OpenFile(*recordPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("record: %v", err)
 		}
+		recordFile = f
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(resp)
-		return
+	if otlpEndpoint != "" {
+		spanQueue = make(chan *span, 4*spanBatchSize)
+		go exportSpans(otlpEndpoint, spanQueue)
+	}
 
-	case <-timer.C:
-		if fc.Process != nil {
-			_ = fc.Process.Kill()
-		}
-		_ = fc.Wait()
+	parseCORSOrigins(*corsOriginList)
 
-		resp := RunResponse{
-			Stdout:   "",
-			Stderr:   "execution timed out",
-			ExitCode: 124,
+	var err error
+	if executor, err = selectExecutor(*executorName); err != nil {
+		log.Fatal(err)
+	}
+	if resultStore, err = openResultStore(*resultStoreSpec); err != nil {
+		log.Fatal(err)
+	}
+
+	if *imagesPath != "" {
+		if err := loadImageProfiles(*imagesPath); err != nil {
+			log.Fatalf("load images: %v", err)
 		}
+	}
+	if err := validateConfig(*listenAddr); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	logEffectiveConfig(flag.CommandLine)
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(resp)
-		return
+	if missing := missingTools(); len(missing) > 0 {
+		log.Fatalf("required tools not found in PATH: %s", strings.Join(missing, ", "))
 	}
-}
 
-/* ---------------- main ---------------- */
+	if err := checkRunBase(runBaseDir, runBaseMinFreeMiB); err != nil {
+		log.Fatalf("run dir %s: %v", runBaseDir, err)
+	}
+	only, err := lockRunBase(runBaseDir)
+	if err != nil {
+		log.Fatalf("lock %s: %v", runBaseDir, err)
+	}
+	maxAge := *staleAge
+	if only {
+		// Nobody else can own anything under runBaseDir; sweep it all.
+		maxAge = 0
+	}
+	if err := sweepRunDirs(runBaseDir, maxAge); err != nil {
+		log.Printf("cleanup: %v", err)
+	}
 
-func main() {
-	http.HandleFunc("/run", runHandler)
-	log.Println("sandboxd listening on :7777")
-	log.Fatal(http.ListenAndServe(":7777", nil))
+	if *prewarm {
+		for _, res := range prewarmImages(context.Background(), nil) {
+			if res.OK {
+				log.Printf("prewarm %s: ok in %dms", res.Image, res.RunMs)
+			} else {
+				log.Printf("prewarm %s: %s", res.Image, res.Error)
+			}
+		}
+	}
+
+	http.HandleFunc("/run", withCORS(runHandler))
+	http.HandleFunc("/run/async", withCORS(runHandler))
+	http.HandleFunc("/run/result/", withCORS(resultHandler))
+	http.HandleFunc("/session", sessionHandler)
+	http.HandleFunc("/executions", withCORS(executionsHandler))
+	http.HandleFunc("/executions/", executionHandler)
+	http.HandleFunc("/prewarm", prewarmHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/admin/reload", adminReloadHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+
+	srv := &http.Server{Addr: *listenAddr}
+	stopped := make(chan struct{})
+	go func() {
+		<-runsDone
+		log.Printf("all %d runs (-max-runs) are done; waiting for unfetched /run/async results", maxRuns)
+		awaitResults()
+		log.Printf("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(stopped)
+	}()
+	log.Printf("sandboxd listening on %s", *listenAddr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
 }
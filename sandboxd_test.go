@@ -1,13 +1,34 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -37,10 +58,25 @@ func runRequest(t *testing.T, payload any) RunResponse {
 	return resp
 }
 
-func assertStdoutClean(t *testing.T, stdout string) {
+// vmOrFake gates a test that boots a VM: it runs against firecracker when
+// this host can boot one, against the fake executor when
+// SANDBOXD_EXECUTOR=fake, and is skipped otherwise.
+func vmOrFake(t *testing.T) {
+	t.Helper()
+	if os.Getenv("SANDBOXD_EXECUTOR") == executorFake {
+		old := executor
+		executor = fakeShellExecutor{}
+		t.Cleanup(func() { executor = old })
+		return
+	}
+	skipWithoutFirecracker(t)
+}
+
+func assertStdoutClean(t *testing.T, resp RunResponse) {
 	t.Helper()
 
-	data, err := os.ReadFile(fcLog)
+	// Needs a debug run: otherwise the run dir (and its log) is already gone.
+	data, err := os.ReadFile(fcLogPath(runBaseDir + "/" + resp.ExecID))
 	if err != nil {
 		if os.IsNotExist(err) {
 			t.Skip("firecracker log missing; cannot assert separation")
@@ -59,16 +95,18 @@ func assertStdoutClean(t *testing.T, stdout string) {
 		if line == "" {
 			continue
 		}
-		if strings.Contains(stdout, line) {
+		if strings.Contains(resp.Stdout, line) {
 			t.Fatalf("stdout contains firecracker log line: %q", line)
 		}
 	}
 }
 
 func TestSimpleEcho(t *testing.T) {
+	vmOrFake(t)
 	resp := runRequest(t, map[string]any{
 		"cmd":        "echo hi",
 		"timeout_ms": 2000,
+		"debug":      true,
 	})
 
 	if resp.ExitCode != 0 {
@@ -80,10 +118,11 @@ func TestSimpleEcho(t *testing.T) {
 	if !strings.Contains(resp.Stdout, "hi") {
 		t.Fatalf("expected stdout to contain %q, got %q", "hi", resp.Stdout)
 	}
-	assertStdoutClean(t, resp.Stdout)
+	assertStdoutClean(t, resp)
 }
 
 func TestBoundaryTimeout(t *testing.T) {
+	vmOrFake(t)
 	resp := runRequest(t, map[string]any{
 		"cmd":        "sleep 1",
 		"timeout_ms": 1500,
@@ -98,6 +137,7 @@ func TestBoundaryTimeout(t *testing.T) {
 }
 
 func TestHardTimeout(t *testing.T) {
+	vmOrFake(t)
 	start := time.Now()
 
 	resp := runRequest(t, map[string]any{
@@ -118,6 +158,7 @@ func TestHardTimeout(t *testing.T) {
 }
 
 func TestFileInjection(t *testing.T) {
+	vmOrFake(t)
 	resp := runRequest(t, map[string]any{
 		"cmd": "sh main.sh",
 		"files": map[string]string{
@@ -138,6 +179,7 @@ func TestFileInjection(t *testing.T) {
 }
 
 func TestFileInjectionTimeout(t *testing.T) {
+	vmOrFake(t)
 	resp := runRequest(t, map[string]any{
 		"cmd": "sh main.sh",
 		"files": map[string]string{
@@ -153,3 +195,3781 @@ func TestFileInjectionTimeout(t *testing.T) {
 		t.Fatalf("expected timeout stderr, got %q", resp.Stderr)
 	}
 }
+
+func TestSymlinkEscapeRejected(t *testing.T) {
+	workDir := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.Symlink(outside, workDir+"/evil"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink(outside+"/target", workDir+"/link.sh"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	for _, name := range []string{"evil/pwned.sh", "link.sh"} {
+		targetPath, err := resolveWorkPath(workDir, name)
+		if err != nil {
+			t.Fatalf("resolveWorkPath(%q): %v", name, err)
+		}
+		if err := checkNoSymlinks(workDir, targetPath); err == nil {
+			t.Fatalf("expected symlink escape via %q to be rejected", name)
+		}
+	}
+
+	if err := writeFileNoFollow(workDir+"/link.sh", []byte("echo pwned"), 0o644); err == nil {
+		t.Fatalf("expected O_NOFOLLOW write through symlink to fail")
+	}
+
+	if _, err := os.Stat(outside + "/target"); !os.IsNotExist(err) {
+		t.Fatalf("write escaped work dir through symlink")
+	}
+
+	targetPath, err := resolveWorkPath(workDir, "ok.sh")
+	if err != nil {
+		t.Fatalf("resolveWorkPath: %v", err)
+	}
+	if err := checkNoSymlinks(workDir, targetPath); err != nil {
+		t.Fatalf("expected plain path to be accepted, got %v", err)
+	}
+}
+
+func TestExecutionsListAndKill(t *testing.T) {
+	killed := false
+	registerExecution("abc123", "echo secret", func() { killed = true })
+	defer unregisterExecution("abc123")
+
+	rr := httptest.NewRecorder()
+	executionsHandler(rr, httptest.NewRequest(http.MethodGet, "/executions", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d body=%s", rr.Code, rr.Body.String())
+	}
+	var list []executionInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(list) != 1 || list[0].ExecID != "abc123" || list[0].Cmd != "echo secret" {
+		t.Fatalf("unexpected executions: %+v", list)
+	}
+
+	rr = httptest.NewRecorder()
+	executionHandler(rr, httptest.NewRequest(http.MethodDelete, "/executions/abc123", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d body=%s", rr.Code, rr.Body.String())
+	}
+	if !killed {
+		t.Fatalf("expected execution to be cancelled")
+	}
+
+	rr = httptest.NewRecorder()
+	executionHandler(rr, httptest.NewRequest(http.MethodDelete, "/executions/missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown execution, got %d", rr.Code)
+	}
+}
+
+func TestKillResponse(t *testing.T) {
+	vmOrFake(t)
+	const cmd = "echo started; sleep 30"
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "`+cmd+`", "timeout_ms": 60000}`)))
+		done <- rr
+	}()
+
+	var execID string
+	for deadline := time.Now().Add(10 * time.Second); execID == ""; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("run never showed up in /executions")
+		}
+		for _, e := range listExecutions() {
+			if e.Cmd == cmd {
+				execID = e.ExecID
+			}
+		}
+	}
+	// Let the command print before it is killed; a kill drops it anyway.
+	time.Sleep(500 * time.Millisecond)
+	rr := httptest.NewRecorder()
+	executionHandler(rr, httptest.NewRequest(http.MethodDelete, "/executions/"+execID, nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", rr.Code, rr.Body)
+	}
+
+	rr = <-done
+	var resp RunResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("%d %s", rr.Code, rr.Body)
+	}
+	if resp.ExitCode != 137 || resp.ExitReason != exitReasonKilled || resp.Stdout != "" || resp.Stderr != "execution killed" {
+		t.Fatalf("got %+v", resp)
+	}
+}
+
+func TestFailOnNonzeroStatus(t *testing.T) {
+	cases := []struct {
+		failOnNonzero bool
+		exitCode      int
+		want          int
+	}{
+		{false, 1, http.StatusOK},
+		{true, 0, http.StatusOK},
+		{true, 1, http.StatusUnprocessableEntity},
+		{true, 124, http.StatusGatewayTimeout},
+	}
+
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/run", nil)
+		writeRunResponse(rr, req, RunRequest{FailOnNonzero: c.failOnNonzero}, RunResponse{ExitCode: c.exitCode})
+		if rr.Code != c.want {
+			t.Fatalf("fail_on_nonzero=%v exit_code=%d: expected status %d, got %d",
+				c.failOnNonzero, c.exitCode, c.want, rr.Code)
+		}
+		var resp RunResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.ExitCode != c.exitCode {
+			t.Fatalf("expected body with exit_code %d, got %s", c.exitCode, rr.Body.String())
+		}
+	}
+}
+
+func TestExtractRusage(t *testing.T) {
+	text := "[guest] init started\nhi\n[guest] rusage: 1234 0.01 0.02 3 456\n[guest] exit code: 0\n"
+
+	ru, stdout := extractRusage(text)
+	if ru == nil {
+		t.Fatalf("expected rusage to be parsed")
+	}
+	if ru.MaxRSSKB != 1234 || ru.UserSec != 0.01 || ru.SystemSec != 0.02 || ru.MajorFaults != 3 || ru.MinorFaults != 456 {
+		t.Fatalf("unexpected rusage: %+v", ru)
+	}
+	if strings.Contains(stdout, rusageMarker) {
+		t.Fatalf("expected rusage marker stripped from stdout, got %q", stdout)
+	}
+	if !strings.Contains(stdout, "hi") {
+		t.Fatalf("expected stdout preserved, got %q", stdout)
+	}
+
+	if ru, _ := extractRusage("[guest] init started\nhi\n"); ru != nil {
+		t.Fatalf("expected nil rusage when time(1) is missing, got %+v", ru)
+	}
+}
+
+func TestSweepRunDirs(t *testing.T) {
+	base := t.TempDir()
+	for _, name := range []string{"old", "fresh"} {
+		if err := os.MkdirAll(base+"/"+name+"/rootfs", 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(base+"/old", past, past); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	if err := sweepRunDirs(base, time.Hour); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if _, err := os.Stat(base + "/old"); !os.IsNotExist(err) {
+		t.Fatalf("expected stale run dir to be removed")
+	}
+	if _, err := os.Stat(base + "/fresh"); err != nil {
+		t.Fatalf("expected fresh run dir to be kept: %v", err)
+	}
+
+	if err := sweepRunDirs(base, 0); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if _, err := os.Stat(base + "/fresh"); !os.IsNotExist(err) {
+		t.Fatalf("expected maxAge 0 to remove every run dir")
+	}
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := wsUpgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := ws.readMessage()
+		if err != nil {
+			ws.close(1011, err.Error())
+			return
+		}
+		_ = ws.writeFrame(wsOpText, msg)
+		ws.close(1000, "bye")
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	handshake := "GET /session HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("write handshake: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	// Accept value from the RFC 6455 example.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected Sec-WebSocket-Accept %q", got)
+	}
+
+	payload := []byte("echo hi")
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | wsOpText, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+
+	client := &wsConn{conn: conn, br: br}
+	msg, err := client.readMessage()
+	if err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(msg) != "echo hi" {
+		t.Fatalf("expected echo %q, got %q", "echo hi", msg)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	// {"cmd": "sh main.sh", "timeout_ms": 2000, "files": {"main.sh": bin("echo ok")}}
+	body := []byte{0x83,
+		0xa3, 'c', 'm', 'd', 0xaa, 's', 'h', ' ', 'm', 'a', 'i', 'n', '.', 's', 'h',
+		0xaa, 't', 'i', 'm', 'e', 'o', 'u', 't', '_', 'm', 's', 0xcd, 0x07, 0xd0,
+		0xa5, 'f', 'i', 'l', 'e', 's', 0x81,
+		0xa7, 'm', 'a', 'i', 'n', '.', 's', 'h', 0xc4, 0x07, 'e', 'c', 'h', 'o', ' ', 'o', 'k',
+	}
+
+	var req RunRequest
+	if err := decodeMsgpackRequest(bytes.NewReader(body), &req, false); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if req.Cmd != "sh main.sh" || req.TimeoutMs != 2000 || req.Files["main.sh"].Content != "echo ok" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	// {"cmd": "cat blob", "stdin": bin(ff fe 80), "files": {"blob": {"content": bin(ff fe 00 c3 28), "mode": "0600"}}}
+	binary := []byte{0x83,
+		0xa3, 'c', 'm', 'd', 0xa8, 'c', 'a', 't', ' ', 'b', 'l', 'o', 'b',
+		0xa5, 's', 't', 'd', 'i', 'n', 0xc4, 0x03, 0xff, 0xfe, 0x80,
+		0xa5, 'f', 'i', 'l', 'e', 's', 0x81,
+		0xa4, 'b', 'l', 'o', 'b', 0x82,
+		0xa7, 'c', 'o', 'n', 't', 'e', 'n', 't', 0xc4, 0x05, 0xff, 0xfe, 0x00, 0xc3, 0x28,
+		0xa4, 'm', 'o', 'd', 'e', 0xa4, '0', '6', '0', '0',
+	}
+	var breq RunRequest
+	if err := decodeMsgpackRequest(bytes.NewReader(binary), &breq, true); err != nil {
+		t.Fatalf("decode binary: %v", err)
+	}
+	if f := breq.Files["blob"]; f.Content != "\xff\xfe\x00\xc3\x28" || f.Mode != "0600" || breq.Stdin != "\xff\xfe\x80" {
+		t.Fatalf("binary contents not kept byte for byte: %+v", breq)
+	}
+
+	if err := decodeMsgpackRequest(bytes.NewReader(body[:10]), &req, false); err == nil {
+		t.Fatalf("expected truncated msgpack to be rejected")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/run", nil)
+	r.Header.Set("Accept", "application/msgpack")
+	rr := httptest.NewRecorder()
+	writeRunResponse(rr, r, req, RunResponse{Stdout: "ok\n", ExitCode: -3})
+	if ct := rr.Header().Get("Content-Type"); ct != msgpackContentType {
+		t.Fatalf("expected msgpack content type, got %q", ct)
+	}
+
+	d := &msgpackDecoder{data: rr.Body.Bytes()}
+	v, err := d.decode(0)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok || m["stdout"] != "ok\n" || m["exit_code"] != int64(-3) {
+		t.Fatalf("unexpected response: %#v", v)
+	}
+}
+
+func TestCallbackDeliveryRetriesAndSigns(t *testing.T) {
+	oldSecret, oldBackoff := callbackSecret, callbackBackoff
+	callbackSecret, callbackBackoff = "s3cret", time.Millisecond
+	defer func() { callbackSecret, callbackBackoff = oldSecret, oldBackoff }()
+
+	attempts := 0
+	var got callbackPayload
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		signature = r.Header.Get("X-Sandboxd-Signature")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	deliverCallback("abc123", srv.URL, RunResponse{Stdout: "hi", ExitCode: 3}, nil)
+
+	if attempts != 2 {
+		t.Fatalf("expected 2 delivery attempts, got %d", attempts)
+	}
+	if got.ExecID != "abc123" || got.Result == nil || got.Result.ExitCode != 3 {
+		t.Fatalf("unexpected payload: %+v", got)
+	}
+	body, _ := json.Marshal(got)
+	if signature != signCallback(body) {
+		t.Fatalf("unexpected signature %q", signature)
+	}
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	cases := []struct {
+		method string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed, errMethodNotAllowed},
+		{http.MethodPost, "{", http.StatusBadRequest, errValidation},
+		{http.MethodPost, `{"cmd": ""}`, http.StatusBadRequest, errValidation},
+	}
+
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		runHandler(rr, httptest.NewRequest(c.method, "/run", strings.NewReader(c.body)))
+		if rr.Code != c.status {
+			t.Fatalf("%s %q: expected status %d, got %d", c.method, c.body, c.status, rr.Code)
+		}
+		var body struct {
+			Error errorBody `json:"error"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("unmarshal error body: %v\nbody=%s", err, rr.Body.String())
+		}
+		if body.Error.Code != c.code || body.Error.Message == "" {
+			t.Fatalf("%s %q: expected code %s, got %+v", c.method, c.body, c.code, body.Error)
+		}
+	}
+}
+
+func TestImageProfiles(t *testing.T) {
+	path := t.TempDir() + "/images.json"
+	data := `{
+		"custom": {"kernel_path": "/k", "rootfs_path": "/r", "init_path": "/init", "cmd_transport": "arg"},
+		"fileinit": {"kernel_path": "/k", "rootfs_path": "/r", "cmd_transport": "file"}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := loadImageProfiles(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer delete(imageProfiles, "custom")
+	defer delete(imageProfiles, "fileinit")
+
+	custom, err := lookupImage("custom")
+	if err != nil {
+		t.Fatalf("lookup: %v", err)
+	}
+	if got := custom.bootArgs(); !strings.Contains(got, "init=/init -- sh "+guestRunScript) {
+		t.Fatalf("unexpected arg transport boot args: %q", got)
+	}
+
+	fileinit, _ := lookupImage("fileinit")
+	if got := fileinit.bootArgs(); !strings.HasSuffix(got, "init=/sbin/init") {
+		t.Fatalf("unexpected file transport boot args: %q", got)
+	}
+
+	def, _ := lookupImage("")
+	if got := def.bootArgs(); !strings.Contains(got, `CMD="sh `+guestRunScript+`"`) {
+		t.Fatalf("unexpected default boot args: %q", got)
+	}
+
+	if _, err := lookupImage("missing"); err == nil {
+		t.Fatalf("expected unknown image to be rejected")
+	}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	meta, _ := mw.CreateFormField("metadata")
+	_, _ = meta.Write([]byte(`{"cmd": "sh src/main.sh", "timeout_ms": 1000}`))
+	f, _ := mw.CreateFormFile("file", "src/main.sh")
+	_, _ = f.Write([]byte("#!/bin/sh\necho ok\n"))
+	f, _ = mw.CreateFormFile("file", "data.txt")
+	_, _ = f.Write([]byte("plain"))
+	_ = mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/run", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var req RunRequest
+	if err := decodeMultipartRequest(r, &req); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if req.Cmd != "sh src/main.sh" || req.TimeoutMs != 1000 {
+		t.Fatalf("unexpected metadata: %+v", req)
+	}
+
+	workDir := t.TempDir()
+	if err := writeUploads(workDir, req.uploads); err != nil {
+		t.Fatalf("write uploads: %v", err)
+	}
+	fi, err := os.Stat(workDir + "/src/main.sh")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0o755 {
+		t.Fatalf("expected shebang file to be executable, got %v", fi.Mode())
+	}
+	if data, _ := os.ReadFile(workDir + "/data.txt"); string(data) != "plain" {
+		t.Fatalf("unexpected data.txt contents %q", data)
+	}
+
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	f, _ = mw.CreateFormFile("file", "../escape.sh")
+	_, _ = f.Write([]byte("echo nope"))
+	_ = mw.Close()
+	mr := multipart.NewReader(&body, mw.Boundary())
+	if err := writeUploads(workDir, mr); err == nil {
+		t.Fatalf("expected traversal in part filename to be rejected")
+	}
+}
+
+func TestPlainTextRequest(t *testing.T) {
+	script := "echo \"quoted\" 'args'\nls /work\n"
+	r := httptest.NewRequest(http.MethodPost, "/run?timeout_ms=1500", strings.NewReader(script))
+	r.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	req, err := decodeRunRequest(r)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if req.Cmd != script || req.TimeoutMs != 1500 {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/run?timeout_ms=soon", strings.NewReader(script))
+	r.Header.Set("Content-Type", "text/plain")
+	if _, err := decodeRunRequest(r); err == nil {
+		t.Fatalf("expected invalid timeout_ms to be rejected")
+	}
+}
+
+func TestOutputsTarResponse(t *testing.T) {
+	workDir := t.TempDir()
+	if err := os.MkdirAll(workDir+"/out", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	_ = os.WriteFile(workDir+"/out/a.txt", []byte("aaa"), 0o644)
+	_ = os.WriteFile(workDir+"/out/b.txt", []byte("bbbb"), 0o644)
+	_ = os.Symlink("/etc/passwd", workDir+"/out/c.txt")
+
+	outputs, truncated := readOutputs(workDir, []string{"out/*.txt"}, 5)
+	if !truncated {
+		t.Fatalf("expected outputs beyond the limit to be truncated")
+	}
+	if string(outputs["out/a.txt"]) != "aaa" || len(outputs) != 1 {
+		t.Fatalf("unexpected outputs: %v", outputs)
+	}
+
+	outputs, _ = readOutputs(workDir, []string{"out/*.txt"}, maxOutputBytes)
+	if _, ok := outputs["out/c.txt"]; ok {
+		t.Fatalf("expected symlinked output to be skipped")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/run", nil)
+	r.Header.Set("Accept", "application/x-tar")
+	rr := httptest.NewRecorder()
+	writeRunResponse(rr, r, RunRequest{}, RunResponse{Stdout: "done", Outputs: outputs})
+
+	tr := tar.NewReader(rr.Body)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != tarManifestName {
+		t.Fatalf("expected manifest first, got %v %v", hdr, err)
+	}
+	var manifest RunResponse
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil || manifest.Stdout != "done" || manifest.Outputs != nil {
+		t.Fatalf("unexpected manifest: %+v %v", manifest, err)
+	}
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "out/a.txt,out/b.txt" {
+		t.Fatalf("unexpected tar entries: %v", names)
+	}
+
+	if err := validateOutputGlob("../*"); err == nil {
+		t.Fatalf("expected traversal glob to be rejected")
+	}
+}
+
+// TestSeccompProfiles re-runs the test binary as a child that installs each
+// profile and probes what it blocks.
+func TestSeccompProfiles(t *testing.T) {
+	if profile := os.Getenv("SANDBOXD_SECCOMP_CHILD"); profile != "" {
+		seccompChild(profile)
+		return
+	}
+
+	for _, profile := range []string{seccompDefault, seccompStrict} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSeccompProfiles$")
+		cmd.Env = append(os.Environ(), "SANDBOXD_SECCOMP_CHILD="+profile)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("%s: %v\n%s", profile, err, out)
+		}
+	}
+
+	if _, err := seccompProfileName("bogus"); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("unknown profile: got %v", err)
+	}
+	script := buildGuestScript(RunRequest{Cmd: "true", Seccomp: seccompStrict})
+	if !strings.Contains(script, guestHelper+" guest-exec -seccomp strict -- sh "+guestCmdScript) {
+		t.Fatalf("wrapper does not use the helper:\n%s", script)
+	}
+}
+
+func seccompChild(profile string) {
+	if err := installSeccomp(profile); err != nil {
+		// Kernels without seccomp (or sandboxes forbidding it) cannot run this.
+		os.Exit(0)
+	}
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+		os.Exit(1)
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PTRACE, syscall.PTRACE_PEEKDATA, 1, 0); errno != syscall.EPERM {
+		fail("ptrace: got %v, want EPERM", errno)
+	}
+	if err := syscall.Mount("none", "/nonexistent", "tmpfs", 0, ""); err != syscall.EPERM {
+		fail("mount: got %v, want EPERM", err)
+	}
+	if _, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_ICMP); err != syscall.EPERM {
+		fail("raw socket: got %v, want EPERM", err)
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		fail("unix socket: %v", err)
+	}
+	syscall.Close(fd)
+
+	fd, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	switch {
+	case profile == seccompStrict && err != syscall.EPERM:
+		fail("strict tcp socket: got %v, want EPERM", err)
+	case profile == seccompDefault && err != nil:
+		fail("default tcp socket: %v", err)
+	}
+	if err == nil {
+		syscall.Close(fd)
+	}
+	os.Exit(0)
+}
+
+func TestKernelPanicDetected(t *testing.T) {
+	consolePath := t.TempDir() + "/console.log"
+	console := "[    0.41] VFS: Cannot open root device \"vda\"\r\n" +
+		"[    0.42] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)\r\n" +
+		"[    0.42] ---[ end Kernel panic ]---\r\n"
+	if err := os.WriteFile(consolePath, []byte(console), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := waitForGuestInitStarted(context.Background(), consolePath, 5*time.Second)
+	if body := errorBodyFor(err); body.Code != errKernelPanic ||
+		!strings.Contains(body.Message, "Unable to mount root fs on unknown-block(0,0)") {
+		t.Fatalf("init wait: got %+v", body)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("panic was not detected promptly")
+	}
+
+	_, _, err = waitForGuestCompletion(context.Background(), consolePath, 5*time.Second, 0, nil)
+	if errorBodyFor(err).Code != errKernelPanic {
+		t.Fatalf("completion wait: got %v", err)
+	}
+
+	// A running command printing the signature is not a panic.
+	console = "[guest] init started\n" +
+		"Kernel panic - not syncing: from the command\n" +
+		"log: [    1.00] Kernel panic - not syncing: quoted\n"
+	if err := os.WriteFile(consolePath, []byte(console), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := waitForGuestCompletion(context.Background(), consolePath, 200*time.Millisecond, 0, nil); !errors.Is(err, errCompletionTimeout) {
+		t.Fatalf("command output taken for a panic: %v", err)
+	}
+	for _, text := range []string{"Kernel panic - not syncing: x\n", "echo '[ 1.0] Kernel panic - not syncing: x'\n"} {
+		if err := kernelPanicError(text); err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+	}
+
+	vmOrFake(t)
+	resp := runRequest(t, map[string]any{"cmd": "echo 'Kernel panic - not syncing: not really'; sleep 0.2; echo after"})
+	if resp.ExitCode != 0 || !strings.Contains(resp.Stdout, "after") {
+		t.Fatalf("got %+v", resp)
+	}
+}
+
+func TestFileSpecModes(t *testing.T) {
+	var req RunRequest
+	body := `{"cmd": "true", "files": {
+		"plain.sh": "#!/bin/sh\n",
+		"data.txt": {"content": "#!not a script"},
+		"tool": {"content": "\u007fELF", "executable": true},
+		"secret": {"content": "x", "mode": "0600", "executable": true}
+	}}`
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	workDir := t.TempDir()
+	for name, file := range req.Files {
+		mode, err := file.fileMode()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := writeWorkFile(workDir, name, strings.NewReader(file.Content), mode); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// data.txt is an explicit object without a mode, so the shebang
+	// heuristic still applies; only mode/executable override it.
+	want := map[string]os.FileMode{"plain.sh": 0o755, "data.txt": 0o755, "tool": 0o755, "secret": 0o600}
+	for name, perm := range want {
+		info, err := os.Stat(workDir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Fatalf("%s: expected %o, got %o", name, perm, info.Mode().Perm())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run",
+		strings.NewReader(`{"cmd": "true", "files": {"a": {"content": "", "mode": "rwx"}}}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad mode: expected 400, got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTimeoutBounds(t *testing.T) {
+	cases := []struct {
+		timeoutMs int
+		ok        bool
+	}{
+		{0, true},
+		{1, true},
+		{maxTimeoutMs, true},
+		{-1, false},
+		{maxTimeoutMs + 1, false},
+		{math.MaxInt, false},
+	}
+	for _, c := range cases {
+		if err := validateTimeout(c.timeoutMs); (err == nil) != c.ok {
+			t.Fatalf("validateTimeout(%d) = %v", c.timeoutMs, err)
+		}
+	}
+
+	if got := execTimeout(0); got != 5*time.Second {
+		t.Fatalf("default timeout: got %v", got)
+	}
+	if got := execTimeout(math.MaxInt); got <= 0 {
+		t.Fatalf("execTimeout overflowed: %v", got)
+	}
+
+	for _, body := range []string{`{"cmd": "true", "timeout_ms": -5}`, `{"cmd": "true", "timeout_ms": 9223372036854775807}`} {
+		rr := httptest.NewRecorder()
+		runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", body, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestPrewarmReportsFailures(t *testing.T) {
+	imageProfiles["missing"] = imageProfile{
+		KernelPath:   t.TempDir() + "/vmlinux",
+		RootfsPath:   t.TempDir() + "/rootfs.ext4",
+		InitPath:     "/sbin/init",
+		CmdTransport: cmdTransportEnv,
+	}
+	defer delete(imageProfiles, "missing")
+
+	rr := httptest.NewRecorder()
+	prewarmHandler(rr, httptest.NewRequest(http.MethodPost, "/prewarm?image=missing&image=nope", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var results []prewarmResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(results) != 2 || results[0].Image != "missing" || results[0].OK ||
+		!strings.Contains(results[0].Error, "vmlinux") || !strings.Contains(results[1].Error, "unknown image") {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	rr = httptest.NewRecorder()
+	prewarmHandler(rr, httptest.NewRequest(http.MethodGet, "/prewarm", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: expected 405, got %d", rr.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	h := withCORS(executionsHandler)
+
+	// Off by default.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/executions", nil)
+	req.Header.Set("Origin", "https://play.example")
+	h(rr, req)
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("CORS headers sent while disabled")
+	}
+
+	parseCORSOrigins("https://play.example/, https://other.example")
+	defer func() { corsOrigins = map[string]bool{} }()
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodOptions, "/run", nil)
+	req.Header.Set("Origin", "https://play.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	withCORS(runHandler)(rr, req)
+	if rr.Code != http.StatusNoContent ||
+		rr.Header().Get("Access-Control-Allow-Origin") != "https://play.example" ||
+		rr.Header().Get("Access-Control-Allow-Methods") != corsMethods {
+		t.Fatalf("preflight: status %d headers %v", rr.Code, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/executions", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	h(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed origin: status %d headers %v", rr.Code, rr.Header())
+	}
+}
+
+func TestFakeTimeSpec(t *testing.T) {
+	cases := map[string]string{
+		"":                          "",
+		"+2d":                       "+2d",
+		"-90m":                      "-90m",
+		"2020-02-29 12:00:00":       "@2020-02-29 12:00:00",
+		"2020-02-29T12:00:00+02:00": "@2020-02-29 10:00:00",
+	}
+	for in, want := range cases {
+		got, err := fakeTimeSpec(in)
+		if err != nil || got != want {
+			t.Fatalf("fakeTimeSpec(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"+", "+2w", "-1.5h", "tomorrow", "2020-02-29'; rm -rf /"} {
+		if _, err := fakeTimeSpec(bad); err == nil {
+			t.Fatalf("fakeTimeSpec(%q) accepted", bad)
+		}
+	}
+
+	script := buildGuestScript(RunRequest{Cmd: "date", FakeTime: "+1y"})
+	if !strings.Contains(script, "FAKETIME='+1y'") {
+		t.Fatalf("wrapper does not set FAKETIME:\n%s", script)
+	}
+}
+
+func TestMountToolDiagnostics(t *testing.T) {
+	err := runMountTool("sh", "-c", "echo 'mount: /mnt: failed to setup loop device for /img.ext4.' >&2; exit 32")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "exit status 32") || !strings.Contains(msg, "failed to setup loop device for /img.ext4.") ||
+		!strings.Contains(msg, "hint: no free loop devices") {
+		t.Fatalf("unexpected error: %s", msg)
+	}
+
+	err = runMountTool("sh", "-c", "echo 'mount: only root can use \"--options\" option (effective UID is 1000)' >&2; echo 'Permission denied' >&2; exit 1")
+	if err == nil || !strings.Contains(err.Error(), "CAP_SYS_ADMIN") {
+		t.Fatalf("expected a privilege hint, got %v", err)
+	}
+
+	if err := runMountTool("true"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMountImageRetriesLoopExhaustion(t *testing.T) {
+	bin := t.TempDir()
+	counter := bin + "/calls"
+	// Fails twice for lack of loop devices, then succeeds.
+	script := "#!/bin/sh\necho x >> " + counter + "\n" +
+		"[ $(wc -l < " + counter + ") -gt 2 ] && exit 0\n" +
+		"echo 'mount: /mnt: failed to setup loop device for /img.' >&2\nexit 32\n"
+	if err := os.WriteFile(bin+"/mount", []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	oldRetries, oldBackoff := mountRetries, mountBackoff
+	defer func() { mountRetries, mountBackoff = oldRetries, oldBackoff }()
+	mountBackoff = time.Millisecond
+
+	ctx := context.Background()
+	mountRetries = 1
+	if err := mountImage(ctx, "/img", "/mnt", "ro"); err == nil {
+		t.Fatal("expected failure with a single retry")
+	}
+
+	os.Remove(counter)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := mountImage(cancelled, "/img", "/mnt", "ro"); err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Fatalf("expected a done ctx to stop the retries, got %v", err)
+	}
+
+	os.Remove(counter)
+	mountRetries = 3
+	if err := mountImage(ctx, "/img", "/mnt", "ro"); err != nil {
+		t.Fatalf("expected success after retries: %v", err)
+	}
+	data, _ := os.ReadFile(counter)
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Fatalf("expected 3 mount attempts, got %d", n)
+	}
+}
+
+func TestKeepVMReaped(t *testing.T) {
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run",
+		strings.NewReader(`{"cmd": "true", "keep_alive_on_failure": true}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without -debug-keep-alive, got %d", rr.Code)
+	}
+
+	oldTTL := keepAliveTTL
+	defer func() { keepAliveTTL = oldTTL }()
+	keepAliveTTL = 50 * time.Millisecond
+
+	runDir := t.TempDir() + "/run"
+	if err := os.Mkdir(runDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fc := exec.Command("sleep", "60")
+	if err := fc.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := keepVM("test", fc, runDir, runDir+"/fc-0.sock", runDir+"/console.log", nil)
+	if kept.PID != fc.Process.Pid || kept.LogPath != fcLogPath(runDir) {
+		t.Fatalf("unexpected kept VM: %+v", kept)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(runDir); os.IsNotExist(err) {
+			if err := syscall.Kill(kept.PID, 0); err != syscall.ESRCH {
+				t.Fatalf("process still around after reaping: %v", err)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("kept VM was not reaped")
+}
+
+func TestSelectExecutor(t *testing.T) {
+	if e, err := selectExecutor(executorNamespace); err != nil || e != (namespaceExecutor{}) {
+		t.Fatalf("namespace: got %T, %v", e, err)
+	}
+	if e, err := selectExecutor(executorFirecracker); err != nil || e != (firecrackerExecutor{}) {
+		t.Fatalf("firecracker: got %T, %v", e, err)
+	}
+	if e, err := selectExecutor(executorGVisor); err != nil || e != (gvisorExecutor{}) {
+		t.Fatalf("gvisor: got %T, %v", e, err)
+	}
+	if e, err := selectExecutor(executorAuto); err != nil || e == nil {
+		t.Fatalf("auto: got %T, %v", e, err)
+	}
+	if _, err := selectExecutor("docker"); err == nil {
+		t.Fatal("unknown executor accepted")
+	}
+}
+
+func TestGVisorCommand(t *testing.T) {
+	oldRunsc := runscPath
+	defer func() { runscPath = oldRunsc }()
+	dir := t.TempDir()
+	runscPath = dir + "/runsc"
+	fake := "#!/bin/sh\necho \"$*\" >> " + dir + "/calls\n[ \"$5\" = run ] && { echo out; echo err >&2; exit 3; }\nexit 0\n"
+	if err := os.WriteFile(runscPath, []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	runDir, mountDir := t.TempDir(), "/tmp/sandboxd/x/rootfs"
+	cmd, cleanup, err := gvisorCommand(context.Background(), "exec1", mountDir, runDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 || string(out) != "out\n" {
+		t.Fatalf("out %q, err %v", out, err)
+	}
+	cleanup()
+
+	calls, _ := os.ReadFile(dir + "/calls")
+	state := runDir + "/runsc"
+	want := fmt.Sprintf("--root %[1]s --network=none --overlay2=none run --bundle %[2]s/bundle exec1\n--root %[1]s --network=none --overlay2=none delete --force exec1\n", state, runDir)
+	if string(calls) != want {
+		t.Fatalf("runsc calls:\n%s\nwant:\n%s", calls, want)
+	}
+
+	var spec struct {
+		Root struct {
+			Path     string `json:"path"`
+			Readonly bool   `json:"readonly"`
+		} `json:"root"`
+		Process struct {
+			Args []string `json:"args"`
+		} `json:"process"`
+	}
+	data, err := os.ReadFile(runDir + "/bundle/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Root.Path != mountDir || spec.Root.Readonly || strings.Join(spec.Process.Args, " ") != "/bin/sh "+guestRunScript {
+		t.Fatalf("spec: %+v", spec)
+	}
+}
+
+// fakeExecutor stands in for a VM so the HTTP layer can be tested alone.
+type fakeExecutor func(ctx context.Context, req RunRequest) (RunResponse, error)
+
+func (f fakeExecutor) Execute(ctx context.Context, req RunRequest) (RunResponse, error) {
+	return f(ctx, req)
+}
+
+func TestRunHandlerWithFakeExecutor(t *testing.T) {
+	old := executor
+	defer func() { executor = old }()
+
+	var got RunRequest
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		got = req
+		return RunResponse{Stdout: "hi\n", ExitCode: 3}, nil
+	})
+
+	resp := runRequest(t, map[string]any{"cmd": "echo hi; exit 3", "timeout_ms": 1500})
+	if got.Cmd != "echo hi; exit 3" || got.TimeoutMs != 1500 || got.execID == "" {
+		t.Fatalf("executor got %+v", got)
+	}
+	if resp.ExecID != got.execID || resp.Stdout != "hi\n" || resp.ExitCode != 3 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.SchemaVersion != responseSchemaVersion {
+		t.Fatalf("expected schema_version %d, got %d", responseSchemaVersion, resp.SchemaVersion)
+	}
+
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("no vm"))
+	})
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "true"}`)))
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get(schemaVersionHeader) != "1" {
+		t.Fatalf("missing %s header on an error response", schemaVersionHeader)
+	}
+
+	if err := validateRunRequest(RunRequest{Cmd: "true", OutputGlobs: []string{"../x"}}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+}
+
+func TestInjectFiles(t *testing.T) {
+	root := t.TempDir()
+	workDir := root + "/work"
+	if err := os.Mkdir(workDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := injectFiles(workDir, map[string]FileSpec{
+		"run.sh":          {Content: "#!/bin/sh\necho hi\n"},
+		"data/input.txt":  {Content: "plain data\n"},
+		"./a/../b/c.conf": {Content: "x"},
+	})
+	if err != nil {
+		t.Fatalf("injectFiles: %v", err)
+	}
+	want := map[string]os.FileMode{"run.sh": 0o755, "data/input.txt": 0o644, "b/c.conf": 0o644}
+	for name, perm := range want {
+		info, err := os.Stat(workDir + "/" + name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Fatalf("%s: expected %o, got %o", name, perm, info.Mode().Perm())
+		}
+	}
+
+	for _, name := range []string{"", "/etc/passwd", "..", "../escape", "a/../../escape", "data/../../escape", "."} {
+		err := injectFiles(workDir, map[string]FileSpec{name: {Content: "x"}})
+		if errorBodyFor(err).Code != errValidation {
+			t.Fatalf("%q: expected VALIDATION_ERROR, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(root + "/escape"); !os.IsNotExist(err) {
+		t.Fatalf("file written outside the work dir")
+	}
+}
+
+func TestStepsScriptAndResults(t *testing.T) {
+	steps := []StepSpec{
+		{Cmd: "echo building; echo warn >&2"},
+		{Cmd: "printf 'no newline'; exit 3", ContinueOnError: true},
+		{Cmd: "sleep 0.1; exit 4"},
+		{Cmd: "echo never"},
+	}
+
+	// Run the generated script with the host shell, relocated to a temp dir.
+	dir := t.TempDir()
+	script := strings.ReplaceAll(buildStepsScript(steps, "sh"), "/sandboxd/", dir+"/")
+	for i, step := range steps {
+		name := strings.ReplaceAll(guestStepScript(i), "/sandboxd/", dir+"/")
+		if err := os.WriteFile(name, []byte(step.Cmd+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := exec.Command("sh", "-c", script).Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 4 {
+		t.Fatalf("expected the pipeline to stop with 4, got %v\n%s", err, out)
+	}
+
+	// The console adds noise around the markers.
+	console := "[guest] init started\n" + string(out) + "[guest] exit code: 4\n"
+	results := parseStepResults(console)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 step results, got %d: %+v", len(results), results)
+	}
+	if results[0].Stdout != "building\n" || results[0].Stderr != "warn\n" || results[0].ExitCode != 0 {
+		t.Fatalf("step 0: %+v", results[0])
+	}
+	if results[1].Stdout != "no newline" || results[1].Stderr != "" || results[1].ExitCode != 3 {
+		t.Fatalf("step 1: %+v", results[1])
+	}
+	if results[2].ExitCode != 4 || results[2].DurationMs < 50 {
+		t.Fatalf("step 2: %+v", results[2])
+	}
+
+	for _, req := range []RunRequest{
+		{Cmd: "true", Steps: steps},
+		{Steps: []StepSpec{{Cmd: ""}}},
+	} {
+		if err := validateRunRequest(req); errorBodyFor(err).Code != errValidation {
+			t.Fatalf("%+v: expected a validation error, got %v", req, err)
+		}
+	}
+}
+
+func TestInitTimeoutIsAgentTimeout(t *testing.T) {
+	consolePath := t.TempDir() + "/console.log"
+	if err := os.WriteFile(consolePath, []byte("[    0.10] Linux version 6.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := waitForGuestInitStarted(context.Background(), consolePath, 100*time.Millisecond)
+	if errorBodyFor(err).Code != errAgentTimeout {
+		t.Fatalf("silent guest: got %v", err)
+	}
+
+	if err := os.WriteFile(consolePath, []byte("reboot: System halted\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = waitForGuestInitStarted(context.Background(), consolePath, time.Second)
+	if errorBodyFor(err).Code != errBootFailed {
+		t.Fatalf("halted guest: got %v", err)
+	}
+}
+
+func TestExtractDmesg(t *testing.T) {
+	console := "[guest] init started\nout\n\n" + dmesgBeginMarker + "\n[    0.00] Linux version 6.1\n[    1.20] oom-kill: task=node\n" +
+		dmesgEndMarker + "\n[guest] exit code: 0\n"
+	dmesg, rest := extractDmesg(console)
+	if dmesg != "[    0.00] Linux version 6.1\n[    1.20] oom-kill: task=node\n" {
+		t.Fatalf("dmesg: %q", dmesg)
+	}
+	if rest != "[guest] init started\nout\n[guest] exit code: 0\n" {
+		t.Fatalf("rest: %q", rest)
+	}
+
+	big := "\n" + dmesgBeginMarker + "\n" + strings.Repeat("x", maxDmesgBytes+10) + "END\n" + dmesgEndMarker + "\n"
+	if dmesg, _ := extractDmesg(big); len(dmesg) != maxDmesgBytes || !strings.HasSuffix(dmesg, "END\n") {
+		t.Fatalf("expected dmesg capped to its last %d bytes, got %d", maxDmesgBytes, len(dmesg))
+	}
+
+	if dmesg, rest := extractDmesg("plain\n"); dmesg != "" || rest != "plain\n" {
+		t.Fatalf("no block: %q %q", dmesg, rest)
+	}
+}
+
+func TestSetupSplitFromCommand(t *testing.T) {
+	dir := t.TempDir()
+	run := func(setup, cmd string) RunResponse {
+		t.Helper()
+		if err := os.WriteFile(dir+"/setup.sh", []byte(setup+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		script := strings.ReplaceAll(setupPrelude(), guestSetupScript, dir+"/setup.sh") + cmd + "\n"
+		out, err := exec.Command("sh", "-c", script).Output()
+		resp := RunResponse{Stdout: string(out)}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			resp.ExitCode = exitErr.ExitCode()
+		}
+		splitSetup(&resp)
+		return resp
+	}
+
+	resp := run("export GREETING=hi; echo preparing; echo noisy >&2", "echo $GREETING")
+	if resp.Stdout != "hi\n" || resp.SetupOutput != "preparing\nnoisy\n" || *resp.SetupExitCode != 0 || resp.ExitCode != 0 {
+		t.Fatalf("successful setup: %+v", resp)
+	}
+
+	resp = run("echo missing tarball; false", "echo never")
+	if resp.ExitCode != guestErrorExitCode || resp.Stderr != "setup failed with exit code 1" ||
+		resp.SetupOutput != "missing tarball\n" || strings.Contains(resp.Stdout, "never") {
+		t.Fatalf("failed setup: %+v", resp)
+	}
+
+	resp = run("exit 0", "echo never")
+	if resp.ExitCode != guestErrorExitCode || resp.Stderr != "setup exited before the command ran" {
+		t.Fatalf("setup calling exit: %+v", resp)
+	}
+}
+
+func TestFcPutHonorsContext(t *testing.T) {
+	socketPath := t.TempDir() + "/fc.sock"
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	defer close(release)
+
+	if err := fcPut(context.Background(), socketPath, "/machine-config", map[string]any{}); err != nil {
+		t.Fatalf("fcPut: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := fcPut(ctx, socketPath, "/slow", map[string]any{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context deadline, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("fcPut ignored cancellation")
+	}
+}
+
+func TestTmpfsWorkScript(t *testing.T) {
+	script := buildGuestScript(RunRequest{Cmd: "make", TmpfsWork: true, Files: map[string]FileSpec{"Makefile": {}}})
+	mount := strings.Index(script, "mount -t tmpfs -o size=64m sandboxd-work /work")
+	cd := strings.Index(script, "cd /work")
+	if mount < 0 || cd < mount {
+		t.Fatalf("tmpfs must be mounted before the cd:\n%s", script)
+	}
+	if strings.Contains(script, "cp -a /work/.") {
+		t.Fatalf("copied back without output_globs:\n%s", script)
+	}
+
+	script = buildGuestScript(RunRequest{Cmd: "make", TmpfsWork: true, TmpfsWorkMB: 128, OutputGlobs: []string{"out/*"}})
+	if !strings.Contains(script, "size=128m") || !strings.Contains(script, "cp -a /work/. "+guestWorkSeed+"/\nsync\n") {
+		t.Fatalf("expected outputs copied back before sync:\n%s", script)
+	}
+
+	for _, mb := range []int{-1, maxTmpfsWorkMB + 1} {
+		if err := validateRunRequest(RunRequest{Cmd: "true", TmpfsWork: true, TmpfsWorkMB: mb}); errorBodyFor(err).Code != errValidation {
+			t.Fatalf("tmpfs_work_mb %d: got %v", mb, err)
+		}
+	}
+}
+
+func TestTtyRun(t *testing.T) {
+	script := buildGuestScript(RunRequest{Cmd: "ls", Tty: true})
+	if !strings.Contains(script, guestHelper+" guest-exec -tty -seccomp none -- sh "+guestCmdScript) {
+		t.Fatalf("tty run line missing:\n%s", script)
+	}
+
+	master, slave, err := openPTY()
+	if err != nil {
+		t.Skipf("no pty available: %v", err)
+	}
+	master.Close()
+	slave.Close()
+
+	var out bytes.Buffer
+	sh, _ := exec.LookPath("sh")
+	code, err := runWithPTY(sh, []string{"sh", "-c", "test -t 1 && echo tty; echo err >&2; exit 3"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 || out.String() != "tty\r\nerr\r\n" {
+		t.Fatalf("got code %d output %q", code, out.String())
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	oldExec, oldMax := executor, maxBodyBytes
+	defer func() { executor, maxBodyBytes = oldExec, oldMax }()
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		return RunResponse{}, nil
+	})
+	maxBodyBytes = 64
+
+	for _, ct := range []string{"application/json", "text/plain"} {
+		body := `{"cmd": "echo ` + strings.Repeat("x", 100) + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body))
+		req.Header.Set("Content-Type", ct)
+		rr := httptest.NewRecorder()
+		runHandler(rr, req)
+		if rr.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rr.Body.String(), errPayloadTooLarge) {
+			t.Fatalf("%s: expected 413, got %d body=%s", ct, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "true"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("small body: got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	// An oversized Content-Length is refused without reading the body.
+	req := httptest.NewRequest(http.MethodPost, "/run", iotest.ErrReader(errors.New("body was read")))
+	req.ContentLength = 1 << 30
+	rr = httptest.NewRecorder()
+	runHandler(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rr.Body.String(), "1073741824 bytes exceeds 64 bytes") {
+		t.Fatalf("Content-Length: expected 413, got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestBuildRootfs(t *testing.T) {
+	// The overlay branch re-execs init, which mounts /proc again then.
+	if n := strings.Count(guestInitScript, "mount -t proc"); n != 1 {
+		t.Fatalf("init mounts /proc %d times", n)
+	}
+	for _, tool := range []string{"mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	base := t.TempDir()
+	if err := os.MkdirAll(base+"/sbin", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/bin/busybox", base+"/sbin/init"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+"/etc-marker", []byte("base\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir() + "/rootfs.ext4"
+	if err := buildRootfs(rootfsBuild{Base: base, Out: out, SizeMB: 64, Init: "/sbin/init"}); err != nil {
+		t.Fatal(err)
+	}
+	cat := func(path string) string {
+		b, err := exec.Command("debugfs", "-R", "cat "+path, out).Output()
+		if err != nil {
+			t.Fatalf("debugfs cat %s: %v", path, err)
+		}
+		return string(b)
+	}
+	if got := cat("/sbin/init"); got != guestInitScript {
+		t.Fatalf("init not installed, got %q", got)
+	}
+	if got := cat("/etc-marker"); got != "base\n" {
+		t.Fatalf("base not copied, got %q", got)
+	}
+	ls, _ := exec.Command("debugfs", "-R", "ls -l /sandboxd", out).Output()
+	if !strings.Contains(string(ls), "sandboxd") {
+		t.Fatalf("guest helper missing:\n%s", ls)
+	}
+
+	if err := buildRootfs(rootfsBuild{Base: base, Out: out, SizeMB: 64, Init: "sbin/init"}); err == nil {
+		t.Fatal("expected a relative -init to be rejected")
+	}
+}
+
+func TestBuildRootfsOCI(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	type entry struct{ name, body string }
+	layer := func(entries ...entry) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(zw)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+			if strings.HasSuffix(e.name, "/") {
+				hdr = &tar.Header{Name: e.name, Mode: 0o755, Typeflag: tar.TypeDir}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			_, _ = tw.Write([]byte(e.body))
+		}
+		_ = tw.Close()
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	layout := t.TempDir()
+	if err := os.MkdirAll(layout+"/blobs/sha256", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	blob := func(data []byte) string {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		if err := os.WriteFile(layout+"/blobs/sha256/"+digest[7:], data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	lower := blob(layer(entry{"etc/", ""}, entry{"etc/keep", "keep\n"}, entry{"etc/gone", "x"}, entry{"opq/", ""}, entry{"opq/old", "x"}))
+	upper := blob(layer(entry{"etc/.wh.gone", ""}, entry{"opq/new", "new\n"}, entry{"opq/.wh..wh..opq", ""}))
+	manifest := blob([]byte(`{"layers": [{"digest": "` + lower + `"}, {"digest": "` + upper + `"}]}`))
+	// A multi-platform index in front of the manifest, as registries serve.
+	index := blob([]byte(`{"manifests": [
+		{"digest": "sha256:` + strings.Repeat("0", 64) + `", "platform": {"os": "linux", "architecture": "s390x"}},
+		{"digest": "` + manifest + `", "platform": {"os": "linux", "architecture": "` + runtime.GOARCH + `"}}]}`))
+	if err := os.WriteFile(layout+"/index.json", []byte(`{"manifests": [{"digest": "`+index+`"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir() + "/rootfs.ext4"
+	if err := buildRootfs(rootfsBuild{OCI: layout, Out: out, SizeMB: 64, Init: "/sbin/init"}); err != nil {
+		t.Fatal(err)
+	}
+	cat := func(path string) string {
+		b, _ := exec.Command("debugfs", "-R", "cat "+path, out).Output()
+		return string(b)
+	}
+	if got := cat("/etc/keep"); got != "keep\n" {
+		t.Fatalf("/etc/keep: got %q", got)
+	}
+	if got := cat("/opq/new"); got != "new\n" {
+		t.Fatalf("/opq/new: got %q", got)
+	}
+	for _, dir := range []string{"/etc", "/opq"} {
+		ls, _ := exec.Command("debugfs", "-R", "ls "+dir, out).Output()
+		if strings.Contains(string(ls), "gone") || strings.Contains(string(ls), "old") || strings.Contains(string(ls), ".wh.") {
+			t.Fatalf("whiteout not applied in %s:\n%s", dir, ls)
+		}
+	}
+	if got := cat("/sbin/init"); got != guestInitScript {
+		t.Fatalf("init not installed, got %q", got)
+	}
+
+	images := t.TempDir() + "/images.json"
+	if err := os.WriteFile(images, []byte(`{"other": {"kernel_path": "/k", "rootfs_path": "/r"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerRootfs(rootfsBuild{Out: out, Init: "/sbin/init", Register: images, Name: "oci", Kernel: "/srv/vmlinux"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(images)
+	var profiles map[string]imageProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		t.Fatal(err)
+	}
+	if p := profiles["oci"]; p.RootfsPath != out || p.KernelPath != "/srv/vmlinux" || profiles["other"].RootfsPath != "/r" {
+		t.Fatalf("unexpected profiles: %s", data)
+	}
+}
+
+func TestUnmountImageBusy(t *testing.T) {
+	bin := t.TempDir()
+	calls := bin + "/calls"
+	// Busy for the first BUSY plain attempts; a lazy umount always works.
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\n" +
+		"[ \"$1\" = -l ] && exit 0\n" +
+		"[ $(wc -l < " + calls + ") -gt $BUSY ] && exit 0\n" +
+		"echo \"umount: $1: target is busy.\" >&2\nexit 32\n"
+	if err := os.WriteFile(bin+"/umount", []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	oldRetries, oldBackoff := mountRetries, mountBackoff
+	defer func() { mountRetries, mountBackoff = oldRetries, oldBackoff }()
+	mountRetries, mountBackoff = 2, time.Millisecond
+
+	t.Setenv("BUSY", "2")
+	if err := unmountImage("/mnt"); err != nil {
+		t.Fatalf("expected success after retries: %v", err)
+	}
+	if data, _ := os.ReadFile(calls); string(data) != "/mnt\n/mnt\n/mnt\n" {
+		t.Fatalf("unexpected umount calls:\n%s", data)
+	}
+
+	os.Remove(calls)
+	t.Setenv("BUSY", "100")
+	if err := unmountImage("/mnt"); err != nil {
+		t.Fatalf("expected the lazy fallback to succeed: %v", err)
+	}
+	if data, _ := os.ReadFile(calls); !strings.HasSuffix(string(data), "/mnt\n-l /mnt\n") {
+		t.Fatalf("expected a lazy umount last:\n%s", data)
+	}
+
+	if err := os.WriteFile(bin+"/umount", []byte("#!/bin/sh\necho 'umount: /mnt: not mounted.' >&2\nexit 32\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unmountImage("/mnt"); err == nil || !strings.Contains(err.Error(), "not mounted") {
+		t.Fatalf("expected the umount error, got %v", err)
+	}
+}
+
+func TestGuestShell(t *testing.T) {
+	for name, want := range map[string]string{"": "sh", "sh": "/bin/sh", "bash": "/bin/bash", "/bin/dash": "/bin/dash"} {
+		if got, err := guestShellPath(name); err != nil || got != want {
+			t.Fatalf("shell %q: got %q, %v", name, got, err)
+		}
+	}
+	for _, name := range []string{"zsh", "/usr/bin/bash", "sh -x"} {
+		if err := validateRunRequest(RunRequest{Cmd: "true", Shell: name}); errorBodyFor(err).Code != errValidation {
+			t.Fatalf("shell %q: expected a validation error, got %v", name, err)
+		}
+	}
+
+	if script := buildGuestScript(RunRequest{Cmd: "[[ 1 ]]", Shell: "bash"}); !strings.Contains(script, "/bin/bash "+guestCmdScript+"\n") {
+		t.Fatalf("command not run with bash:\n%s", script)
+	}
+	if script := buildStepsScript([]StepSpec{{Cmd: "true"}}, "/bin/bash"); !strings.Contains(script, "/bin/bash "+guestStepScript(0)) {
+		t.Fatalf("step not run with bash:\n%s", script)
+	}
+
+	root := t.TempDir()
+	if err := os.MkdirAll(root+"/bin", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/bin/busybox", root+"/bin/sh"); err != nil {
+		t.Fatal(err)
+	}
+	err := installGuestScripts(root, RunRequest{Cmd: "true", Shell: "bash"})
+	if errorBodyFor(err).Code != errValidation || !strings.Contains(err.Error(), "/bin/bash") {
+		t.Fatalf("expected a missing-shell error, got %v", err)
+	}
+	if err := installGuestScripts(root, RunRequest{Cmd: "true", Shell: "sh"}); err != nil {
+		t.Fatalf("sh is a dangling-on-host symlink but present: %v", err)
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	oldExec, oldQueue := executor, spanQueue
+	defer func() { executor, spanQueue = oldExec, oldQueue }()
+	spanQueue = make(chan *span, 64)
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		_, s := startSpan(ctx, "exec")
+		s.finish(nil)
+		return RunResponse{ExitCode: 0}, nil
+	})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "true"}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	runHandler(httptest.NewRecorder(), req)
+	close(spanQueue)
+
+	collector := make(chan map[string]any, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			t.Errorf("unexpected export to %s", r.URL.Path)
+		}
+		collector <- body
+	}))
+	defer srv.Close()
+	exportSpans(srv.URL, spanQueue)
+
+	body := <-collector
+	rs := body["resourceSpans"].([]any)[0].(map[string]any)
+	spans := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	byName := map[string]map[string]any{}
+	for _, s := range spans {
+		m := s.(map[string]any)
+		if m["traceId"] != traceID {
+			t.Fatalf("span %v is not in the caller's trace", m["name"])
+		}
+		byName[m["name"].(string)] = m
+	}
+	root := byName["POST /run"]
+	if root == nil || root["parentSpanId"] != parentID || root["kind"] != float64(2) {
+		t.Fatalf("bad root span: %v", root)
+	}
+	for _, name := range []string{"validate", "exec", "response"} {
+		if byName[name] == nil || byName[name]["parentSpanId"] != root["spanId"] {
+			t.Fatalf("%s is not a child of the root span: %v", name, byName[name])
+		}
+	}
+
+	if _, _, ok := parseTraceparent("00-" + strings.Repeat("0", 32) + "-" + parentID + "-01"); ok {
+		t.Fatal("accepted an all-zero trace id")
+	}
+	spanQueue = nil
+	if _, s := startSpan(context.Background(), "off"); s != nil {
+		t.Fatal("expected no span with tracing off")
+	}
+}
+
+func TestExtraBootArgs(t *testing.T) {
+	old := allowExtraBootArgs
+	defer func() { allowExtraBootArgs = old }()
+
+	allowExtraBootArgs = false
+	if err := validateRunRequest(RunRequest{Cmd: "true", ExtraBootArgs: "nokaslr"}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("expected extra_boot_args to be refused by default, got %v", err)
+	}
+
+	allowExtraBootArgs = true
+	if err := validateRunRequest(RunRequest{Cmd: "true", ExtraBootArgs: "nokaslr systemd.unified_cgroup_hierarchy=0"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, args := range []string{"init=/bin/sh", "nokaslr panic=0", "rdinit=/x", "CMD=id", "-- x", `a="b c"`, "quiet\x00"} {
+		if err := validateRunRequest(RunRequest{Cmd: "true", ExtraBootArgs: args}); errorBodyFor(err).Code != errValidation {
+			t.Fatalf("%q: expected a validation error, got %v", args, err)
+		}
+	}
+
+	img := imageProfile{InitPath: "/sbin/init", CmdTransport: cmdTransportArg, extraBootArgs: "nokaslr"}
+	if got := img.bootArgs(); !strings.HasSuffix(got, "init=/sbin/init nokaslr -- sh "+guestRunScript) {
+		t.Fatalf("extra args must precede the command: %s", got)
+	}
+}
+
+func TestRootfsBusy(t *testing.T) {
+	img, err := lookupImage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockRootfs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = runExecution(context.Background(), "busy-test", RunRequest{Cmd: "true"})
+	if errorBodyFor(err).Code != errSandboxBusy {
+		t.Fatalf("expected SANDBOX_BUSY, got %v", err)
+	}
+	rr := httptest.NewRecorder()
+	writeError(rr, err)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rr.Code)
+	}
+	if _, err := os.Stat(runBaseDir + "/busy-test"); !os.IsNotExist(err) {
+		t.Fatalf("run dir left behind: %v", err)
+	}
+
+	unlock()
+	unlock, err = lockRootfs(img)
+	if err != nil {
+		t.Fatalf("rootfs still held after unlock: %v", err)
+	}
+	unlock()
+}
+
+func TestConfigFile(t *testing.T) {
+	oldProfiles := imageProfiles
+	defer func() { imageProfiles = oldProfiles }()
+	imageProfiles = map[string]imageProfile{"default": oldProfiles["default"]}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", ":7777", "")
+	maxMs := fs.Int("max-timeout-ms", 1000, "")
+	origins := fs.String("cors-origins", "", "")
+	keep := fs.Bool("debug-keep-alive", false, "")
+	secret := fs.String("callback-secret", "", "")
+	if err := fs.Parse([]string{"-listen", ":9000"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SANDBOXD_CALLBACK_SECRET", "from-env")
+
+	path := t.TempDir() + "/sandboxd.json"
+	config := `{
+		"listen": ":8080",
+		"max-timeout-ms": 30000,
+		"cors-origins": ["https://a.example", "https://b.example"],
+		"debug-keep-alive": true,
+		"callback-secret": "from-file",
+		"images": {"alpine": {"kernel_path": "/k", "rootfs_path": "/r"}}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != ":9000" || *secret != "" {
+		t.Fatalf("file overrode a flag or env setting: listen %q, secret %q", *listen, *secret)
+	}
+	if *maxMs != 30000 || *origins != "https://a.example,https://b.example" || !*keep {
+		t.Fatalf("file values not applied: %d %q %v", *maxMs, *origins, *keep)
+	}
+	if p := imageProfiles["alpine"]; p.RootfsPath != "/r" || p.InitPath != "/sbin/init" {
+		t.Fatalf("image not registered: %+v", p)
+	}
+
+	for _, bad := range []string{`{"max-timout-ms": 1}`, `{"max-timeout-ms": "soon"}`, `{"listen": {"port": 1}}`} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fresh := flag.NewFlagSet("test", flag.ContinueOnError)
+		fresh.Int("max-timeout-ms", 1000, "")
+		fresh.String("listen", ":7777", "")
+		if err := applyConfigFile(fresh, path); err == nil {
+			t.Fatalf("%s: expected an error", bad)
+		}
+	}
+
+	oldDefault := defaultImage
+	defer func() { defaultImage = oldDefault }()
+	defaultImage = "missing"
+	if err := validateConfig(":7777"); err == nil {
+		t.Fatal("expected an unknown default image to be rejected")
+	}
+	defaultImage = "alpine"
+	if err := validateConfig(":7777"); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := lookupImage(""); img.RootfsPath != "/r" {
+		t.Fatalf("requests without image should use default-image, got %+v", img)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	oldMax, oldReloader, oldToken := maxTimeoutMs, reloader, adminToken
+	oldImages := make(map[string]imageProfile)
+	for name, p := range imageProfiles {
+		oldImages[name] = p
+	}
+	defer func() {
+		maxTimeoutMs, reloader, adminToken, imageProfiles = oldMax, oldReloader, oldToken, oldImages
+	}()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.IntVar(&maxTimeoutMs, "max-timeout-ms", maxTimeoutMs, "")
+	fs.String("listen", ":7777", "")
+	otlp := fs.String("otlp-endpoint", "", "")
+	if err := fs.Parse([]string{"-listen", ":9000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := t.TempDir() + "/sandboxd.json"
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"max-timeout-ms": 1000, "listen": ":8080"}`)
+	reloader = newConfigReloader(fs, path)
+	if err := applyConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.loaded = loaded
+
+	adminToken = "s3cret"
+	post := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		adminReloadHandler(rr, req)
+		return rr
+	}
+	for _, token := range []string{"", "wrong"} {
+		if rr := post(token); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: status %d", token, rr.Code)
+		}
+	}
+
+	write(`{
+		"max-timeout-ms": 2000,
+		"listen": ":8081",
+		"otlp-endpoint": "http://collector:4318",
+		"images": {"extra": {"kernel_path": "/k", "rootfs_path": "/r"}}
+	}`)
+	// Requests keep reading live settings while the reload sets them; under
+	// -race this catches a read that skips liveMu.
+	stop, reading := make(chan struct{}), make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for once := false; ; once = true {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = validateTimeout(1500)
+			}
+			if !once {
+				close(reading)
+			}
+		}
+	}()
+	<-reading
+	rr := post("s3cret")
+	close(stop)
+	readers.Wait()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body)
+	}
+	var res reloadResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Applied) != "[images max-timeout-ms]" || fmt.Sprint(res.RestartRequired) != "[otlp-endpoint]" {
+		t.Fatalf("got %+v", res)
+	}
+	if maxTimeoutMs != 2000 || *otlp != "" {
+		t.Fatalf("max-timeout-ms %d, otlp-endpoint %q", maxTimeoutMs, *otlp)
+	}
+	if img, err := lookupImage("extra"); err != nil || img.RootfsPath != "/r" {
+		t.Fatalf("image not registered: %+v, %v", img, err)
+	}
+
+	write(`{"max-timeout-ms": -5, "listen": ":8081", "images": {"other": {"kernel_path": "/k", "rootfs_path": "/r2"}}}`)
+	if rr := post("s3cret"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid config: status %d", rr.Code)
+	}
+	if _, err := lookupImage("other"); maxTimeoutMs != 2000 || err == nil {
+		t.Fatal("a rejected reload must leave the old config in place")
+	}
+
+	adminToken = ""
+	if rr := post("s3cret"); rr.Code != http.StatusNotFound {
+		t.Fatalf("disabled admin endpoint: status %d", rr.Code)
+	}
+}
+
+func TestOOMDetection(t *testing.T) {
+	script := buildGuestScript(RunRequest{Cmd: "true"})
+	var check string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.Contains(line, "oom-kill:") {
+			check = line
+		}
+	}
+	if check == "" {
+		t.Fatalf("no OOM check in:\n%s", script)
+	}
+	if strings.Contains(buildGuestScript(RunRequest{Cmd: "true", hostKernel: true}), "oom-kill:") {
+		t.Fatal("OOM check must not read the host's kernel log")
+	}
+
+	bin := t.TempDir()
+	dmesg := "#!/bin/sh\necho '[    1.2] Out of memory: Killed process 42 (python3) total-vm:900000kB'\n"
+	if err := os.WriteFile(bin+"/dmesg", []byte(dmesg), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	run := func(rc int) string {
+		cmd := exec.Command("sh", "-c", fmt.Sprintf("printf 'partial'\nrc=%d\n%s", rc, check))
+		cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+		out, _ := cmd.Output()
+		return string(out)
+	}
+
+	oom, rest := extractOOM(run(137))
+	if !oom || rest != "partial" {
+		t.Fatalf("got oom=%v rest=%q", oom, rest)
+	}
+	if oom, _ := extractOOM(run(0)); oom {
+		t.Fatal("a successful run must not be flagged")
+	}
+}
+
+func TestCommandTimings(t *testing.T) {
+	if strings.Contains(buildGuestScript(RunRequest{Cmd: "true"}), "/proc/uptime") {
+		t.Fatal("timings must be opt-in")
+	}
+	var lines []string
+	for _, line := range strings.Split(buildGuestScript(RunRequest{Cmd: "true", Timings: true}), "\n") {
+		if strings.Contains(line, "sandboxd_t") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got timing lines %q", lines)
+	}
+	script := lines[0] + "\nprintf out\nsleep 0.2\n" + strings.Join(lines[1:], "\n")
+	out, err := exec.Command("sh", "-c", script).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms, rest := extractCommandTiming(string(out))
+	if rest != "out" {
+		t.Fatalf("rest = %q", rest)
+	}
+	if ms == nil || *ms < 150 || *ms > 5000 {
+		t.Fatalf("command_ms = %v", ms)
+	}
+	if ms, rest := extractCommandTiming("no marker"); ms != nil || rest != "no marker" {
+		t.Fatalf("got %v %q", ms, rest)
+	}
+}
+
+func TestCheckRunBase(t *testing.T) {
+	base := t.TempDir() + "/runs"
+	if err := checkRunBase(base, 0); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(base); len(entries) != 0 {
+		t.Fatalf("probe left behind: %v", entries)
+	}
+	if err := checkRunBase(base, 1<<40); err == nil || !strings.Contains(err.Error(), "MiB free") {
+		t.Fatalf("err = %v", err)
+	}
+
+	file := t.TempDir() + "/file"
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRunBase(file+"/runs", 0); err == nil {
+		t.Fatal("a base under a regular file must be rejected")
+	}
+}
+
+func TestParseJSONStdout(t *testing.T) {
+	oldExec := executor
+	defer func() { executor = oldExec }()
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		return RunResponse{Stdout: req.Cmd}, nil
+	})
+
+	for _, tc := range []struct {
+		stdout string
+		parse  bool
+		want   string
+	}{
+		{"{\"rows\": 3}\n", true, `{"rows":3}`},
+		{"[1, 2]", true, `[1,2]`},
+		{"{\"rows\": 3}\n", false, ""},
+		{"not json\n", true, ""},
+		{"{\"a\": 1}\n{\"b\": 2}\n", true, ""},
+		{"\n", true, ""},
+	} {
+		resp := runRequest(t, map[string]any{"cmd": tc.stdout, "parse_json_stdout": tc.parse})
+		if resp.Stdout != tc.stdout {
+			t.Errorf("%q: stdout changed to %q", tc.stdout, resp.Stdout)
+		}
+		if got := string(resp.StdoutJSON); got != tc.want {
+			t.Errorf("%q (parse=%v): stdout_json = %q, want %q", tc.stdout, tc.parse, got, tc.want)
+		}
+	}
+}
+
+func TestWorkQuota(t *testing.T) {
+	script := buildGuestScript(RunRequest{Cmd: "true", WorkQuotaMiB: 32})
+	if !strings.Contains(script, "mount -t tmpfs -o size=32m sandboxd-work /work") {
+		t.Fatalf("no 32m tmpfs /work in:\n%s", script)
+	}
+	if strings.Contains(buildGuestScript(RunRequest{Cmd: "true"}), workFullMarker) {
+		t.Fatal("the full check needs a tmpfs /work")
+	}
+	var check string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.Contains(line, workFullMarker) {
+			check = line
+		}
+	}
+
+	run := func(rc, availKB int) string {
+		bin := t.TempDir()
+		df := fmt.Sprintf("#!/bin/sh\necho 'Filesystem 1024-blocks Used Available Capacity Mounted on'\necho 'sandboxd-work 32768 0 %d 0%% /work'\n", availKB)
+		if err := os.WriteFile(bin+"/df", []byte(df), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("sh", "-c", fmt.Sprintf("printf 'partial'\nrc=%d\n%s", rc, check))
+		cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"))
+		out, _ := cmd.Output()
+		return string(out)
+	}
+	full, rest := extractFlagMarker(run(1, 12), workFullMarker)
+	if !full || rest != "partial" {
+		t.Fatalf("got full=%v rest=%q", full, rest)
+	}
+	if full, _ := extractFlagMarker(run(0, 12), workFullMarker); full {
+		t.Fatal("a successful run must not be flagged")
+	}
+	if full, _ := extractFlagMarker(run(1, 20000), workFullMarker); full {
+		t.Fatal("a run with room left must not be flagged")
+	}
+
+	for _, req := range []RunRequest{
+		{Cmd: "true", WorkQuotaMiB: maxTmpfsWorkMB + 1},
+		{Cmd: "true", WorkQuotaMiB: 16, TmpfsWork: true, TmpfsWorkMB: 32},
+	} {
+		if err := validateRunRequest(req); errorBodyFor(err).Code != errValidation {
+			t.Errorf("%+v: err = %v", req, err)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	oldExec, oldRecord, oldMax := executor, recordFile, maxBodyBytes
+	defer func() { executor, recordFile, maxBodyBytes = oldExec, oldRecord, oldMax }()
+	// Recorded lines carry the (escaped) response too, so they may well be
+	// longer than any accepted request body.
+	maxBodyBytes = 4 << 10
+	long := strings.Repeat("<", 16<<10)
+
+	f, err := os.CreateTemp(t.TempDir(), "record-*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recordFile = f
+
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		if req.Cmd == "boom" {
+			return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("no vm"))
+		}
+		return RunResponse{Stdout: req.Cmd + "\n", Stderr: long}, nil
+	})
+	for _, body := range []string{
+		`{"cmd": "echo a", "files": {"in.txt": "x"}}`,
+		`{"cmd": "echo b"}`,
+		`{"cmd": "boom"}`,
+	} {
+		runHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body)))
+	}
+	recordFile = nil
+
+	// The replay target now answers "echo b" differently.
+	var replayed []RunRequest
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		replayed = append(replayed, req)
+		if req.Cmd == "boom" {
+			return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("no vm"))
+		}
+		if req.Cmd == "echo b" {
+			return RunResponse{Stdout: "B\n", ExitCode: 1, Stderr: long}, nil
+		}
+		return RunResponse{Stdout: req.Cmd + "\n", Stderr: long}, nil
+	})
+	srv := httptest.NewServer(http.HandlerFunc(runHandler))
+	defer srv.Close()
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var report bytes.Buffer
+	differ, err := replayRuns(f, srv.URL, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differ != 1 || len(replayed) != 3 {
+		t.Fatalf("expected 1 of 3 runs to differ, got %d of %d:\n%s", differ, len(replayed), report.String())
+	}
+	if replayed[0].Files["in.txt"].Content != "x" {
+		t.Fatalf("files not replayed: %+v", replayed[0].Files)
+	}
+	for _, want := range []string{"line 1: same", `exit_code: recorded 0, replayed 1`, `stdout: recorded "echo b\n", replayed "B\n"`, "line 3: same"} {
+		if !strings.Contains(report.String(), want) {
+			t.Fatalf("report missing %q:\n%s", want, report.String())
+		}
+	}
+}
+
+func TestInjectFilesParallel(t *testing.T) {
+	workDir := t.TempDir()
+	files := make(map[string]FileSpec)
+	for i := 0; i < 200; i++ {
+		files[fmt.Sprintf("d%d/f%03d.txt", i%7, i)] = FileSpec{Content: fmt.Sprint(i)}
+	}
+	files["dup"] = FileSpec{Content: "first"}
+	files["./dup"] = FileSpec{Content: "second"}
+	if err := injectFiles(workDir, files); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(workDir + "/d3/f010.txt"); string(b) != "10" {
+		t.Fatalf("got %q", b)
+	}
+	// Sorted, "./dup" < "dup", so "dup" is written last.
+	if b, _ := os.ReadFile(workDir + "/dup"); string(b) != "first" {
+		t.Fatalf("expected the last name in sorted order to win, got %q", b)
+	}
+
+	if err := injectFiles(t.TempDir(), map[string]FileSpec{"a": {}, "a/b": {}}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("expected a file/directory conflict, got %v", err)
+	}
+
+	// Symlink failures happen while writing; the first name must win
+	// however the workers are scheduled.
+	workDir = t.TempDir()
+	for _, dir := range []string{"m", "z"} {
+		if err := os.Symlink("/etc", workDir+"/"+dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files = map[string]FileSpec{"z/x": {}, "m/x": {}}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("ok%02d", i)] = FileSpec{}
+	}
+	for i := 0; i < 20; i++ {
+		err := injectFiles(workDir, files)
+		if err == nil || !strings.HasPrefix(err.Error(), "m/x:") {
+			t.Fatalf("expected the m/x error, got %v", err)
+		}
+	}
+}
+
+func BenchmarkInjectFiles(b *testing.B) {
+	files := make(map[string]FileSpec)
+	for i := 0; i < 500; i++ {
+		files[fmt.Sprintf("src/pkg%d/file%d.txt", i%20, i)] = FileSpec{Content: strings.Repeat("x", 512)}
+	}
+	old := injectWorkers
+	defer func() { injectWorkers = old }()
+
+	for _, workers := range []int{1, old} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			injectWorkers = workers
+			for i := 0; i < b.N; i++ {
+				if err := injectFiles(b.TempDir(), files); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// skipWithoutFirecracker skips tb unless this host can boot the default
+// image: firecracker on PATH, /dev/kvm, root for the loop mount, and the
+// kernel and rootfs on disk.
+func skipWithoutFirecracker(tb testing.TB) {
+	tb.Helper()
+	if _, err := exec.LookPath("firecracker"); err != nil {
+		tb.Skip("firecracker not in PATH")
+	}
+	if _, err := os.Stat("/dev/kvm"); err != nil {
+		tb.Skip("no /dev/kvm")
+	}
+	if os.Geteuid() != 0 {
+		tb.Skip("mounting the rootfs needs root")
+	}
+	img, err := lookupImage("")
+	if err != nil {
+		tb.Skip(err)
+	}
+	for _, p := range []string{img.KernelPath, img.RootfsPath} {
+		if _, err := os.Stat(p); err != nil {
+			tb.Skip(err)
+		}
+	}
+}
+
+// benchmarkRun posts payload to runHandler b.N times and reports the mean
+// wall time per run.
+func benchmarkRun(b *testing.B, payload map[string]any) {
+	b.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rr := httptest.NewRecorder()
+		runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			b.Fatalf("status %d body=%s", rr.Code, rr.Body.String())
+		}
+		var resp RunResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			b.Fatal(err)
+		}
+		if resp.ExitCode != 0 {
+			b.Fatalf("exit_code %d stderr=%q", resp.ExitCode, resp.Stderr)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Milliseconds())/float64(b.N), "ms/run")
+}
+
+// BenchmarkRunHandler measures the HTTP layer alone: decoding, validation
+// and encoding around an executor that returns at once.
+func BenchmarkRunHandler(b *testing.B) {
+	old := executor
+	defer func() { executor = old }()
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		return RunResponse{Stdout: "hi\n"}, nil
+	})
+	benchmarkRun(b, map[string]any{"cmd": "echo hi"})
+}
+
+// BenchmarkRunEcho measures a cold boot end to end: mount, inject, boot,
+// run a trivial command and tear down.
+func BenchmarkRunEcho(b *testing.B) {
+	skipWithoutFirecracker(b)
+	benchmarkRun(b, map[string]any{"cmd": "true", "timeout_ms": 5000})
+}
+
+// BenchmarkRunFiles adds file injection to BenchmarkRunEcho so the two can
+// be compared for the cost of writing files into the image.
+func BenchmarkRunFiles(b *testing.B) {
+	skipWithoutFirecracker(b)
+	for _, n := range []int{10, 100} {
+		files := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			files[fmt.Sprintf("src/file%d.txt", i)] = map[string]any{"content": strings.Repeat("x", 1024)}
+		}
+		b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+			benchmarkRun(b, map[string]any{"cmd": "true", "timeout_ms": 5000, "files": files})
+		})
+	}
+}
+
+func TestPartialOutputWhenVMExits(t *testing.T) {
+	cmd := exec.Command("sleep", "0.2")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if processExited(cmd.Process) {
+		t.Fatal("reported a running process as exited")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !processExited(cmd.Process) {
+		if time.Now().After(deadline) {
+			t.Fatal("exit never detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("the check must not reap the child: %v", err)
+	}
+
+	consolePath := t.TempDir() + "/console.log"
+	if err := os.WriteFile(consolePath, []byte("[guest] init started\npartial out"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	text, code, err := waitForGuestCompletion(context.Background(), consolePath, 10*time.Second, 0, func() bool { return true })
+	if !errors.Is(err, errVMExited) || code != guestErrorExitCode || !strings.HasSuffix(text, "partial out") {
+		t.Fatalf("got %q, %d, %v", text, code, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("waited for the timeout instead of stopping at VM exit")
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	dir := t.TempDir()
+	for i, tc := range []struct {
+		console string
+		exited  bool
+		want    string
+	}{
+		{"[guest] init started\nhi\n[guest] exit code: 3\n", false, exitReasonExited},
+		{"[guest] init started\nreboot: System halted\n", false, exitReasonHalted},
+		{"[guest] init started\nstill going", true, exitReasonVMExited},
+		{"[guest] init started\nstill going", false, exitReasonTimeout},
+	} {
+		path := fmt.Sprintf("%s/console-%d.log", dir, i)
+		if err := os.WriteFile(path, []byte(tc.console), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := waitForGuestCompletion(context.Background(), path, 100*time.Millisecond, 0, func() bool { return tc.exited })
+		if got := exitReason(err); got != tc.want {
+			t.Errorf("%q: got %s (%v), want %s", tc.console, got, err, tc.want)
+		}
+	}
+	if got := killedResponse(RunRequest{}, "").ExitReason; got != exitReasonKilled {
+		t.Errorf("killed run: got %s", got)
+	}
+}
+
+func TestNoChdir(t *testing.T) {
+	files := map[string]FileSpec{"in.txt": {Content: "x"}}
+	if script := buildGuestScript(RunRequest{Cmd: "cat /work/in.txt", Files: files}); !strings.Contains(script, "cd /work") {
+		t.Fatalf("expected a cd into /work:\n%s", script)
+	}
+	if script := buildGuestScript(RunRequest{Cmd: "cat /work/in.txt", Files: files, NoChdir: true}); strings.Contains(script, "cd /work") {
+		t.Fatalf("no_chdir still changes directory:\n%s", script)
+	}
+}
+
+func TestDeterministicRun(t *testing.T) {
+	dir := t.TempDir()
+	cmd := "echo $PYTHONHASHSEED $SOURCE_DATE_EPOCH $TZ $LC_ALL\ngrep -m1 '\\[stack\\]' /proc/self/maps | cut -d' ' -f1\n"
+	if err := os.WriteFile(dir+"/cmd.sh", []byte(cmd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(req RunRequest) string {
+		script := strings.ReplaceAll(buildGuestScript(req), guestCmdScript, dir+"/cmd.sh")
+		out, err := exec.Command("sh", "-c", script).Output()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, script)
+		}
+		return string(out)
+	}
+
+	// The namespace executor's flavor, since the host kernel is what runs here.
+	req := RunRequest{Cmd: "true", Deterministic: true, hostKernel: true}
+	first, second := run(req), run(req)
+	if first != second {
+		t.Fatalf("runs differ:\n%s\n%s", first, second)
+	}
+	if !strings.HasPrefix(first, "0 315532800 UTC C\n") {
+		t.Fatalf("got %q", first)
+	}
+
+	if script := buildGuestScript(RunRequest{Cmd: "true", Deterministic: true, FakeTime: "2020-01-01T00:00:00Z"}); !strings.Contains(script, "FAKETIME='2020-01-01 00:00:00'") {
+		t.Fatalf("expected a frozen clock:\n%s", script)
+	}
+	if script := buildGuestScript(RunRequest{Cmd: "true", Deterministic: true}); strings.Contains(script, "setarch") {
+		t.Fatalf("guest kernels get norandmaps instead:\n%s", script)
+	}
+}
+
+func TestAsyncRun(t *testing.T) {
+	oldExec, oldTTL := executor, resultTTL
+	defer func() { executor, resultTTL = oldExec, oldTTL }()
+	release := make(chan struct{})
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		<-release
+		if req.Cmd == "boom" {
+			return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("no vm"))
+		}
+		return RunResponse{Stdout: "slow\n"}, nil
+	})
+
+	start := func(cmd string) string {
+		rr := httptest.NewRecorder()
+		runHandler(rr, httptest.NewRequest(http.MethodPost, "/run/async", strings.NewReader(`{"cmd": "`+cmd+`"}`)))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("status %d: %s", rr.Code, rr.Body)
+		}
+		var started struct {
+			ExecID string `json:"exec_id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil || started.ExecID == "" {
+			t.Fatalf("body %s: %v", rr.Body, err)
+		}
+		return started.ExecID
+	}
+	poll := func(id string) (int, resultPayload) {
+		rr := httptest.NewRecorder()
+		resultHandler(rr, httptest.NewRequest(http.MethodGet, "/run/result/"+id, nil))
+		var payload resultPayload
+		_ = json.Unmarshal(rr.Body.Bytes(), &payload)
+		return rr.Code, payload
+	}
+	wait := func(id string) resultPayload {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if code, payload := poll(id); code == http.StatusOK {
+				return payload
+			}
+		}
+		t.Fatalf("%s never finished", id)
+		return resultPayload{}
+	}
+
+	ok, failed := start("sleep 60"), start("boom")
+	if code, payload := poll(ok); code != http.StatusAccepted || payload.Status != "running" {
+		t.Fatalf("while running: %d %+v", code, payload)
+	}
+	close(release)
+
+	if payload := wait(ok); payload.Status != "done" || payload.Result == nil || payload.Result.Stdout != "slow\n" || payload.Result.ExecID != ok {
+		t.Fatalf("got %+v", payload)
+	}
+	if code, _ := poll(ok); code != http.StatusNotFound {
+		t.Fatalf("a fetched result must be gone, got %d", code)
+	}
+	if payload := wait(failed); payload.Status != "failed" || payload.Error == nil || payload.Error.Code != errBootFailed {
+		t.Fatalf("got %+v", payload)
+	}
+
+	resultTTL = 10 * time.Millisecond
+	expired := start("true")
+	time.Sleep(200 * time.Millisecond)
+	if code, _ := poll(expired); code != http.StatusNotFound {
+		t.Fatalf("an expired result must be gone, got %d", code)
+	}
+	waitRunsIdle(t)
+}
+
+// waitRunsIdle waits for async runs, which call finishRun after storing
+// their result, to be done with the run counters.
+func waitRunsIdle(t *testing.T) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); runsLeft().InFlight > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("async runs did not finish")
+		}
+	}
+}
+
+func TestStrictPaths(t *testing.T) {
+	oldAllow := allowFetchFiles
+	defer func() { allowFetchFiles = oldAllow }()
+	allowFetchFiles = true
+
+	files := func(names ...string) map[string]FileSpec {
+		m := make(map[string]FileSpec)
+		for _, name := range names {
+			m[name] = FileSpec{Content: "x"}
+		}
+		return m
+	}
+	for _, tc := range []struct {
+		files map[string]FileSpec
+		fetch map[string]string
+		ok    bool
+	}{
+		{files: files("main.sh", "lib/util.sh", "README"), ok: true},
+		{files: files("Main.sh", "main.sh")},
+		{files: files("a/b.txt", "a//b.txt")},
+		{files: files("./x", "x")},
+		{files: files("Src/a.go", "src/b.go")},
+		{files: files("data.csv"), fetch: map[string]string{"DATA.csv": "https://example.com/d"}},
+	} {
+		req := RunRequest{Cmd: "true", Files: tc.files, FetchFiles: tc.fetch}
+		if err := validateRunRequest(req); err != nil {
+			t.Fatalf("%v: strict_paths is off by default, got %v", tc.files, err)
+		}
+		req.StrictPaths = true
+		err := validateRunRequest(req)
+		if tc.ok != (err == nil) {
+			t.Errorf("%v %v: err = %v", tc.files, tc.fetch, err)
+		}
+		if err != nil && errorBodyFor(err).Code != errValidation {
+			t.Errorf("%v: code %s", tc.files, errorBodyFor(err).Code)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	oldExec := executor
+	defer func() { executor = oldExec }()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		n := calls.Add(1)
+		if req.Cmd == "flaky" && n == 1 {
+			return RunResponse{}, newAPIError(errBootFailed, fmt.Errorf("no vm"))
+		}
+		<-release
+		if ctx.Err() != nil {
+			return killedResponse(req, ""), nil
+		}
+		return RunResponse{Stdout: fmt.Sprintf("run %d\n", n)}, nil
+	})
+
+	post := func(ctx context.Context, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		runHandler(rr, req)
+		return rr
+	}
+
+	// The first client gives up; its retry must get the same run's result.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- post(ctx, "k1", `{"cmd": "make"}`) }()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	retry := make(chan *httptest.ResponseRecorder)
+	go func() { retry <- post(context.Background(), "k1", `{"cmd": "make"}`) }()
+	close(release)
+	<-first
+
+	rr := <-retry
+	if rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "true" || !strings.Contains(rr.Body.String(), `"stdout":"run 1\n"`) {
+		t.Fatalf("retry: %d %v %s", rr.Code, rr.Header(), rr.Body)
+	}
+	if rr := post(context.Background(), "k1", `{"cmd": "make"}`); !strings.Contains(rr.Body.String(), `"stdout":"run 1\n"`) {
+		t.Fatalf("replay after completion: %s", rr.Body)
+	}
+	if rr := post(context.Background(), "k1", `{"cmd": "make install"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("key reused for another request: %d %s", rr.Code, rr.Body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("executed %d times", n)
+	}
+
+	// Setup failures are not cached, so a retry runs again.
+	calls.Store(0)
+	if rr := post(context.Background(), "k2", `{"cmd": "flaky"}`); rr.Code != http.StatusBadGateway {
+		t.Fatalf("first attempt: %d %s", rr.Code, rr.Body)
+	}
+	if rr := post(context.Background(), "k2", `{"cmd": "flaky"}`); rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry after failure: %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestFetchFiles(t *testing.T) {
+	stalled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data.csv":
+			fmt.Fprint(w, "a,b\n1,2\n")
+		case "/big":
+			w.Write(bytes.Repeat([]byte("x"), 100))
+		case "/stall":
+			stalled <- struct{}{}
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	const wrongSum = "3f6a30e76d8aecd4b5f8a8bfc9ce0d0e4f3a3a0b0c7c5e6d1a3f4e6c2b1a0d9e"
+	ctx := context.Background()
+
+	workDir := t.TempDir()
+	if err := validateRunRequest(RunRequest{Cmd: "true", FetchFiles: map[string]string{"f": srv.URL}}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("fetch_files needs -allow-fetch-files, got %v", err)
+	}
+	// The test server is on loopback, which is refused by default.
+	if err := fetchFiles(ctx, workDir, map[string]string{"x": srv.URL + "/data.csv"}); errorBodyFor(err).Code != errFetchFailed || !strings.Contains(err.Error(), "not a public address") {
+		t.Fatalf("expected loopback to be refused, got %v", err)
+	}
+	if err := checkFetchDial("tcp", "169.254.169.254:80", nil); err == nil {
+		t.Fatal("expected link-local to be refused")
+	}
+	if err := checkFetchDial("tcp", "10.1.2.3:443", nil); err == nil {
+		t.Fatal("expected a private address to be refused")
+	}
+	if err := checkFetchDial("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Fatalf("public address refused: %v", err)
+	}
+	if _, err := os.Stat(workDir + "/x"); !os.IsNotExist(err) {
+		t.Fatal("refused fetch left a file behind")
+	}
+
+	// The transport can leave a dial running after its request has returned,
+	// so dials hold dialMu and the flags are only restored under it.
+	var dialMu sync.Mutex
+	oldClient := fetchClient
+	tr := oldClient.Transport.(*http.Transport).Clone()
+	dial := tr.DialContext
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialMu.Lock()
+		defer dialMu.Unlock()
+		return dial(ctx, network, addr)
+	}
+	client := *oldClient
+	client.Transport = tr
+	fetchClient = &client
+
+	oldMax, oldAllow, oldPrivate := maxFetchBytes, allowFetchFiles, allowFetchPrivate
+	defer func() {
+		tr.CloseIdleConnections()
+		dialMu.Lock()
+		defer dialMu.Unlock()
+		fetchClient, maxFetchBytes, allowFetchFiles, allowFetchPrivate = oldClient, oldMax, oldAllow, oldPrivate
+	}()
+	maxFetchBytes, allowFetchFiles, allowFetchPrivate = 50, true, true
+
+	if err := fetchFiles(ctx, workDir, map[string]string{"in/data.csv": srv.URL + "/data.csv"}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(workDir + "/in/data.csv"); string(b) != "a,b\n1,2\n" {
+		t.Fatalf("got %q", b)
+	}
+
+	good := fmt.Sprintf("sha256:%x:%s/data.csv", sha256Sum("a,b\n1,2\n"), srv.URL)
+	if err := fetchFiles(ctx, workDir, map[string]string{"ok.csv": good}); err != nil {
+		t.Fatalf("checksum should match: %v", err)
+	}
+
+	for name, v := range map[string]string{
+		"bad.csv": "sha256:" + wrongSum + ":" + srv.URL + "/data.csv",
+		"missing": srv.URL + "/missing?token=secret",
+		"big.bin": srv.URL + "/big",
+	} {
+		err := fetchFiles(ctx, workDir, map[string]string{name: v})
+		if errorBodyFor(err).Code != errFetchFailed || strings.Contains(err.Error(), "secret") {
+			t.Fatalf("%s: expected FETCH_FAILED without the query, got %v", name, err)
+		}
+		if _, err := os.Stat(workDir + "/" + name); !os.IsNotExist(err) {
+			t.Fatalf("%s: partial file left behind", name)
+		}
+	}
+
+	// Cancelled once the server has the request, as a DELETE would.
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		<-stalled
+		cancel()
+	}()
+	if err := fetchFiles(cancelled, workDir, map[string]string{"late.csv": srv.URL + "/stall"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled fetch to stop, got %v", err)
+	}
+
+	for _, v := range []string{"ftp://x/y", "sha256:abc:https://x/y", "/relative"} {
+		if err := validateRunRequest(RunRequest{Cmd: "true", FetchFiles: map[string]string{"f": v}}); errorBodyFor(err).Code != errValidation {
+			t.Fatalf("%q: expected a validation error, got %v", v, err)
+		}
+	}
+}
+
+func sha256Sum(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func TestCaptureCore(t *testing.T) {
+	if script := buildGuestScript(RunRequest{Cmd: "./a.out", CaptureCore: true}); !strings.Contains(script, "ulimit -c unlimited") || !strings.Contains(script, guestCoreDir+"/core.%e.%p' > /proc/sys/kernel/core_pattern") {
+		t.Fatalf("expected cores enabled:\n%s", script)
+	}
+	if script := buildGuestScript(RunRequest{Cmd: "./a.out", CaptureCore: true, hostKernel: true}); strings.Contains(script, "core_pattern") {
+		t.Fatalf("core_pattern belongs to the host:\n%s", script)
+	}
+
+	root := t.TempDir()
+	coreDir := root + guestCoreDir
+	if err := os.MkdirAll(coreDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(coreDir+"/core.old.1", []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(coreDir+"/core.old.1", time.Now(), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte{0x7f}, maxCoreBytes+1)
+	if err := os.WriteFile(coreDir+"/core.a.out.42", big, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	core := coreDump(root, 139)
+	if core == nil || core.Signal != "SIGSEGV" || core.Name != "core.a.out.42" || core.Size != maxCoreBytes+1 || len(core.Data) != maxCoreBytes || !core.Truncated {
+		t.Fatalf("got %+v", core)
+	}
+
+	if core := coreDump(t.TempDir(), 134); core == nil || core.Signal != "SIGABRT" || core.Data != nil {
+		t.Fatalf("signal without a core file: got %+v", core)
+	}
+	if core := coreDump(t.TempDir(), 1); core != nil {
+		t.Fatalf("plain failure: got %+v", core)
+	}
+
+	// A run clears cores left by the one before it.
+	if err := installGuestScripts(root, RunRequest{Cmd: "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if core := coreDump(root, 0); core != nil {
+		t.Fatalf("stale core returned: %+v", core)
+	}
+
+	// The guest controls the image, so a symlinked core dir is not followed.
+	linked := t.TempDir()
+	if err := os.MkdirAll(linked+"/sandboxd", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(coreDir, linked+guestCoreDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(coreDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(coreDir+"/core.x.1", []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if core := coreDump(linked, 0); core != nil {
+		t.Fatalf("followed a symlink: %+v", core)
+	}
+}
+
+func TestReadOnlyImage(t *testing.T) {
+	img := imageProfile{InitPath: "/sbin/init", CmdTransport: cmdTransportArg, ReadOnly: true}
+	if args := img.bootArgs(); !strings.Contains(args, " "+overlayBootParam+" -- sh ") {
+		t.Fatalf("overlay parameter must precede the command: %s", args)
+	}
+	if err := validateExtraBootArgs(overlayBootParam + "=0"); err == nil {
+		t.Fatal("extra_boot_args may not set the overlay parameter")
+	}
+
+	// A fake mkfs.ext4 keeps a copy of what it was asked to pack.
+	bin := t.TempDir()
+	if err := os.WriteFile(bin+"/mkfs.ext4", []byte("#!/bin/sh\ncp -a \"$4\" \"$5.d\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	runDir := t.TempDir()
+	drive := runDir + "/overlay.ext4"
+	req := RunRequest{Cmd: "cat in.txt", Files: map[string]FileSpec{"in.txt": {Content: "hi"}}}
+	if err := prepareOverlay(context.Background(), drive, runDir, req); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(drive + ".d/upper/work/in.txt"); err != nil || string(data) != "hi" {
+		t.Fatalf("injected file: %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(drive + ".d/upper" + guestCmdScript); err != nil || string(data) != "cat in.txt\n" {
+		t.Fatalf("command script: %q, %v", data, err)
+	}
+	if fi, err := os.Stat(drive + ".d/ovlwork"); err != nil || !fi.IsDir() {
+		t.Fatalf("overlayfs workdir missing: %v", err)
+	}
+	if _, err := os.Stat(runDir + "/overlay"); !os.IsNotExist(err) {
+		t.Fatalf("staging dir left behind: %v", err)
+	}
+}
+
+func TestMemoryAdmission(t *testing.T) {
+	oldBudget, oldWait := memBudgetMiB, admissionTimeout
+	defer func() { memBudgetMiB, admissionTimeout = oldBudget, oldWait }()
+	memBudgetMiB, admissionTimeout = 512, 0
+
+	if _, err := admitMemory(context.Background(), 1024); errorBodyFor(err).Code != errResourceExhausted {
+		t.Fatalf("oversized VM: got %v", err)
+	}
+	first, err := admitMemory(context.Background(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := admitMemory(context.Background(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admitMemory(context.Background(), 256); errorBodyFor(err).Code != errResourceExhausted {
+		t.Fatalf("full budget without waiting: got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	metricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rr.Body.String(), "\nsandboxd_memory_committed_mib 512\n") {
+		t.Fatalf("metrics:\n%s", rr.Body)
+	}
+
+	// A waiting run gets in once another gives its memory back.
+	admissionTimeout = 5 * time.Second
+	admitted := make(chan error)
+	go func() {
+		release, err := admitMemory(context.Background(), 256)
+		if err == nil {
+			release()
+		}
+		admitted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	first()
+	first() // releasing twice is harmless
+	if err := <-admitted; err != nil {
+		t.Fatalf("waiting run: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	third, err := admitMemory(ctx, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := admitMemory(ctx, 256); !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled wait: got %v", err)
+	}
+
+	admissionTimeout = 50 * time.Millisecond
+	if _, err := admitMemory(context.Background(), 256); errorBodyFor(err).Code != errResourceExhausted {
+		t.Fatalf("wait timeout: got %v", err)
+	}
+	second()
+	third()
+	if memCommitted != 0 || memWaiting != 0 {
+		t.Fatalf("committed %d, waiting %d after releasing everything", memCommitted, memWaiting)
+	}
+}
+
+func TestTermGrace(t *testing.T) {
+	old := termGrace
+	defer func() { termGrace = old }()
+
+	if script := buildGuestScript(RunRequest{Cmd: "true"}); strings.Contains(script, "sandboxd_watch") {
+		t.Fatalf("no watchdog without -term-grace:\n%s", script)
+	}
+
+	termGrace = time.Second
+	dir := t.TempDir()
+	cmd := "trap 'echo flushed; exit 3' TERM\necho started\nwhile :; do sleep 0.05; done\n"
+	if err := os.WriteFile(dir+"/cmd.sh", []byte(cmd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := strings.ReplaceAll(buildGuestScript(RunRequest{Cmd: cmd, TimeoutMs: 300, CaptureRusage: true, hostKernel: true}), guestCmdScript, dir+"/cmd.sh")
+	begin := time.Now()
+	out, _ := exec.Command("sh", "-c", script).Output()
+	if elapsed := time.Since(begin); elapsed > 3*time.Second {
+		t.Fatalf("watchdog did not stop the command (took %s)", elapsed)
+	}
+
+	resp := RunResponse{Stdout: string(out), ExitCode: 3, ExitReason: exitReasonExited}
+	terminated(&resp)
+	if resp.ExitCode != timeoutExitCode || resp.ExitReason != exitReasonTimeout || resp.Stderr != timeoutMessage {
+		t.Fatalf("got %+v", resp)
+	}
+	if !strings.Contains(resp.Stdout, "started\n") || !strings.Contains(resp.Stdout, "flushed\n") || strings.Contains(resp.Stdout, terminateMarker) {
+		t.Fatalf("stdout %q", resp.Stdout)
+	}
+
+	// One that ignores SIGTERM gets SIGKILL after the grace, still in the
+	// guest, and well before the host's backstop.
+	termGrace = 200 * time.Millisecond
+	if err := os.WriteFile(dir+"/cmd.sh", []byte("trap '' TERM\necho started\nwhile :; do sleep 0.05; done\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script = strings.ReplaceAll(buildGuestScript(RunRequest{Cmd: "x", TimeoutMs: 200, hostKernel: true}), guestCmdScript, dir+"/cmd.sh")
+	begin = time.Now()
+	out, _ = exec.Command("sh", "-c", script).Output()
+	if elapsed := time.Since(begin); elapsed > execTimeout(200)+backstop() {
+		t.Fatalf("watchdog did not kill the command (took %s)", elapsed)
+	}
+	resp = RunResponse{Stdout: string(out)}
+	terminated(&resp)
+	if resp.ExitCode != timeoutExitCode || resp.Stdout != "started\n" {
+		t.Fatalf("got %+v", resp)
+	}
+
+	// A command that finishes in time is left alone.
+	resp = RunResponse{Stdout: "done\n", ExitCode: 0, ExitReason: exitReasonExited}
+	terminated(&resp)
+	if resp.ExitCode != 0 || resp.Stderr != "" {
+		t.Fatalf("got %+v", resp)
+	}
+}
+
+func TestReturnScratch(t *testing.T) {
+	for _, req := range []RunRequest{
+		{Cmd: "true", ReturnScratch: true, ScratchMiB: maxScratchMiB + 1},
+		{Cmd: "true", ScratchMiB: 16},
+	} {
+		if err := validateRunRequest(req); errorBodyFor(err).Code != errValidation {
+			t.Errorf("%+v: got %v", req, err)
+		}
+	}
+	if _, err := (namespaceExecutor{}).Execute(context.Background(), RunRequest{Cmd: "true", ReturnScratch: true}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("namespace executor: got %v", err)
+	}
+
+	script := buildGuestScript(RunRequest{Cmd: "true", ReturnScratch: true, scratchDevice: "/dev/vdc"})
+	if !strings.Contains(script, "mount /dev/vdc /scratch ||") || !strings.Contains(script, "umount /scratch") {
+		t.Fatalf("scratch drive not mounted:\n%s", script)
+	}
+
+	bin := t.TempDir()
+	if err := os.WriteFile(bin+"/mkfs.ext4", []byte("#!/bin/sh\necho \"$*\" > \"$3.args\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	drive := t.TempDir() + "/scratch.ext4"
+	if err := createScratchDrive(drive, 0); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(drive); err != nil || fi.Size() != defaultScratchMiB<<20 {
+		t.Fatalf("drive: %v %v", fi, err)
+	}
+	if args, _ := os.ReadFile(drive + ".args"); string(args) != "-q -F "+drive+"\n" {
+		t.Fatalf("mkfs.ext4 %s", args)
+	}
+
+	root := t.TempDir()
+	for _, dir := range []string{"lost+found", "out/empty"} {
+		if err := os.MkdirAll(root+"/"+dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(root+"/out/a.txt", []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", root+"/out/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(root+"/out/fifo", 0o644); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := tarDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		got = append(got, fmt.Sprintf("%s:%s%s", hdr.Name, hdr.Linkname, data))
+	}
+	if want := "out/: out/a.txt:hello out/empty/: out/link:/etc/passwd"; strings.Join(got, " ") != want {
+		t.Fatalf("got %q, want %q", strings.Join(got, " "), want)
+	}
+
+	var buf bytes.Buffer
+	if err := writeTarResponse(&buf, RunResponse{Scratch: archive}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), scratchTarName) || strings.Contains(buf.String(), `"scratch"`) {
+		t.Fatal("scratch should be its own tar entry, not in the manifest")
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	oldExec, oldStrict := executor, strictJSON
+	defer func() { executor, strictJSON = oldExec, oldStrict }()
+	executor = fakeExecutor(func(ctx context.Context, req RunRequest) (RunResponse, error) {
+		return RunResponse{}, nil
+	})
+
+	post := func(body, header string) (int, string) {
+		r := httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body))
+		if header != "" {
+			r.Header.Set(strictHeader, header)
+		}
+		rr := httptest.NewRecorder()
+		runHandler(rr, r)
+		return rr.Code, rr.Body.String()
+	}
+
+	typo := `{"cmd": "true", "timeoutMs": 5, "bogus": 1}`
+	if code, body := post(typo, ""); code != http.StatusOK {
+		t.Fatalf("lenient by default: %d %s", code, body)
+	}
+	if code, body := post(typo, "true"); code != http.StatusBadRequest || !strings.Contains(body, "unknown fields: bogus, timeoutMs") {
+		t.Fatalf("strict header: %d %s", code, body)
+	}
+
+	strictJSON = true
+	if code, body := post(`{"steps": [{"cmd": "true", "continue_on_eror": true}]}`, ""); code != http.StatusBadRequest || !strings.Contains(body, "continue_on_eror") {
+		t.Fatalf("nested typo: %d %s", code, body)
+	}
+	if code, body := post(`{"cmd": "true", "timeout_ms": 5}`, ""); code != http.StatusOK {
+		t.Fatalf("valid body in strict mode: %d %s", code, body)
+	}
+	if code, body := post(typo, "false"); code != http.StatusOK {
+		t.Fatalf("header turns strict mode off: %d %s", code, body)
+	}
+}
+
+func TestGuestClockSync(t *testing.T) {
+	img := imageProfile{InitPath: "/sbin/init", CmdTransport: cmdTransportEnv}
+	before := time.Now().Unix()
+	args := img.bootArgs()
+	var booted int64
+	for _, param := range strings.Fields(args) {
+		if v, ok := strings.CutPrefix(param, clockBootParam+"="); ok {
+			booted, _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	if booted < before || booted > time.Now().Unix() {
+		t.Fatalf("boot args carry no current clock: %s", args)
+	}
+	allowExtraBootArgs = true
+	defer func() { allowExtraBootArgs = false }()
+	if err := validateRunRequest(RunRequest{Cmd: "true", ExtraBootArgs: clockBootParam + "=0"}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("extra_boot_args may not set the clock, got %v", err)
+	}
+	if script := buildGuestScript(RunRequest{Cmd: "true", hostKernel: true}); strings.Contains(script, clockBootParam) {
+		t.Fatalf("host kernel runs must not touch the clock:\n%s", script)
+	}
+
+	// Run just the clock loop against a fake cmdline and date(1), which
+	// reports the boot time plus $SKEW.
+	script := buildGuestScript(RunRequest{Cmd: "true"})
+	script = script[:strings.Index(script, "done\n")+len("done\n")]
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/cmdline", []byte("console=ttyS0 "+clockBootParam+"=1000 init=/sbin/init\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script = strings.ReplaceAll(script, "/proc/cmdline", dir+"/cmdline")
+	fakeDate := "#!/bin/sh\nif [ \"$1\" = +%s ]; then echo $((1000 + SKEW)); else echo \"$*\" >> " + dir + "/set; fi\n"
+	if err := os.WriteFile(dir+"/date", []byte(fakeDate), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	for _, tc := range []struct {
+		skew string
+		set  bool
+	}{{"0", false}, {"2", false}, {"-1", true}, {"3600", true}} {
+		_ = os.Remove(dir + "/set")
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Env = append(os.Environ(), "SKEW="+tc.skew)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("skew %s: %v", tc.skew, err)
+		}
+		set, _ := os.ReadFile(dir + "/set")
+		synced, rest := extractFlagMarker(string(out), clockSyncedMarker)
+		if synced != tc.set || (len(set) > 0) != tc.set || strings.TrimSpace(rest) != "" {
+			t.Fatalf("skew %s: out %q, date called with %q", tc.skew, out, set)
+		}
+		if tc.set && !strings.HasPrefix(string(set), "-s @") {
+			t.Fatalf("skew %s: date called with %q", tc.skew, set)
+		}
+	}
+}
+
+func TestFileNameErrors(t *testing.T) {
+	body := `{"cmd": "true", "files": {"ok.txt": "x", "../up": "x", "/etc/passwd": "x", "": "x", "bad-mode": {"content": "x", "mode": "999"}},
+		"fetch_files": {"a/../../b": "https://example.com/b"}}`
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp struct{ Error errorBody }
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range resp.Error.Fields {
+		got = append(got, f.Field+" "+f.Name+" "+f.Reason)
+	}
+	want := "files  empty|files ../up traversal|files /etc/passwd absolute|files bad-mode mode|fetch_files a/../../b traversal"
+	if strings.Join(got, "|") != want {
+		t.Fatalf("got fields %q", got)
+	}
+	if resp.Error.Code != errValidation || !strings.Contains(resp.Error.Message, `files "../up": path traversal is not allowed; `) {
+		t.Fatalf("unexpected error %+v", resp.Error)
+	}
+
+	// A single bad name reads as it always has, with its one field.
+	err := validateRunRequest(RunRequest{Cmd: "true", Files: map[string]FileSpec{"/x": {Content: "x"}}})
+	if b := errorBodyFor(err); b.Message != `files "/x": absolute paths are not allowed` || len(b.Fields) != 1 {
+		t.Fatalf("unexpected error %+v", b)
+	}
+}
+
+func TestImageEnv(t *testing.T) {
+	if err := registerImageProfiles(map[string]imageProfile{"bad-env": {KernelPath: "/k", RootfsPath: "/r", Env: map[string]string{"1X": "y"}}}); err == nil {
+		t.Fatal("expected an invalid env name to be rejected")
+	}
+	if err := validateRunRequest(RunRequest{Cmd: "true", Env: map[string]string{"A-B": "x"}}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("expected VALIDATION_ERROR, got %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/cmd.sh", []byte("echo \"$LANG|$TOOL|$QUOTED\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	req := RunRequest{
+		Cmd:        "x",
+		Env:        map[string]string{"TOOL": "request", "QUOTED": `it's "$HOME"`},
+		imageEnv:   map[string]string{"LANG": "C.UTF-8", "TOOL": "image"},
+		hostKernel: true,
+	}
+	script := strings.ReplaceAll(buildGuestScript(req), guestCmdScript, dir+"/cmd.sh")
+	out, err := exec.Command("sh", "-c", script).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "C.UTF-8|request|it's \"$HOME\"\n"; string(out) != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+}
+
+func TestLiveFiles(t *testing.T) {
+	if err := validateRunRequest(RunRequest{Cmd: "true", LiveFiles: true, Tty: true}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("expected live_files with tty to be refused, got %v", err)
+	}
+
+	// Run the wrapper on the host with a pipe for the console's input and a
+	// file for its output, and feed it the way the handler does.
+	dir := t.TempDir()
+	work := dir + "/work"
+	if err := os.Mkdir(work, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := "while [ ! -e " + work + "/in/b.txt ]; do sleep 0.02; done\ncat " + work + "/in/a.txt " + work + "/in/b.txt\nls -l " + work + "/in/b.txt\n"
+	if err := os.WriteFile(dir+"/cmd.sh", []byte(cmd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := buildGuestScript(RunRequest{Cmd: "x", LiveFiles: true, hostKernel: true})
+	for old, repl := range map[string]string{guestCmdScript: dir + "/cmd.sh", "stty -echo": "true", "=/work/": "=" + work + "/", "/tmp/sandboxd-incoming": dir + "/incoming"} {
+		if !strings.Contains(script, old) {
+			t.Fatalf("wrapper has no %q:\n%s", old, script)
+		}
+		script = strings.ReplaceAll(script, old, repl)
+	}
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinW.Close()
+	console, err := os.Create(dir + "/console.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer console.Close()
+	sh := exec.Command("sh", "-c", script)
+	sh.Stdin, sh.Stdout = stdinR, console
+	if err := sh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = stdinR.Close()
+
+	feed := &liveFeed{w: stdinW, consolePath: console.Name()}
+	// One frame per send: on a pipe, unlike the guest's tty, head may read
+	// past its lines.
+	if err := feed.send(context.Background(), map[string]FileSpec{"in/a.txt": {Content: strings.Repeat("first ", 30) + "\n"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if _, err := os.Stat(work + "/in/a.txt"); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("a.txt never appeared")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := feed.send(context.Background(), map[string]FileSpec{"in/b.txt": {Content: "#!/bin/sh\nsecond\n"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sh.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := os.ReadFile(console.Name())
+	ready, rest := extractFlagMarker(string(out), liveFilesMarker)
+	if !ready || !strings.HasPrefix(rest, strings.Repeat("first ", 30)+"\n#!/bin/sh\nsecond\n-rwxr-xr-x") {
+		t.Fatalf("console %q", out)
+	}
+
+	rr := httptest.NewRecorder()
+	executionHandler(rr, httptest.NewRequest(http.MethodPost, "/executions/nope/files", strings.NewReader(`{"files": {"a": "x"}}`)))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown execution: got %d body=%s", rr.Code, rr.Body.String())
+	}
+	registerExecution("plain", "true", func() {})
+	defer unregisterExecution("plain")
+	rr = httptest.NewRecorder()
+	executionHandler(rr, httptest.NewRequest(http.MethodPost, "/executions/plain/files", strings.NewReader(`{"files": {"../a": "x"}}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "traversal") {
+		t.Fatalf("bad name: got %d body=%s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	executionHandler(rr, httptest.NewRequest(http.MethodPost, "/executions/plain/files", strings.NewReader(`{"files": {"a": "x"}}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "live_files") {
+		t.Fatalf("run without live_files: got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestFakeShellExecutor(t *testing.T) {
+	old := executor
+	defer func() { executor = old }()
+	executor = fakeShellExecutor{}
+	if missing := missingTools(); len(missing) > 0 {
+		t.Fatalf("the fake executor needs no tools, got %v", missing)
+	}
+
+	resp := runRequest(t, map[string]any{
+		"cmd":          "cat in.txt; echo \"$GREETING\" > out.txt; echo oops >&2; exit 3",
+		"files":        map[string]string{"in.txt": "input\n"},
+		"env":          map[string]string{"GREETING": "hello"},
+		"output_globs": []string{"out.txt"},
+	})
+	if resp.Stdout != "input\n" || resp.Stderr != "oops\n" || resp.ExitCode != 3 || string(resp.Outputs["out.txt"]) != "hello\n" {
+		t.Fatalf("got %+v", resp)
+	}
+	if _, err := os.Stat(runBaseDir + "/" + resp.ExecID); !os.IsNotExist(err) {
+		t.Fatalf("run dir left behind: %v", err)
+	}
+
+	// A timeout takes the command's background children with it.
+	begin := time.Now()
+	resp = runRequest(t, map[string]any{"cmd": "sleep 5 & echo started; wait", "timeout_ms": 200})
+	if resp.ExitCode != timeoutExitCode || resp.Stdout != "started\n" || time.Since(begin) > 2*time.Second {
+		t.Fatalf("got %+v after %s", resp, time.Since(begin))
+	}
+
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "true", "steps": [], "tty": true}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "tty is not supported by the fake executor") {
+		t.Fatalf("got %d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestGuestHeartbeat(t *testing.T) {
+	if script := buildGuestScript(RunRequest{Cmd: "true"}); strings.Contains(script, heartbeatMarker) {
+		t.Fatalf("heartbeats must be opt-in:\n%s", script)
+	}
+
+	// The wrapper beats while the command runs, and the beats come out of
+	// the middle of a line without a trace.
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/cmd.sh", []byte("printf a; sleep 0.45; echo b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	script := buildGuestScript(RunRequest{Cmd: "x", hostKernel: true, heartbeat: 100 * time.Millisecond})
+	out, err := exec.Command("sh", "-c", strings.ReplaceAll(script, guestCmdScript, dir+"/cmd.sh")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(out), heartbeatMarker); n < 2 {
+		t.Fatalf("got %d heartbeats in %q", n, out)
+	}
+	if got := stripHeartbeats(string(out)); got != "ab\n" {
+		t.Fatalf("got %q after stripping heartbeats", got)
+	}
+
+	// A beating guest runs to completion; a silent one is given up on well
+	// before the timeout.
+	consolePath := dir + "/console.log"
+	if err := os.WriteFile(consolePath, []byte("[guest] init started\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		f, err := os.OpenFile(consolePath, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		for i := 0; i < 10; i++ {
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintf(f, "\n%s\n", heartbeatMarker)
+		}
+		fmt.Fprintf(f, "[guest] exit code: 0\n")
+	}()
+	if _, code, err := waitForGuestCompletion(context.Background(), consolePath, 5*time.Second, 100*time.Millisecond, nil); err != nil || code != 0 {
+		t.Fatalf("beating guest: %d, %v", code, err)
+	}
+
+	if err := os.WriteFile(consolePath, []byte("[guest] init started\nhi\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, code, err := waitForGuestCompletion(context.Background(), consolePath, 5*time.Second, 100*time.Millisecond, nil)
+	if !errors.Is(err, errGuestUnresponsive) || code != guestErrorExitCode || exitReason(err) != exitReasonStalled {
+		t.Fatalf("silent guest: %d, %v", code, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("waited for the timeout instead of the missed heartbeats")
+	}
+}
+
+func TestMaxRuns(t *testing.T) {
+	oldExecutor, oldMax, oldDone, oldStore := executor, maxRuns, runsDone, resultStore
+	defer func() {
+		executor, maxRuns, runsDone, resultStore = oldExecutor, oldMax, oldDone, oldStore
+		runsAdmitted, runsInFlight = 0, 0
+	}()
+	executor = fakeShellExecutor{}
+	resultStore = newMemoryResultStore()
+	maxRuns, runsAdmitted, runsInFlight, runsDone = 4, 0, 0, make(chan struct{})
+
+	health := func() (int, healthStatus) {
+		rr := httptest.NewRecorder()
+		healthzHandler(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var h healthStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &h); err != nil {
+			t.Fatalf("healthz: %v: %s", err, rr.Body.String())
+		}
+		return rr.Code, h
+	}
+	if code, h := health(); code != http.StatusOK || h.Status != "ok" || h.MaxRuns != 4 || h.RunsRemaining == nil || *h.RunsRemaining != 4 {
+		t.Fatalf("fresh server: %d %+v", code, h)
+	}
+
+	// Sessions take runs too, even ones that fail.
+	rr := httptest.NewRecorder()
+	sessionHandler(rr, httptest.NewRequest(http.MethodGet, "/session?image=nope", nil))
+	if code, h := health(); rr.Code == http.StatusSwitchingProtocols || code != http.StatusOK || *h.RunsRemaining != 3 || h.InFlight != 0 {
+		t.Fatalf("after a session: %d %+v", code, h)
+	}
+
+	if resp := runRequest(t, map[string]any{"cmd": "echo one"}); resp.Stdout != "one\n" {
+		t.Fatalf("got %+v", resp)
+	}
+	rr = httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run/async", strings.NewReader(`{"cmd": "echo two"}`)))
+	var started struct {
+		ExecID string `json:"exec_id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); rr.Code != http.StatusAccepted || err != nil {
+		t.Fatalf("async run: %d %s", rr.Code, rr.Body.String())
+	}
+	waitRunsIdle(t)
+	// The last run holds up the shutdown until it is done.
+	if err := admitRun(); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "true"}`)))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), errShuttingDown) {
+		t.Fatalf("run over the limit: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	sessionHandler(rr, httptest.NewRequest(http.MethodGet, "/session", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), errShuttingDown) {
+		t.Fatalf("session over the limit: %d %s", rr.Code, rr.Body.String())
+	}
+	if code, h := health(); code != http.StatusServiceUnavailable || h.Status != "draining" || *h.RunsRemaining != 0 || h.InFlight != 1 {
+		t.Fatalf("draining server: %d %+v", code, h)
+	}
+	select {
+	case <-runsDone:
+		t.Fatal("shut down with a run in flight")
+	default:
+	}
+	finishRun()
+	select {
+	case <-runsDone:
+	case <-time.After(time.Second):
+		t.Fatal("no shutdown after the last run")
+	}
+
+	// The async run's result is still served until it is fetched.
+	fetched := make(chan struct{})
+	go func() {
+		awaitResults()
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+		t.Fatal("shut down before the async result was fetched")
+	case <-time.After(300 * time.Millisecond):
+	}
+	rr = httptest.NewRecorder()
+	resultHandler(rr, httptest.NewRequest(http.MethodGet, "/run/result/"+started.ExecID, nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"stdout":"two\n"`) {
+		t.Fatalf("async result: %d %s", rr.Code, rr.Body.String())
+	}
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after the async result was fetched")
+	}
+}
+
+func TestCollectVMMetrics(t *testing.T) {
+	dir := t.TempDir()
+	// Two flushes (deltas) and one cut short by the VM going away; the
+	// socket is gone, so nothing more gets flushed.
+	flushes := `{"utc_timestamp_ms": 1, "block": {"read_bytes": 4096, "write_bytes": 512, "read_count": 2, "write_count": 1}, "vcpu": {"exit_io_in": 10, "exit_io_out": 5, "exit_mmio_read": 3, "exit_mmio_write": 1}}
+{"utc_timestamp_ms": 2, "block": {"read_bytes": 1024, "write_bytes": 0, "read_count": 1, "write_count": 0}, "vcpu": {"exit_io_in": 1, "exit_io_out": 0, "exit_mmio_read": 0, "exit_mmio_write": 2}}
+{"utc_timestamp_ms": 3, "block": {"read_by`
+	if err := os.WriteFile(fcMetricsPath(dir), []byte(flushes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := collectVMMetrics(context.Background(), dir+"/gone.sock", fcMetricsPath(dir))
+	want := VMMetrics{BlockReadBytes: 5120, BlockWriteBytes: 512, BlockReadCount: 3, BlockWriteCount: 1, VcpuExitsIO: 16, VcpuExitsMMIO: 6}
+	if got == nil || *got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got := collectVMMetrics(context.Background(), dir+"/gone.sock", dir+"/missing.json"); got != nil {
+		t.Fatalf("no metrics file: got %+v", got)
+	}
+}
+
+func TestHostnameAndHosts(t *testing.T) {
+	for _, tc := range []struct {
+		hostname string
+		entries  map[string]string
+		ok       bool
+	}{
+		{"build-01.example.com", map[string]string{"db": "10.0.0.5", "api.internal": "fd00::1"}, true},
+		{"-bad", nil, false},
+		{"a b", nil, false},
+		{strings.Repeat("a", 65), nil, false},
+		{"", map[string]string{"db": "10.0.0.300"}, false},
+		{"", map[string]string{"db;rm": "10.0.0.5"}, false},
+	} {
+		err := validateRunRequest(RunRequest{Cmd: "true", Hostname: tc.hostname, HostsEntries: tc.entries})
+		if (err == nil) != tc.ok || (err != nil && errorBodyFor(err).Code != errValidation) {
+			t.Errorf("%q %v: got %v", tc.hostname, tc.entries, err)
+		}
+	}
+
+	script := buildGuestScript(RunRequest{Cmd: "true", Hostname: "build-01"})
+	if !strings.Contains(script, "hostname 'build-01'") || strings.Contains(script, guestHostsFile) {
+		t.Fatalf("hostname only:\n%s", script)
+	}
+
+	// Run the /etc/hosts part against a stand-in file, with cp for the bind
+	// mount.
+	script = buildGuestScript(RunRequest{Cmd: "true", hostKernel: true, HostsEntries: map[string]string{"db": "10.0.0.5", "api": "fd00:0::1"}})
+	start := strings.Index(script, "{ cat /etc/hosts")
+	end := strings.Index(script[start:], "; }\n") + start + len("; }\n")
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/hosts", []byte("127.0.0.1\tlocalhost\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	part := strings.NewReplacer(guestHostsFile, dir+"/new-hosts", "/etc/hosts", dir+"/hosts", "mount --bind", "cp").Replace(script[start:end])
+	if out, err := exec.Command("sh", "-c", part).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s\n%s", err, out, part)
+	}
+	hosts, _ := os.ReadFile(dir + "/hosts")
+	if want := "127.0.0.1\tlocalhost\nfd00::1\tapi\n10.0.0.5\tdb\n"; string(hosts) != want {
+		t.Fatalf("got %q, want %q", hosts, want)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	oldPct, oldWindow, oldCooldown := breakerFailurePct, breakerWindow, breakerCooldown
+	reset := func() { breakerState, breakerOutcomes, breakerProbing = breakerClosed, nil, false }
+	defer func() {
+		breakerFailurePct, breakerWindow, breakerCooldown = oldPct, oldWindow, oldCooldown
+		reset()
+	}()
+	breakerFailurePct, breakerWindow, breakerCooldown = 50, 4, 200*time.Millisecond
+	reset()
+
+	run := func(runErr error) {
+		t.Helper()
+		done, err := admitBreaker()
+		if err != nil {
+			t.Fatalf("refused with the breaker %s: %v", breakerStatus(), err)
+		}
+		done(runErr)
+	}
+	bootFailed := newAPIError(errBootFailed, errors.New("no loop device"))
+	run(nil)
+	run(newAPIError(errValidation, errors.New("bad request"))) // not counted
+	run(bootFailed)
+	run(nil)
+	if breakerStatus() != breakerClosed {
+		t.Fatalf("opened with 1 of %d failed", breakerWindow)
+	}
+
+	// Prewarm boots count like runs.
+	dir := t.TempDir()
+	for _, f := range []string{"/vmlinux", "/rootfs.ext4"} {
+		if err := os.WriteFile(dir+f, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imageProfiles["warm"] = imageProfile{KernelPath: dir + "/vmlinux", RootfsPath: dir + "/rootfs.ext4", InitPath: "/sbin/init", CmdTransport: cmdTransportEnv}
+	defer delete(imageProfiles, "warm")
+	oldExec := executor
+	defer func() { executor = oldExec }()
+	var boots atomic.Int32
+	executor = fakeExecutor(func(context.Context, RunRequest) (RunResponse, error) {
+		boots.Add(1)
+		return RunResponse{}, bootFailed
+	})
+	if res := prewarmImage(context.Background(), "warm"); res.OK {
+		t.Fatalf("got %+v", res)
+	}
+	if breakerStatus() != breakerOpen {
+		t.Fatalf("still %s with 2 of %d failed", breakerStatus(), breakerWindow)
+	}
+
+	rr := httptest.NewRecorder()
+	runHandler(rr, httptest.NewRequest(http.MethodPost, "/run", strings.NewReader(`{"cmd": "true"}`)))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), errHostDegraded) {
+		t.Fatalf("run with the breaker open: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	sessionHandler(rr, httptest.NewRequest(http.MethodGet, "/session", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), errHostDegraded) {
+		t.Fatalf("session with the breaker open: %d %s", rr.Code, rr.Body.String())
+	}
+	if res := prewarmImage(context.Background(), "warm"); res.OK || !strings.Contains(res.Error, "circuit breaker open") || boots.Load() != 1 {
+		t.Fatalf("prewarm with the breaker open: %+v (%d boots)", res, boots.Load())
+	}
+	rr = httptest.NewRecorder()
+	healthzHandler(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), `"status":"degraded","in_flight":0,"breaker":"open"`) {
+		t.Fatalf("healthz: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// After the cooldown one probe at a time goes through.
+	time.Sleep(breakerCooldown)
+	if breakerStatus() != breakerHalfOpen {
+		t.Fatalf("got %s after the cooldown", breakerStatus())
+	}
+	probe, err := admitBreaker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admitBreaker(); errorBodyFor(err).Code != errHostDegraded {
+		t.Fatalf("second run during a probe: %v", err)
+	}
+	probe(bootFailed)
+	if _, err := admitBreaker(); errorBodyFor(err).Code != errHostDegraded {
+		t.Fatalf("failed probe must reopen the breaker, got %v", err)
+	}
+	time.Sleep(breakerCooldown)
+	run(nil)
+	if breakerStatus() != breakerClosed {
+		t.Fatalf("got %s after a good probe", breakerStatus())
+	}
+}
+
+func TestLineBuffered(t *testing.T) {
+	if _, err := exec.LookPath("stdbuf"); err != nil {
+		t.Skip("stdbuf not installed")
+	}
+	if script := buildGuestScript(RunRequest{Cmd: "true"}); strings.Contains(script, "stdbuf") {
+		t.Fatalf("line buffering must be opt-in:\n%s", script)
+	}
+
+	// tr fully buffers into a file or pipe, so its line only shows up
+	// before it exits if stdbuf is in effect.
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/cmd.sh", []byte("(echo hi; sleep 5) | tr a-z A-Z\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, lineBuffered := range []bool{false, true} {
+		script := buildGuestScript(RunRequest{Cmd: "x", hostKernel: true, LineBuffered: lineBuffered})
+		out, err := os.Create(fmt.Sprintf("%s/out-%v", dir, lineBuffered))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("sh", "-c", strings.ReplaceAll(script, guestCmdScript, dir+"/cmd.sh"))
+		cmd.Stdout = out
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(500 * time.Millisecond)
+		got, _ := os.ReadFile(out.Name())
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		_ = cmd.Wait()
+		out.Close()
+		if want := map[bool]string{false: "", true: "HI\n"}[lineBuffered]; string(got) != want {
+			t.Errorf("line_buffered %v: got %q before the kill, want %q", lineBuffered, got, want)
+		}
+	}
+}
+
+// fakeRedis serves SET (with PX), GET, DEL, AUTH and SELECT over RESP. It
+// hangs up after every dropEvery-th command, if set, to exercise redials.
+func fakeRedis(t *testing.T, password string, dropEvery int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var (
+		mu       sync.Mutex
+		data     = map[string]string{}
+		expires  = map[string]time.Time{}
+		commands int
+	)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		authed := password == ""
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args := make([]string, n)
+			for i := range args {
+				line, _ := rd.ReadString('\n')
+				size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				buf := make([]byte, size+2)
+				if _, err := io.ReadFull(rd, buf); err != nil {
+					return
+				}
+				args[i] = string(buf[:size])
+			}
+			mu.Lock()
+			commands++
+			drop := dropEvery > 0 && commands%dropEvery == 0
+			reply := "+OK\r\n"
+			switch cmd := strings.ToUpper(args[0]); {
+			case cmd == "AUTH":
+				if authed = args[1] == password; !authed {
+					reply = "-WRONGPASS invalid password\r\n"
+				}
+			case !authed:
+				reply = "-NOAUTH Authentication required.\r\n"
+			case cmd == "SELECT":
+			case cmd == "SET":
+				ms, _ := strconv.Atoi(args[4])
+				data[args[1]], expires[args[1]] = args[2], time.Now().Add(time.Duration(ms)*time.Millisecond)
+			case cmd == "GET":
+				if v, ok := data[args[1]]; ok && time.Now().Before(expires[args[1]]) {
+					reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+				} else {
+					reply = "$-1\r\n"
+				}
+			case cmd == "DEL":
+				delete(data, args[1])
+				reply = ":1\r\n"
+			default:
+				reply = "-ERR unknown command\r\n"
+			}
+			mu.Unlock()
+			if drop {
+				return
+			}
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestResultStores(t *testing.T) {
+	addr := fakeRedis(t, "s3cret", 5)
+	redis, err := openResultStore("redis://:s3cret@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"redis://", "http://localhost", "redis://localhost/x"} {
+		if _, err := openResultStore(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+
+	for name, store := range map[string]ResultStore{"memory": newMemoryResultStore(), "redis": redis} {
+		for i := 0; i < 4; i++ { // enough commands for the fake to hang up
+			id := fmt.Sprintf("run-%d", i)
+			value := []byte("{\"stdout\": \"a\\r\\nb\"}\x00\xff")
+			if err := store.Put(id, value, time.Minute); err != nil {
+				t.Fatalf("%s put: %v", name, err)
+			}
+			if got, ok, err := store.Get(id); err != nil || !ok || !bytes.Equal(got, value) {
+				t.Fatalf("%s get: %q %v %v", name, got, ok, err)
+			}
+			if err := store.Delete(id); err != nil {
+				t.Fatalf("%s delete: %v", name, err)
+			}
+			if _, ok, err := store.Get(id); ok || err != nil {
+				t.Fatalf("%s: deleted entry still there (%v)", name, err)
+			}
+		}
+		if err := store.Put("short", []byte("x"), 50*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, ok, _ := store.Get("short"); ok {
+			t.Errorf("%s: entry outlived its ttl", name)
+		}
+	}
+
+	wrong, _ := openResultStore("redis://:nope@" + addr)
+	if err := wrong.Put("x", []byte("x"), time.Minute); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("wrong password: %v", err)
+	}
+
+	// Async results go through the configured store.
+	old := resultStore
+	defer func() { resultStore = old }()
+	resultStore = redis
+	startResult("abc")
+	if res, ok, err := takeResult("abc"); err != nil || !ok || res.Done {
+		t.Fatalf("running: %+v %v %v", res, ok, err)
+	}
+	finishResult("abc", RunResponse{Stdout: "hi\n"}, nil)
+	rr := httptest.NewRecorder()
+	resultHandler(rr, httptest.NewRequest(http.MethodGet, "/run/result/abc", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"stdout":"hi\n"`) {
+		t.Fatalf("done: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, ok, _ := takeResult("abc"); ok {
+		t.Fatal("a finished result must be handed out once")
+	}
+}
+
+func TestStdin(t *testing.T) {
+	for _, tc := range []struct {
+		req  RunRequest
+		want string
+	}{
+		{RunRequest{Cmd: "cat", Stdin: "x", StdinB64: "eA=="}, "mutually exclusive"},
+		{RunRequest{Cmd: "cat", StdinB64: "not base64!"}, "stdin_b64"},
+		{RunRequest{Cmd: "cat", Stdin: "x", Tty: true}, "cannot be combined"},
+	} {
+		if err := validateRunRequest(tc.req); errorBodyFor(err).Code != errValidation || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: got %v", tc.req, err)
+		}
+	}
+
+	// Every byte value, CR/LF pairs and no trailing newline must arrive as
+	// sent: run the wrapper as written to a stand-in image.
+	var data []byte
+	for i := 0; i < 512; i++ {
+		data = append(data, byte(i), '\r', '\n')
+	}
+	data = append(data, 0, 0xff)
+	sum := sha256.Sum256(data)
+	root := t.TempDir()
+	req := RunRequest{Cmd: "sha256sum", StdinB64: base64.StdEncoding.EncodeToString(data), hostKernel: true}
+	if err := writeGuestScripts(root, req); err != nil {
+		t.Fatal(err)
+	}
+	script, err := os.ReadFile(root + guestRunScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sh", "-c", strings.ReplaceAll(string(script), "/sandboxd/", root+"/sandboxd/")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(out)); len(got) == 0 || got[0] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("command read %q, want sha256 %x", out, sum)
+	}
+
+	// The next run without stdin must not see this one's.
+	if err := writeGuestScripts(root, RunRequest{Cmd: "cat", hostKernel: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root + guestStdinFile); !os.IsNotExist(err) {
+		t.Fatalf("stdin left behind: %v", err)
+	}
+
+	old := executor
+	defer func() { executor = old }()
+	executor = fakeShellExecutor{}
+	if resp := runRequest(t, map[string]any{"cmd": "tr a-z A-Z", "stdin": "hello\n"}); resp.Stdout != "HELLO\n" {
+		t.Fatalf("fake executor: got %+v", resp)
+	}
+}
+
+func TestPipefail(t *testing.T) {
+	if err := validateRunRequest(RunRequest{Cmd: "true", Shell: "dash", Pipefail: true}); errorBodyFor(err).Code != errValidation {
+		t.Fatalf("dash has no pipefail, got %v", err)
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	root := t.TempDir()
+	run := func(req RunRequest, shell, script string) (int, string) {
+		t.Helper()
+		req.hostKernel = true
+		if err := writeGuestScripts(root, req); err != nil {
+			t.Fatal(err)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(shell, root+script)
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		return cmd.ProcessState.ExitCode(), stderr.String()
+	}
+	if code, _ := run(RunRequest{Cmd: "false | true"}, "bash", guestCmdScript); code != 0 {
+		t.Fatalf("without pipefail: exit %d", code)
+	}
+	if code, _ := run(RunRequest{Cmd: "exit 3 | true", Pipefail: true}, "bash", guestCmdScript); code != 3 {
+		t.Fatalf("with pipefail: exit %d", code)
+	}
+	if code, _ := run(RunRequest{Steps: []StepSpec{{Cmd: "false | true"}}, Pipefail: true}, "bash", guestStepScript(0)); code != 1 {
+		t.Fatalf("step with pipefail: exit %d", code)
+	}
+	// A shell without the option says so instead of ignoring it.
+	if _, err := exec.LookPath("dash"); err == nil {
+		if code, stderr := run(RunRequest{Cmd: "false | true", Pipefail: true}, "dash", guestCmdScript); code != guestErrorExitCode || !strings.Contains(stderr, "does not support pipefail") {
+			t.Fatalf("dash: exit %d, stderr %q", code, stderr)
+		}
+	}
+}
+
+func TestOverallTimeout(t *testing.T) {
+	for _, ms := range []int{-1, maxOverallTimeoutMs() + 1, math.MaxInt} {
+		if err := validateRunRequest(RunRequest{Cmd: "true", OverallTimeoutMs: ms}); errorBodyFor(err).Code != errValidation {
+			t.Fatalf("overall_timeout_ms %d: %v", ms, err)
+		}
+	}
+	if d := overallTimeout(math.MaxInt); d <= 0 {
+		t.Fatalf("overallTimeout overflowed: %v", d)
+	}
+
+	// A run cut short keeps the steps it finished; a DELETE keeps nothing.
+	console := "[guest] step 0 begin 1.00\nstep 0 done\n\n[guest] step 0 stderr\n\n[guest] step 0 end 0 1.50\n[guest] step 1 begin 1.50\npartial"
+	req := RunRequest{Steps: []StepSpec{{Cmd: "a"}, {Cmd: "b"}}}
+	overall, cancel := context.WithTimeoutCause(context.Background(), 0, errOverallTimeout)
+	defer cancel()
+	<-overall.Done()
+	if resp := cancelledResponse(overall, req, "", console); resp.Stdout != console || len(resp.StepResults) != 1 || resp.StepResults[0].Stdout != "step 0 done\n" {
+		t.Fatalf("overall timeout: %+v", resp)
+	}
+	killed, kill := context.WithCancel(context.Background())
+	kill()
+	if resp := cancelledResponse(killed, req, "", console); resp.Stdout != "" || resp.StepResults != nil || resp.ExitReason != exitReasonKilled {
+		t.Fatalf("killed: %+v", resp)
+	}
+
+	vmOrFake(t)
+	begin := time.Now()
+	resp := runRequest(t, map[string]any{"cmd": "echo started; sleep 30", "timeout_ms": 60000, "overall_timeout_ms": 3000})
+	if resp.ExitReason != exitReasonOverall || resp.ExitCode != timeoutExitCode || !resp.OutputIncomplete ||
+		!strings.Contains(resp.Stderr, "overall timeout exceeded") || !strings.Contains(resp.Stdout, "started\n") {
+		t.Fatalf("got %+v", resp)
+	}
+	if time.Since(begin) > 10*time.Second {
+		t.Fatal("overall_timeout_ms did not cut the run short")
+	}
+
+	if resp := runRequest(t, map[string]any{"cmd": "echo done", "overall_timeout_ms": 60000}); resp.ExitReason != exitReasonExited || !strings.Contains(resp.Stdout, "done\n") {
+		t.Fatalf("run within the bound: %+v", resp)
+	}
+}